@@ -3,9 +3,10 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"gopkg.in/mgo.v2"
 )
 
 // AccountHandler dispatches requests to handlers that manage the /account resource based on
@@ -14,9 +15,12 @@ func AccountHandler(c *Context, w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "POST":
 		CreateHandler(c, w, r)
+	case "DELETE":
+		AccountDeletionHandler(c, w, r)
 	default:
 		APIError{
-			Message: fmt.Sprintf("Unsupported method %s. Only POST is accepted for this resource.",
+			Message: fmt.Sprintf(
+				"Unsupported method %s. Only POST and DELETE are accepted for this resource.",
 				r.Method),
 		}.Log("").Report(w, http.StatusMethodNotAllowed)
 	}
@@ -30,7 +34,7 @@ func CreateHandler(c *Context, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	account, err := NewAccount(accountName, password)
+	account, err := NewAccount(c.Hasher, accountName, password)
 	if err != nil {
 		APIError{
 			Message: fmt.Sprintf("Unable to create account: %v", err),
@@ -39,7 +43,7 @@ func CreateHandler(c *Context, w http.ResponseWriter, r *http.Request) {
 	}
 
 	err = c.Storage.CreateAccount(account)
-	if mgo.IsDup(err) {
+	if err == ErrAccountExists {
 		APIError{
 			Message: fmt.Sprintf(
 				`The account name "%s" has already been taken. Please choose another.`,
@@ -49,13 +53,185 @@ func CreateHandler(c *Context, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err != nil {
-		APIError{Message: "Internal storage error."}.Log(accountName).Report(w, http.StatusInternalServerError)
+		APIError{
+			UserMessage: "Internal storage error.",
+			LogMessage:  fmt.Sprintf("Unable to create account: %v", err),
+		}.Log(accountName).Report(w, StorageErrorStatus(err))
 		return
 	}
 
 	log.WithFields(log.Fields{
 		"account": accountName,
 	}).Info("Account created successfully.")
+	Audit(c, r, AuditEvent{Event: "account.created", Account: accountName, Actor: accountName})
 
 	w.WriteHeader(http.StatusCreated)
 }
+
+// AccountDeletionHandler closes an account, after verifying its password and, if it's enabled, its
+// second factor. The account and all of its API keys are removed from storage.
+func AccountDeletionHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	accountName, password, ok := ExtractPasswordCredentials(w, r, "Account deletion")
+	if !ok {
+		return
+	}
+
+	account, ok := AuthenticatePassword(c, w, r, accountName, password)
+	if !ok || !RequireSecondFactor(c, w, r, account) {
+		return
+	}
+
+	DeleteAccount(c, w, r, accountName, accountName)
+}
+
+// DeleteAccount removes an account that's already been authorized by the caller, and reports the
+// result. The deletion is audited as the work of actor.
+func DeleteAccount(c *Context, w http.ResponseWriter, r *http.Request, accountName, actor string) {
+	err := c.Storage.DeleteAccount(accountName)
+	if err == ErrAccountNotFound {
+		APIError{
+			Message: "Unrecognized account.",
+		}.Log(accountName).Report(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		APIError{
+			UserMessage: "Internal storage error.",
+			LogMessage:  fmt.Sprintf("Unable to delete account: %v", err),
+		}.Log(accountName).Report(w, StorageErrorStatus(err))
+		return
+	}
+
+	Audit(c, r, AuditEvent{Event: "account.deleted", Account: accountName, Actor: actor})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PasswordChangeHandler replaces an account's password, after verifying its current one and, if
+// it's enabled, its second factor. If the request's "revokeKeys" parameter is true, every API key on
+// the account is revoked as well.
+func PasswordChangeHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	if !MethodOk(w, r, "POST") {
+		return
+	}
+
+	accountName, password, ok := ExtractPasswordCredentials(w, r, "Password change")
+	if !ok {
+		return
+	}
+
+	newPassword := r.FormValue("newPassword")
+	if newPassword == "" {
+		APIError{
+			UserMessage: `Missing required parameter "newPassword".`,
+			LogMessage:  "Password change request missing required query parameters.",
+		}.Log(accountName).Report(w, http.StatusBadRequest)
+		return
+	}
+
+	revokeKeys := false
+	if raw := r.FormValue("revokeKeys"); raw != "" {
+		var err error
+		if revokeKeys, err = strconv.ParseBool(raw); err != nil {
+			APIError{
+				Message: fmt.Sprintf("Invalid revokeKeys [%s]: must be true or false.", raw),
+			}.Log(accountName).Report(w, http.StatusBadRequest)
+			return
+		}
+	}
+
+	account, ok := AuthenticatePassword(c, w, r, accountName, password)
+	if !ok || !RequireSecondFactor(c, w, r, account) {
+		return
+	}
+
+	if err := account.SetPassword(c.Hasher, newPassword, time.Now().UnixNano()); err != nil {
+		APIError{
+			UserMessage: "Unable to change your password. Please try again later.",
+			LogMessage:  fmt.Sprintf("Unable to hash password: %v", err),
+		}.Log(accountName).Report(w, http.StatusInternalServerError)
+		return
+	}
+
+	err := c.Storage.UpdatePassword(accountName, account.HashedPassword, account.UpdatedAt, revokeKeys)
+	if err != nil {
+		APIError{
+			UserMessage: "Internal storage error.",
+			LogMessage:  fmt.Sprintf("Unable to change password: %v", err),
+		}.Log(accountName).Report(w, StorageErrorStatus(err))
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"account":      accountName,
+		"revoked keys": revokeKeys,
+	}).Info("Account password changed.")
+	Audit(c, r, AuditEvent{
+		Event:   "password.changed",
+		Account: accountName,
+		Actor:   accountName,
+		Details: AuditDetails(log.Fields{"revoked keys": revokeKeys}),
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PasswordResetHandler replaces an account's password using a one-time reset token, for users who
+// have forgotten their current password. Tokens are issued on the internal API.
+func PasswordResetHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	if !MethodOk(w, r, "POST") {
+		return
+	}
+
+	accountName, token, ok := extractCredentials(w, r, "Password reset", "token")
+	if !ok {
+		return
+	}
+
+	newPassword := r.FormValue("newPassword")
+	if newPassword == "" {
+		APIError{
+			UserMessage: `Missing required parameter "newPassword".`,
+			LogMessage:  "Password reset request missing required query parameters.",
+		}.Log(accountName).Report(w, http.StatusBadRequest)
+		return
+	}
+
+	hashed, err := c.Hasher.Hash(newPassword)
+	if err != nil {
+		APIError{
+			UserMessage: "Unable to reset your password. Please try again later.",
+			LogMessage:  fmt.Sprintf("Unable to hash password: %v", err),
+		}.Log(accountName).Report(w, http.StatusInternalServerError)
+		return
+	}
+
+	err = c.Storage.ResetPassword(accountName, DigestResetToken(token), hashed, time.Now().UnixNano())
+	if err == ErrAccountNotFound || err == ErrResetTokenInvalid {
+		Audit(c, r, AuditEvent{
+			Event:   "password.reset",
+			Account: accountName,
+			Actor:   accountName,
+			Outcome: AuditFailure,
+		})
+
+		APIError{
+			Message: "Invalid or expired password reset token.",
+		}.Log(accountName).Report(w, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		APIError{
+			UserMessage: "Internal storage error.",
+			LogMessage:  fmt.Sprintf("Unable to reset password: %v", err),
+		}.Log(accountName).Report(w, StorageErrorStatus(err))
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"account": accountName,
+	}).Info("Account password reset.")
+	Audit(c, r, AuditEvent{Event: "password.reset", Account: accountName, Actor: accountName})
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 
-	"gopkg.in/mgo.v2"
+	log "github.com/Sirupsen/logrus"
 )
 
 type AuthTestStorage struct {
@@ -14,6 +17,28 @@ type AuthTestStorage struct {
 
 	NextError error
 	Created   *Account
+
+	FoundAccount *Account
+	Hashed       []byte
+	RevokedKeys  bool
+}
+
+func (storage *AuthTestStorage) FindAccount(name string) (*Account, error) {
+	if storage.FoundAccount == nil {
+		return nil, ErrAccountNotFound
+	}
+	return storage.FoundAccount, nil
+}
+
+func (storage *AuthTestStorage) UpdatePassword(name string, hashed []byte, updatedAt int64, revokeKeys bool) error {
+	if err := storage.NextError; err != nil {
+		storage.NextError = nil
+		return err
+	}
+
+	storage.Hashed = hashed
+	storage.RevokedKeys = revokeKeys
+	return nil
 }
 
 func (storage *AuthTestStorage) CreateAccount(account *Account) error {
@@ -31,7 +56,7 @@ func TestCreateHandlerSuccess(t *testing.T) {
 		`accountName=someone%40gmail.com&password=secret`)
 	w := httptest.NewRecorder()
 	s := &AuthTestStorage{}
-	c := &Context{Storage: s}
+	c := &Context{Storage: s, Hasher: testHasher}
 
 	CreateHandler(c, w, r)
 
@@ -58,11 +83,8 @@ func TestCreateHandlerDuplicateAccount(t *testing.T) {
 	r := HTTPRequest(t, "POST", "https://localhost/v1/accounts",
 		`accountName=someone%40gmail.com&password=secret`)
 	w := httptest.NewRecorder()
-	s := &AuthTestStorage{
-		// See https://github.com/go-mgo/mgo/blob/445c05a1261a0941bc48d898c8eb3ee18ab398c3/session.go#L2116
-		NextError: &mgo.QueryError{Code: 11000},
-	}
-	c := &Context{Storage: s}
+	s := &AuthTestStorage{NextError: ErrAccountExists}
+	c := &Context{Storage: s, Hasher: testHasher}
 
 	CreateHandler(c, w, r)
 
@@ -76,7 +98,7 @@ func TestCreateHandlerStorageFailure(t *testing.T) {
 		`accountName=mongo-go-boom%40gmail.com&password=uhoh`)
 	w := httptest.NewRecorder()
 	s := &AuthTestStorage{NextError: errors.New("WTF")}
-	c := &Context{Storage: s}
+	c := &Context{Storage: s, Hasher: testHasher}
 
 	CreateHandler(c, w, r)
 
@@ -84,3 +106,147 @@ func TestCreateHandlerStorageFailure(t *testing.T) {
 		t.Errorf("Expected response code %d, but was %d", http.StatusInternalServerError, w.Code)
 	}
 }
+
+func TestCreateHandlerStorageUnavailable(t *testing.T) {
+	r := HTTPRequest(t, "POST", "https://localhost/v1/accounts",
+		`accountName=someone%40gmail.com&password=secret`)
+	w := httptest.NewRecorder()
+	s := &AuthTestStorage{NextError: ErrUnavailable}
+	c := &Context{Storage: s, Hasher: testHasher}
+
+	CreateHandler(c, w, r)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected response code %d, but was %d", http.StatusServiceUnavailable, w.Code)
+	}
+}
+
+func TestPasswordChangeSuccess(t *testing.T) {
+	a, err := NewAccount(testHasher, "someone@gmail.com", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+
+	r := HTTPRequest(t, "POST", "https://localhost/v1/accounts/password",
+		`accountName=someone%40gmail.com&password=secret&newPassword=changed&revokeKeys=true`)
+	w := httptest.NewRecorder()
+	s := &AuthTestStorage{FoundAccount: a}
+	c := &Context{Storage: s, Hasher: testHasher}
+
+	PasswordChangeHandler(c, w, r)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusNoContent, w.Code)
+	}
+
+	changed := &Account{HashedPassword: s.Hashed}
+	if !changed.HasPassword("changed") {
+		t.Error("Expected the new password to be stored")
+	}
+	if !s.RevokedKeys {
+		t.Error("Expected keys to be revoked")
+	}
+}
+
+func TestPasswordChangeBadPassword(t *testing.T) {
+	a, err := NewAccount(testHasher, "someone@gmail.com", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+
+	r := HTTPRequest(t, "POST", "https://localhost/v1/accounts/password",
+		`accountName=someone%40gmail.com&password=wrong&newPassword=changed`)
+	w := httptest.NewRecorder()
+	s := &AuthTestStorage{FoundAccount: a}
+	c := &Context{Storage: s, Hasher: testHasher}
+
+	PasswordChangeHandler(c, w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected response code %d, but was %d", http.StatusUnauthorized, w.Code)
+	}
+	if s.Hashed != nil {
+		t.Error("Expected the password to be unchanged")
+	}
+}
+
+func TestPasswordChangeMissingNewPassword(t *testing.T) {
+	r := HTTPRequest(t, "POST", "https://localhost/v1/accounts/password",
+		`accountName=someone%40gmail.com&password=secret`)
+	w := httptest.NewRecorder()
+	c := &Context{Storage: &AuthTestStorage{}, Hasher: testHasher}
+
+	PasswordChangeHandler(c, w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected response code %d, but was %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestPasswordResetInvalidToken(t *testing.T) {
+	r := HTTPRequest(t, "POST", "https://localhost/v1/accounts/password/reset",
+		`accountName=someone&token=123abc&newPassword=changed`)
+	w := httptest.NewRecorder()
+	c := &Context{Storage: &AuthTestStorage{}, Hasher: testHasher}
+
+	PasswordResetHandler(c, w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected response code %d, but was %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestAccountDeletionSuccess(t *testing.T) {
+	s := NewMemoryStorage()
+	a, err := NewAccount(testHasher, "someone@gmail.com", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+	if err := s.CreateAccount(a); err != nil {
+		t.Fatalf("Unable to store account: %v", err)
+	}
+	c := &Context{Storage: s, Hasher: testHasher}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	r := HTTPRequest(t, "DELETE", "https://localhost/v1/accounts?accountName=someone%40gmail.com&password=secret", "")
+	w := httptest.NewRecorder()
+	AccountHandler(c, w, r)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusNoContent, w.Code)
+	}
+
+	if _, err := s.FindAccount("someone@gmail.com"); err != ErrAccountNotFound {
+		t.Errorf("Expected the account to be deleted, but got: %v", err)
+	}
+
+	if !strings.Contains(buf.String(), "audit=account.deleted") {
+		t.Errorf("Expected the deletion to be audited, but logged: %s", buf.String())
+	}
+}
+
+func TestAccountDeletionBadPassword(t *testing.T) {
+	s := NewMemoryStorage()
+	a, err := NewAccount(testHasher, "someone@gmail.com", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+	if err := s.CreateAccount(a); err != nil {
+		t.Fatalf("Unable to store account: %v", err)
+	}
+	c := &Context{Storage: s, Hasher: testHasher}
+
+	r := HTTPRequest(t, "DELETE", "https://localhost/v1/accounts?accountName=someone%40gmail.com&password=wrong", "")
+	w := httptest.NewRecorder()
+	AccountHandler(c, w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected response code %d, but was %d", http.StatusUnauthorized, w.Code)
+	}
+	if _, err := s.FindAccount("someone@gmail.com"); err != nil {
+		t.Errorf("Expected the account to survive, but got: %v", err)
+	}
+}
@@ -0,0 +1,793 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// AdminHandler is a ContextHandler that also accepts the administrator who made the request.
+type AdminHandler func(c *Context, w http.ResponseWriter, r *http.Request, admin *Account)
+
+// RequireAdministrator returns a ContextHandler that only invokes handler for requests made by an
+// administrator. Requests authenticate with HTTP Basic authentication, using an account name as
+// the username and one of the account's API keys as the password.
+func RequireAdministrator(handler AdminHandler) ContextHandler {
+	return func(c *Context, w http.ResponseWriter, r *http.Request) {
+		admin, ok := AuthenticateAdministrator(c, w, r)
+		if !ok {
+			return
+		}
+		handler(c, w, r, admin)
+	}
+}
+
+// AuthenticateAdministrator verifies the HTTP Basic credentials of a request. If they name an
+// enabled administrator's account and one of its valid API keys that grants the keys:manage scope,
+// it returns the account. Otherwise, it reports an error and returns false. The credentials are
+// verified before the account is reported as disabled, so that callers without them can't learn
+// which accounts are.
+func AuthenticateAdministrator(c *Context, w http.ResponseWriter, r *http.Request) (*Account, bool) {
+	rejectAuth := func(accountName string) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="auth-store administration"`)
+		APIError{
+			UserMessage: "Administrative requests must authenticate with an account name and API key.",
+			LogMessage:  "Administrative authentication failure.",
+		}.Log(accountName).Report(w, http.StatusUnauthorized)
+	}
+
+	accountName, apiKey, ok := r.BasicAuth()
+	if !ok || accountName == "" || apiKey == "" {
+		rejectAuth("")
+		return nil, false
+	}
+
+	account, err := c.Storage.FindAccount(accountName)
+	if err == ErrAccountNotFound {
+		rejectAuth(accountName)
+		return nil, false
+	}
+	if err != nil {
+		APIError{
+			UserMessage: "Internal storage error. Please try again later.",
+			LogMessage:  fmt.Sprintf("Error authenticating administrator: %v", err),
+		}.Log(accountName).Report(w, StorageErrorStatus(err))
+		return nil, false
+	}
+
+	key := account.Key(DigestAPIKey(apiKey))
+	if key == nil || key.Expired(time.Now().UnixNano()) {
+		rejectAuth(accountName)
+		return nil, false
+	}
+
+	if !account.Administrator {
+		APIError{
+			UserMessage: "This request requires an administrator.",
+			LogMessage:  "Administrative request made by an account that isn't an administrator.",
+		}.Log(accountName).Report(w, http.StatusForbidden)
+		return nil, false
+	}
+
+	if !key.HasScope(ScopeKeysManage) {
+		APIError{
+			UserMessage: fmt.Sprintf("Administrative requests require an API key that grants the scope [%s].",
+				ScopeKeysManage),
+			LogMessage: "Administrative request made with an API key that lacks the management scope.",
+		}.Log(accountName).Report(w, http.StatusForbidden)
+		return nil, false
+	}
+
+	if account.Disabled {
+		RejectDisabled(w, accountName)
+		return nil, false
+	}
+
+	return account, true
+}
+
+// AdminSetupHandler creates the first administrator of a fresh install, using the one-time setup
+// token that was issued to the log on startup. It doesn't require administrator authentication,
+// but stops working as soon as any administrator exists.
+func AdminSetupHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	if !MethodOk(w, r, "POST") {
+		return
+	}
+
+	accountName, password, ok := ExtractPasswordCredentials(w, r, "Administrator setup")
+	if !ok {
+		return
+	}
+
+	token := r.FormValue("token")
+	if token == "" {
+		APIError{
+			UserMessage: `Missing required parameter "token".`,
+			LogMessage:  "Administrator setup request missing required query parameters.",
+		}.Log(accountName).Report(w, http.StatusBadRequest)
+		return
+	}
+
+	found, err := c.Storage.HasAdministrator()
+	if err != nil {
+		APIError{
+			UserMessage: "Internal storage error encountered. Please try again later.",
+			LogMessage:  fmt.Sprintf("Unable to look for an administrator: %v", err),
+		}.Log(accountName).Report(w, StorageErrorStatus(err))
+		return
+	}
+	if found || c.Setup == nil {
+		APIError{
+			Message: "An administrator already exists. Setup is no longer available.",
+		}.Log(accountName).Report(w, http.StatusConflict)
+		return
+	}
+
+	// NewAccount discards the plaintext of the key it generates, so it's replaced with one that can
+	// be returned. The administrator API accepts nothing else.
+	var key string
+	var record APIKey
+	account, err := NewAccount(c.Hasher, accountName, password)
+	if err == nil {
+		key, record, err = NewAPIKey()
+	}
+	if err == nil {
+		account.APIKeys = []APIKey{record}
+		account.Administrator = true
+		err = c.Setup.Redeem(token, func() error {
+			return c.Storage.CreateAccount(account)
+		})
+	}
+	switch err {
+	case nil:
+	case ErrSetupTokenInvalid:
+		APIError{
+			Message: "Invalid or already used setup token.",
+		}.Log(accountName).Report(w, http.StatusUnauthorized)
+		return
+	case ErrAccountExists:
+		APIError{
+			Message: fmt.Sprintf(`The account name "%s" has already been taken.`, accountName),
+		}.Log(accountName).Report(w, http.StatusConflict)
+		return
+	default:
+		APIError{
+			UserMessage: "Internal storage error encountered. Please try again later.",
+			LogMessage:  fmt.Sprintf("Unable to create administrator: %v", err),
+		}.Log(accountName).Report(w, StorageErrorStatus(err))
+		return
+	}
+
+	Audit(c, r, AuditEvent{
+		Event:   "account.created",
+		Account: accountName,
+		Actor:   "setup",
+		Details: AuditDetails(log.Fields{"admin": true}),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(AdminSetupResult{
+		AdminAccount: NewAdminAccount(account, false),
+		Key:          GeneratedKey{APIKey: record, Key: key},
+	})
+}
+
+// AdminSetupResult is the JSON representation of the administrator created by setup, along with
+// its API key. This is the only time that the key itself is revealed.
+type AdminSetupResult struct {
+	AdminAccount
+
+	Key GeneratedKey `json:"key"`
+}
+
+// AdminAccount is the JSON representation of an account, as it's shown to administrators. Keys are
+// only included when a single account is described.
+type AdminAccount struct {
+	Name           string `json:"name"`
+	Administrator  bool   `json:"admin"`
+	Disabled       bool   `json:"disabled"`
+	DisabledReason string `json:"disabledReason,omitempty"`
+	DisabledAt     int64  `json:"disabledAt,omitempty"`
+	TwoFactor      bool   `json:"twoFactor"`
+	KeyCount       int    `json:"keyCount"`
+	CreatedAt      int64  `json:"createdAt"`
+	UpdatedAt      int64  `json:"updatedAt"`
+
+	Keys []APIKey `json:"keys,omitempty"`
+}
+
+// NewAdminAccount describes an account to administrators, optionally including its key metadata.
+func NewAdminAccount(account *Account, withKeys bool) AdminAccount {
+	described := AdminAccount{
+		Name:           account.Name,
+		Administrator:  account.Administrator,
+		Disabled:       account.Disabled,
+		DisabledReason: account.DisabledReason,
+		DisabledAt:     account.DisabledAt,
+		TwoFactor:      account.TwoFactorEnabled(),
+		KeyCount:       len(account.APIKeys),
+		CreatedAt:      account.CreatedAt,
+		UpdatedAt:      account.UpdatedAt,
+	}
+
+	if withKeys {
+		described.Keys = make([]APIKey, len(account.APIKeys))
+		for i, key := range account.APIKeys {
+			key.Scopes = key.GrantedScopes()
+			described.Keys[i] = key
+		}
+	}
+	return described
+}
+
+// AdminAccountList is the JSON representation of a page of accounts.
+type AdminAccountList struct {
+	Accounts []AdminAccount `json:"accounts"`
+
+	// NextCursor continues the listing after this page. It's omitted on the last page.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// AdminAccountsHandler dispatches requests made to the administrative /accounts resource based on
+// request method.
+func AdminAccountsHandler(c *Context, w http.ResponseWriter, r *http.Request, admin *Account) {
+	switch r.Method {
+	case "GET":
+		AdminAccountListHandler(c, w, r, admin)
+	case "POST":
+		AdminAccountCreationHandler(c, w, r, admin)
+	case "DELETE":
+		AdminAccountDeletionHandler(c, w, r, admin)
+	default:
+		APIError{
+			Message: fmt.Sprintf(
+				"Unsupported method %s. Only GET, POST and DELETE are accepted for this resource.",
+				r.Method),
+		}.Log("").Report(w, http.StatusMethodNotAllowed)
+	}
+}
+
+// AdminAccountListHandler lists a page of accounts. Accounts may be filtered by name, status and
+// creation time, and sorted by name or creation time.
+func AdminAccountListHandler(c *Context, w http.ResponseWriter, r *http.Request, admin *Account) {
+	query, ok := parseAccountQuery(w, r, admin.Name)
+	if !ok {
+		return
+	}
+
+	page, err := c.Storage.ListAccounts(query)
+	if err == ErrInvalidCursor {
+		APIError{
+			Message: "Invalid cursor. A cursor may only continue the listing that it came from.",
+		}.Log(admin.Name).Report(w, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		APIError{
+			UserMessage: "Internal storage error encountered. Please try again later.",
+			LogMessage:  fmt.Sprintf("Unable to list accounts: %v", err),
+		}.Log(admin.Name).Report(w, StorageErrorStatus(err))
+		return
+	}
+
+	list := AdminAccountList{
+		Accounts:   make([]AdminAccount, len(page.Accounts)),
+		NextCursor: page.NextCursor,
+	}
+	for i, account := range page.Accounts {
+		list.Accounts[i] = NewAdminAccount(account, false)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(list)
+}
+
+// parseAccountQuery reads an AccountQuery from the parameters of an account listing request.
+func parseAccountQuery(w http.ResponseWriter, r *http.Request, adminName string) (AccountQuery, bool) {
+	query := AccountQuery{
+		Prefix:   r.FormValue("prefix"),
+		Contains: r.FormValue("search"),
+		Sort:     r.FormValue("sort"),
+		Cursor:   r.FormValue("cursor"),
+	}
+
+	reject := func(message string, args ...interface{}) (AccountQuery, bool) {
+		APIError{
+			Message: fmt.Sprintf(message, args...),
+		}.Log(adminName).Report(w, http.StatusBadRequest)
+		return query, false
+	}
+
+	flags := map[string]**bool{"admin": &query.Administrator, "disabled": &query.Disabled}
+	for name, flag := range flags {
+		if raw := r.FormValue(name); raw != "" {
+			value, err := strconv.ParseBool(raw)
+			if err != nil {
+				return reject("Invalid %s [%s]: must be true or false.", name, raw)
+			}
+			*flag = &value
+		}
+	}
+
+	times := map[string]*int64{"createdAfter": &query.CreatedAfter, "createdBefore": &query.CreatedBefore}
+	for name, at := range times {
+		if raw := r.FormValue(name); raw != "" {
+			t, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				return reject("Invalid %s [%s]: must be an RFC 3339 timestamp.", name, raw)
+			}
+			*at = t.UnixNano()
+		}
+	}
+
+	switch query.Sort {
+	case "", AccountSortName, AccountSortCreated:
+	default:
+		return reject("Invalid sort [%s]: must be %s or %s.", query.Sort, AccountSortName, AccountSortCreated)
+	}
+
+	switch raw := r.FormValue("order"); raw {
+	case "", "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		return reject("Invalid order [%s]: must be asc or desc.", raw)
+	}
+
+	if raw := r.FormValue("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > MaxAccountPageSize {
+			return reject("Invalid limit [%s]: must be between 1 and %d.", raw, MaxAccountPageSize)
+		}
+		query.Limit = limit
+	}
+
+	return query, true
+}
+
+// AdminAccountDetailsHandler describes a single account, including the metadata of its API keys.
+func AdminAccountDetailsHandler(c *Context, w http.ResponseWriter, r *http.Request, admin *Account) {
+	if !MethodOk(w, r, "GET") {
+		return
+	}
+
+	accountName, ok := extractAccountName(w, r, "Account details")
+	if !ok {
+		return
+	}
+
+	account, err := c.Storage.FindAccount(accountName)
+	if err == ErrAccountNotFound {
+		APIError{
+			Message: "Unrecognized account.",
+		}.Log(accountName).Report(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		APIError{
+			UserMessage: "Internal storage error encountered. Please try again later.",
+			LogMessage:  fmt.Sprintf("Unable to find account: %v", err),
+		}.Log(accountName).Report(w, StorageErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(NewAdminAccount(account, true))
+}
+
+// AdminAccountCreationHandler creates an account on behalf of a user. If the "admin" parameter is
+// true, the new account is an administrator.
+func AdminAccountCreationHandler(c *Context, w http.ResponseWriter, r *http.Request, admin *Account) {
+	accountName, password, ok := ExtractPasswordCredentials(w, r, "Administrative account creation")
+	if !ok {
+		return
+	}
+
+	administrator, ok := parseAdminFlag(w, r, accountName)
+	if !ok {
+		return
+	}
+
+	account, err := NewAccount(c.Hasher, accountName, password)
+	if err != nil {
+		APIError{
+			Message: fmt.Sprintf("Unable to create account: %v", err),
+		}.Log("").Report(w, http.StatusInternalServerError)
+		return
+	}
+	account.Administrator = administrator
+
+	err = c.Storage.CreateAccount(account)
+	if err == ErrAccountExists {
+		APIError{
+			Message: fmt.Sprintf(`The account name "%s" has already been taken.`, accountName),
+		}.Log("").Report(w, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		APIError{
+			UserMessage: "Internal storage error.",
+			LogMessage:  fmt.Sprintf("Unable to create account: %v", err),
+		}.Log(accountName).Report(w, StorageErrorStatus(err))
+		return
+	}
+
+	Audit(c, r, AuditEvent{
+		Event:   "account.created",
+		Account: accountName,
+		Actor:   admin.Name,
+		Details: AuditDetails(log.Fields{"admin": administrator}),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(NewAdminAccount(account, false))
+}
+
+// AdminSetAdministratorHandler grants or revokes an account's administrator status, according to
+// the "admin" parameter. Administrators can't revoke their own status, so that at least one
+// administrator always remains.
+func AdminSetAdministratorHandler(c *Context, w http.ResponseWriter, r *http.Request, admin *Account) {
+	if !MethodOk(w, r, "POST") {
+		return
+	}
+
+	accountName, ok := extractAccountName(w, r, "Administrator status")
+	if !ok {
+		return
+	}
+
+	if r.FormValue("admin") == "" {
+		APIError{
+			UserMessage: `Missing required parameter "admin".`,
+			LogMessage:  "Administrator status request missing required query parameters.",
+		}.Log(accountName).Report(w, http.StatusBadRequest)
+		return
+	}
+	administrator, ok := parseAdminFlag(w, r, accountName)
+	if !ok {
+		return
+	}
+
+	if accountName == admin.Name && !administrator {
+		APIError{
+			Message: "You can't revoke your own administrator status.",
+		}.Log(accountName).Report(w, http.StatusBadRequest)
+		return
+	}
+
+	err := c.Storage.SetAdministrator(accountName, administrator)
+	if err == ErrAccountNotFound {
+		APIError{
+			Message: "Unrecognized account.",
+		}.Log(accountName).Report(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		APIError{
+			UserMessage: "Internal storage error encountered. Please try again later.",
+			LogMessage:  fmt.Sprintf("Unable to change administrator status: %v", err),
+		}.Log(accountName).Report(w, StorageErrorStatus(err))
+		return
+	}
+
+	if administrator {
+		Audit(c, r, AuditEvent{Event: "account.admin.granted", Account: accountName, Actor: admin.Name})
+	} else {
+		Audit(c, r, AuditEvent{Event: "account.admin.revoked", Account: accountName, Actor: admin.Name})
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseAdminFlag reads the "admin" parameter of a request, which is false if it's absent.
+func parseAdminFlag(w http.ResponseWriter, r *http.Request, accountName string) (bool, bool) {
+	raw := r.FormValue("admin")
+	if raw == "" {
+		return false, true
+	}
+
+	administrator, err := strconv.ParseBool(raw)
+	if err != nil {
+		APIError{
+			Message: fmt.Sprintf("Invalid admin [%s]: must be true or false.", raw),
+		}.Log(accountName).Report(w, http.StatusBadRequest)
+		return false, false
+	}
+	return administrator, true
+}
+
+// AdminKeyRevocationHandler revokes a single API key from any account, identified by its ID.
+func AdminKeyRevocationHandler(c *Context, w http.ResponseWriter, r *http.Request, admin *Account) {
+	if !MethodOk(w, r, "POST") {
+		return
+	}
+
+	accountName, keyID, ok := extractCredentials(w, r, "Administrative key revocation", "keyId")
+	if !ok {
+		return
+	}
+
+	rejectKey := func() {
+		APIError{
+			Message: "Unrecognized account or API key.",
+		}.Log(accountName).Report(w, http.StatusNotFound)
+	}
+
+	account, err := c.Storage.FindAccount(accountName)
+	if err == nil {
+		err = ErrKeyNotFound
+		for _, key := range account.APIKeys {
+			if key.ID == keyID {
+				err = c.Storage.RevokeKeyFromAccount(accountName, key.Digest)
+				break
+			}
+		}
+	}
+	if err == ErrAccountNotFound || err == ErrKeyNotFound {
+		rejectKey()
+		return
+	}
+	if err != nil {
+		APIError{
+			UserMessage: "Internal storage error encountered. Please try again later.",
+			LogMessage:  fmt.Sprintf("Unable to revoke API key: %v", err),
+		}.Log(accountName).Report(w, StorageErrorStatus(err))
+		return
+	}
+
+	Audit(c, r, AuditEvent{
+		Event:   "key.revoked",
+		Account: accountName,
+		Actor:   admin.Name,
+		Details: AuditDetails(log.Fields{"key id": keyID}),
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AdminRevokeAllHandler revokes every API key on any account, so that administrators can respond to
+// a compromised account without knowing its password. Like every administrative handler, it's only
+// reached through RequireAdministrator, not merely with a client certificate for the internal API.
+func AdminRevokeAllHandler(c *Context, w http.ResponseWriter, r *http.Request, admin *Account) {
+	if !MethodOk(w, r, "POST") {
+		return
+	}
+
+	accountName, ok := extractAccountName(w, r, "Administrative key revocation")
+	if !ok {
+		return
+	}
+
+	RevokeAllKeys(c, w, r, accountName, admin.Name)
+}
+
+// AdminAccountDeletionHandler removes any account, along with all of its API keys.
+func AdminAccountDeletionHandler(c *Context, w http.ResponseWriter, r *http.Request, admin *Account) {
+	accountName, ok := extractAccountName(w, r, "Administrative account deletion")
+	if !ok {
+		return
+	}
+
+	if accountName == admin.Name {
+		APIError{
+			Message: "You can't delete your own account here.",
+		}.Log(accountName).Report(w, http.StatusBadRequest)
+		return
+	}
+
+	DeleteAccount(c, w, r, accountName, admin.Name)
+}
+
+// AdminDisableHandler disables an account, with an optional reason. A disabled account keeps all of
+// its data, but can't validate its API keys or authenticate with its password until it's enabled.
+func AdminDisableHandler(c *Context, w http.ResponseWriter, r *http.Request, admin *Account) {
+	setAccountDisabled(c, w, r, admin, true)
+}
+
+// AdminEnableHandler enables a disabled account.
+func AdminEnableHandler(c *Context, w http.ResponseWriter, r *http.Request, admin *Account) {
+	setAccountDisabled(c, w, r, admin, false)
+}
+
+func setAccountDisabled(c *Context, w http.ResponseWriter, r *http.Request, admin *Account, disabled bool) {
+	if !MethodOk(w, r, "POST") {
+		return
+	}
+
+	accountName, ok := extractAccountName(w, r, "Administrative account status")
+	if !ok {
+		return
+	}
+
+	if accountName == admin.Name && disabled {
+		APIError{
+			Message: "You can't disable your own account.",
+		}.Log(accountName).Report(w, http.StatusBadRequest)
+		return
+	}
+
+	reason := r.FormValue("reason")
+	err := c.Storage.SetAccountDisabled(accountName, disabled, reason, time.Now().UnixNano())
+	if err == ErrAccountNotFound {
+		APIError{
+			Message: "Unrecognized account.",
+		}.Log(accountName).Report(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		APIError{
+			UserMessage: "Internal storage error encountered. Please try again later.",
+			LogMessage:  fmt.Sprintf("Unable to change account status: %v", err),
+		}.Log(accountName).Report(w, StorageErrorStatus(err))
+		return
+	}
+
+	if disabled {
+		Audit(c, r, AuditEvent{
+			Event:   "account.disabled",
+			Account: accountName,
+			Actor:   admin.Name,
+			Details: AuditDetails(log.Fields{"reason": reason}),
+		})
+	} else {
+		Audit(c, r, AuditEvent{Event: "account.enabled", Account: accountName, Actor: admin.Name})
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AdminPasswordResetHandler issues a one-time password reset token for an account, and delivers it
+// to the account's owner with the configured Notifier. Any earlier token is invalidated. The token
+// is never included in the response, so that whoever requests a reset can't use it.
+func AdminPasswordResetHandler(c *Context, w http.ResponseWriter, r *http.Request, admin *Account) {
+	if !MethodOk(w, r, "POST") {
+		return
+	}
+
+	accountName, ok := extractAccountName(w, r, "Password reset token")
+	if !ok {
+		return
+	}
+
+	token, record, err := NewResetToken(time.Now(), c.ResetTTL)
+	if err != nil {
+		APIError{
+			UserMessage: "Unable to generate a password reset token.",
+			LogMessage:  fmt.Sprintf("Unable to generate password reset token: %v", err),
+		}.Log(accountName).Report(w, http.StatusInternalServerError)
+		return
+	}
+
+	err = c.Storage.SetResetToken(accountName, record)
+	if err == ErrAccountNotFound {
+		APIError{
+			Message: "Unrecognized account.",
+		}.Log(accountName).Report(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		APIError{
+			UserMessage: "Internal storage error encountered. Please try again later.",
+			LogMessage:  fmt.Sprintf("Unable to store password reset token: %v", err),
+		}.Log(accountName).Report(w, StorageErrorStatus(err))
+		return
+	}
+
+	if err := c.Notifier.NotifyPasswordReset(accountName, token, time.Unix(0, record.ExpiresAt)); err != nil {
+		APIError{
+			UserMessage: "Unable to deliver the password reset token.",
+			LogMessage:  fmt.Sprintf("Unable to deliver password reset token: %v", err),
+		}.Log(accountName).Report(w, http.StatusInternalServerError)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"account": accountName,
+	}).Info("Password reset token issued.")
+	Audit(c, r, AuditEvent{Event: "password.reset_issued", Account: accountName, Actor: admin.Name})
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// AdminAuditLog is the JSON representation of the result of an audit trail query.
+type AdminAuditLog struct {
+	Events []AuditEvent `json:"events"`
+}
+
+// AdminAuditHandler queries the audit trail. Events may be filtered by the account that they
+// affected and by when they happened, and are listed in the order that they happened.
+func AdminAuditHandler(c *Context, w http.ResponseWriter, r *http.Request, admin *Account) {
+	if !MethodOk(w, r, "GET") {
+		return
+	}
+
+	reader, ok := c.AuditSink.(AuditReader)
+	if !ok {
+		APIError{
+			Message: "The audit trail isn't recorded anywhere that can be queried.",
+		}.Log(admin.Name).Report(w, http.StatusNotImplemented)
+		return
+	}
+
+	query, ok := parseAuditQuery(w, r, admin.Name)
+	if !ok {
+		return
+	}
+
+	events, err := reader.FindAuditEvents(query)
+	if err != nil {
+		APIError{
+			UserMessage: "Internal storage error encountered. Please try again later.",
+			LogMessage:  fmt.Sprintf("Unable to query audit trail: %v", err),
+		}.Log(admin.Name).Report(w, StorageErrorStatus(err))
+		return
+	}
+	if events == nil {
+		events = []AuditEvent{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(AdminAuditLog{Events: events})
+}
+
+// parseAuditQuery reads an AuditQuery from the parameters of an audit trail request.
+func parseAuditQuery(w http.ResponseWriter, r *http.Request, adminName string) (AuditQuery, bool) {
+	query := AuditQuery{Account: r.FormValue("accountName")}
+
+	reject := func(message string, args ...interface{}) (AuditQuery, bool) {
+		APIError{
+			Message: fmt.Sprintf(message, args...),
+		}.Log(adminName).Report(w, http.StatusBadRequest)
+		return query, false
+	}
+
+	times := map[string]*int64{"since": &query.Since, "until": &query.Until}
+	for name, at := range times {
+		if raw := r.FormValue(name); raw != "" {
+			t, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				return reject("Invalid %s [%s]: must be an RFC 3339 timestamp.", name, raw)
+			}
+			*at = t.UnixNano()
+		}
+	}
+
+	if raw := r.FormValue("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > MaxAuditQueryLimit {
+			return reject("Invalid limit [%s]: must be between 1 and %d.", raw, MaxAuditQueryLimit)
+		}
+		query.Limit = limit
+	}
+
+	return query, true
+}
+
+// extractAccountName reads the name of the account that an administrative request acts on.
+func extractAccountName(w http.ResponseWriter, r *http.Request, requestName string) (string, bool) {
+	if err := r.ParseForm(); err != nil {
+		APIError{
+			Message: fmt.Sprintf("Unable to parse URL parameters: %v", err),
+		}.Log("").Report(w, http.StatusBadRequest)
+		return "", false
+	}
+
+	accountName := r.FormValue("accountName")
+	if accountName == "" {
+		APIError{
+			UserMessage: `Missing required parameter "accountName".`,
+			LogMessage:  fmt.Sprintf("%s request missing required query parameters.", requestName),
+		}.Log("").Report(w, http.StatusBadRequest)
+		return "", false
+	}
+	return accountName, true
+}
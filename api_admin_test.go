@@ -0,0 +1,617 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testAdmin is the administrator that administrative handlers are invoked on behalf of.
+var testAdmin = &Account{Name: "root", Administrator: true}
+
+// asAdmin binds an AdminHandler to testAdmin.
+func asAdmin(handler AdminHandler) ContextHandler {
+	return func(c *Context, w http.ResponseWriter, r *http.Request) { handler(c, w, r, testAdmin) }
+}
+
+func TestAdminRevokeAllSuccess(t *testing.T) {
+	s := NewMemoryStorage()
+	a, err := NewAccount(testHasher, "someone", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+	if err := s.CreateAccount(a); err != nil {
+		t.Fatalf("Unable to store account: %v", err)
+	}
+
+	r := HTTPRequest(t, "POST", "https://localhost/v1/admin/keys/revoke-all", `accountName=someone`)
+	w := httptest.NewRecorder()
+	c := &Context{Storage: s, Hasher: testHasher}
+
+	AdminRevokeAllHandler(c, w, r, testAdmin)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusOK, w.Code)
+	}
+
+	var result RevokedKeys
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("Unable to decode response: %v", err)
+	}
+	if result.Revoked != 1 || result.Replacement != nil {
+		t.Errorf("Unexpected revocation result: %+v", result)
+	}
+
+	found, err := s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if len(found.APIKeys) != 0 {
+		t.Errorf("Expected every key to be revoked, but found %d", len(found.APIKeys))
+	}
+}
+
+func TestAdminRevokeAllMissingAccount(t *testing.T) {
+	r := HTTPRequest(t, "POST", "https://localhost/v1/admin/keys/revoke-all", `accountName=nobody`)
+	w := httptest.NewRecorder()
+	c := &Context{Storage: NewMemoryStorage(), Hasher: testHasher}
+
+	AdminRevokeAllHandler(c, w, r, testAdmin)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected response code %d, but was %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestPasswordResetFlow(t *testing.T) {
+	s := NewMemoryStorage()
+	a, err := NewAccount(testHasher, "someone", "forgotten")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+	if err := s.CreateAccount(a); err != nil {
+		t.Fatalf("Unable to store account: %v", err)
+	}
+
+	n := &RecordingNotifier{}
+	c := &Context{Storage: s, Notifier: n, ResetTTL: time.Hour, Hasher: testHasher}
+
+	r := HTTPRequest(t, "POST", "https://localhost/v1/admin/password-reset", `accountName=someone`)
+	w := httptest.NewRecorder()
+	AdminPasswordResetHandler(c, w, r, testAdmin)
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusAccepted, w.Code)
+	}
+	if n.AccountName != "someone" || n.Token == "" {
+		t.Fatalf("Expected a reset token to be delivered, but got (%s, %s)", n.AccountName, n.Token)
+	}
+	if w.Body.Len() != 0 {
+		t.Error("Expected the reset token to be omitted from the response")
+	}
+
+	reset := func() int {
+		r := HTTPRequest(t, "POST", "https://localhost/v1/accounts/password/reset",
+			`accountName=someone&token=`+n.Token+`&newPassword=remembered`)
+		w := httptest.NewRecorder()
+		PasswordResetHandler(c, w, r)
+		return w.Code
+	}
+
+	if code := reset(); code != http.StatusNoContent {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusNoContent, code)
+	}
+
+	found, err := s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if !found.HasPassword("remembered") {
+		t.Error("Expected the password to be reset")
+	}
+
+	if code := reset(); code != http.StatusUnauthorized {
+		t.Errorf("Expected a used token to be rejected with %d, but was %d", http.StatusUnauthorized, code)
+	}
+}
+
+func TestAdminPasswordResetMissingAccount(t *testing.T) {
+	r := HTTPRequest(t, "POST", "https://localhost/v1/admin/password-reset", `accountName=nobody`)
+	w := httptest.NewRecorder()
+	n := &RecordingNotifier{}
+	c := &Context{Storage: NewMemoryStorage(), Notifier: n, ResetTTL: time.Hour, Hasher: testHasher}
+
+	AdminPasswordResetHandler(c, w, r, testAdmin)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected response code %d, but was %d", http.StatusNotFound, w.Code)
+	}
+	if n.Token != "" {
+		t.Error("Expected no token to be delivered")
+	}
+}
+
+func TestAdminAccountDeletion(t *testing.T) {
+	s := NewMemoryStorage()
+	a, err := NewAccount(testHasher, "someone", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+	key, err := a.GenerateAPIKey()
+	if err != nil {
+		t.Fatalf("Unable to generate API key: %v", err)
+	}
+	if err := s.CreateAccount(a); err != nil {
+		t.Fatalf("Unable to store account: %v", err)
+	}
+	c := &Context{Storage: s, Hasher: testHasher}
+
+	r := HTTPRequest(t, "DELETE", "https://localhost/v1/admin/accounts?accountName=someone", "")
+	w := httptest.NewRecorder()
+	AdminAccountDeletionHandler(c, w, r, testAdmin)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusNoContent, w.Code)
+	}
+
+	// Every former key is now invalid.
+	r = HTTPRequest(t, "GET", "https://localhost/v1/validate?accountName=someone&apiKey="+key, "")
+	w = httptest.NewRecorder()
+	ValidateHandler(c, w, r)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected validation to fail with %d, but was %d", http.StatusNotFound, w.Code)
+	}
+
+	r = HTTPRequest(t, "DELETE", "https://localhost/v1/admin/accounts?accountName=someone", "")
+	w = httptest.NewRecorder()
+	AdminAccountDeletionHandler(c, w, r, testAdmin)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected deleting a missing account to fail with %d, but was %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestAdminDisableAndEnable(t *testing.T) {
+	s := NewMemoryStorage()
+	a, err := NewAccount(testHasher, "someone", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+	key, err := a.GenerateAPIKey()
+	if err != nil {
+		t.Fatalf("Unable to generate API key: %v", err)
+	}
+	if err := s.CreateAccount(a); err != nil {
+		t.Fatalf("Unable to store account: %v", err)
+	}
+	c := &Context{Storage: s, Hasher: testHasher}
+
+	serve := func(handler ContextHandler, method, url, body string) int {
+		r := HTTPRequest(t, method, url, body)
+		w := httptest.NewRecorder()
+		handler(c, w, r)
+		return w.Code
+	}
+
+	code := serve(asAdmin(AdminDisableHandler), "POST", "https://localhost/v1/admin/accounts/disable",
+		`accountName=someone&reason=spam`)
+	if code != http.StatusNoContent {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusNoContent, code)
+	}
+
+	found, err := s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if !found.Disabled || found.DisabledReason != "spam" || found.DisabledAt == 0 {
+		t.Errorf("Unexpected disabled state: (%v, %s, %d)", found.Disabled, found.DisabledReason, found.DisabledAt)
+	}
+
+	validate := "https://localhost/v1/validate?accountName=someone&apiKey=" + key
+	if code := serve(ValidateHandler, "GET", validate, ""); code != http.StatusForbidden {
+		t.Errorf("Expected validation to fail with %d, but was %d", http.StatusForbidden, code)
+	}
+
+	code = serve(KeyHandler, "POST", "https://localhost/v1/keys", `accountName=someone&password=secret`)
+	if code != http.StatusForbidden {
+		t.Errorf("Expected key generation to fail with %d, but was %d", http.StatusForbidden, code)
+	}
+
+	code = serve(PasswordChangeHandler, "POST", "https://localhost/v1/accounts/password",
+		`accountName=someone&password=secret&newPassword=changed`)
+	if code != http.StatusForbidden {
+		t.Errorf("Expected password change to fail with %d, but was %d", http.StatusForbidden, code)
+	}
+
+	code = serve(asAdmin(AdminEnableHandler), "POST", "https://localhost/v1/admin/accounts/enable", `accountName=someone`)
+	if code != http.StatusNoContent {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusNoContent, code)
+	}
+
+	if code := serve(ValidateHandler, "GET", validate, ""); code != http.StatusNoContent {
+		t.Errorf("Expected validation to succeed once enabled, but was %d", code)
+	}
+}
+
+func TestAdminDisableMissingAccount(t *testing.T) {
+	r := HTTPRequest(t, "POST", "https://localhost/v1/admin/accounts/disable", `accountName=nobody`)
+	w := httptest.NewRecorder()
+	c := &Context{Storage: NewMemoryStorage(), Hasher: testHasher}
+
+	AdminDisableHandler(c, w, r, testAdmin)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected response code %d, but was %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestRequireAdministrator(t *testing.T) {
+	s := NewMemoryStorage()
+	keys := make(map[string]string)
+	for _, name := range []string{"root", "someone", "former"} {
+		a, err := NewAccount(testHasher, name, "secret")
+		if err != nil {
+			t.Fatalf("Unable to create account: %v", err)
+		}
+		if keys[name], err = a.GenerateAPIKey(); err != nil {
+			t.Fatalf("Unable to generate API key: %v", err)
+		}
+		a.Administrator = name != "someone"
+		a.SetDisabled(name == "former", "retired", 1)
+		if name == "root" {
+			// A second key that can't manage keys, and so can't administer either.
+			if keys["root:read"], err = a.GenerateAPIKey(); err != nil {
+				t.Fatalf("Unable to generate API key: %v", err)
+			}
+			a.APIKeys[len(a.APIKeys)-1].Scopes = []string{ScopeJobsRead}
+		}
+		if err := s.CreateAccount(a); err != nil {
+			t.Fatalf("Unable to store account: %v", err)
+		}
+	}
+	c := &Context{Storage: s, Hasher: testHasher}
+
+	var invokedBy *Account
+	handler := RequireAdministrator(func(c *Context, w http.ResponseWriter, r *http.Request, admin *Account) {
+		invokedBy = admin
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	cases := []struct {
+		accountName, apiKey string
+		expected            int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"root", "wrong", http.StatusUnauthorized},
+		{"nobody", keys["root"], http.StatusUnauthorized},
+		{"someone", keys["someone"], http.StatusForbidden},
+		{"former", keys["former"], http.StatusForbidden},
+		{"former", "wrong", http.StatusUnauthorized},
+		{"root", keys["root:read"], http.StatusForbidden},
+		{"root", keys["root"], http.StatusNoContent},
+	}
+
+	for _, each := range cases {
+		invokedBy = nil
+		r := HTTPRequest(t, "GET", "https://localhost/v1/admin/accounts", "")
+		if each.accountName != "" {
+			r.SetBasicAuth(each.accountName, each.apiKey)
+		}
+		w := httptest.NewRecorder()
+
+		handler(c, w, r)
+
+		if w.Code != each.expected {
+			t.Errorf("Expected response code %d for [%s], but was %d", each.expected, each.accountName, w.Code)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("Expected a WWW-Authenticate challenge for [%s]", each.accountName)
+		}
+		if each.expected == http.StatusNoContent {
+			if invokedBy == nil || invokedBy.Name != each.accountName {
+				t.Errorf("Expected the handler to be invoked by [%s], but was %v", each.accountName, invokedBy)
+			}
+		} else if invokedBy != nil {
+			t.Errorf("Expected the handler not to be invoked for [%s]", each.accountName)
+		}
+	}
+}
+
+// adminTestStorage creates a MemoryStorage that contains an account for each name.
+func adminTestStorage(t *testing.T, names ...string) *MemoryStorage {
+	s := NewMemoryStorage()
+	for _, name := range names {
+		a, err := NewAccount(testHasher, name, "secret")
+		if err != nil {
+			t.Fatalf("Unable to create account: %v", err)
+		}
+		if err := s.CreateAccount(a); err != nil {
+			t.Fatalf("Unable to store account: %v", err)
+		}
+	}
+	return s
+}
+
+func TestAdminAccountList(t *testing.T) {
+	s := adminTestStorage(t, "carol@example.com", "alice@example.com", "bob@example.org")
+	c := &Context{Storage: s, Hasher: testHasher}
+
+	r := HTTPRequest(t, "GET", "https://localhost/v1/admin/accounts?search=Example.COM", "")
+	w := httptest.NewRecorder()
+	AdminAccountsHandler(c, w, r, testAdmin)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusOK, w.Code)
+	}
+
+	var list AdminAccountList
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatalf("Unable to decode response: %v", err)
+	}
+	if len(list.Accounts) != 2 {
+		t.Fatalf("Expected 2 accounts, but found %d", len(list.Accounts))
+	}
+	if list.Accounts[0].Name != "alice@example.com" || list.Accounts[1].Name != "carol@example.com" {
+		t.Errorf("Unexpected accounts: %+v", list.Accounts)
+	}
+	if list.Accounts[0].KeyCount != 1 || list.Accounts[0].Keys != nil {
+		t.Errorf("Expected listed accounts to count their keys without including them: %+v", list.Accounts[0])
+	}
+	if list.NextCursor != "" {
+		t.Errorf("Expected a single page, but found cursor [%s]", list.NextCursor)
+	}
+}
+
+func TestAdminAccountListPages(t *testing.T) {
+	s := adminTestStorage(t, "carol", "alice", "bob")
+	c := &Context{Storage: s, Hasher: testHasher}
+
+	list := func(url string) (int, AdminAccountList) {
+		r := HTTPRequest(t, "GET", url, "")
+		w := httptest.NewRecorder()
+		AdminAccountsHandler(c, w, r, testAdmin)
+
+		var list AdminAccountList
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+				t.Fatalf("Unable to decode response: %v", err)
+			}
+		}
+		return w.Code, list
+	}
+
+	code, first := list("https://localhost/v1/admin/accounts?order=desc&limit=2")
+	if code != http.StatusOK {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusOK, code)
+	}
+	if len(first.Accounts) != 2 || first.Accounts[0].Name != "carol" || first.NextCursor == "" {
+		t.Fatalf("Unexpected first page: %+v", first)
+	}
+
+	code, second := list("https://localhost/v1/admin/accounts?order=desc&limit=2&cursor=" + first.NextCursor)
+	if code != http.StatusOK {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusOK, code)
+	}
+	if len(second.Accounts) != 1 || second.Accounts[0].Name != "alice" || second.NextCursor != "" {
+		t.Errorf("Unexpected second page: %+v", second)
+	}
+
+	invalid := []string{
+		"limit=0",
+		"limit=many",
+		"sort=password",
+		"order=sideways",
+		"admin=maybe",
+		"createdAfter=yesterday",
+		"cursor=" + first.NextCursor,
+	}
+	for _, params := range invalid {
+		if code, _ := list("https://localhost/v1/admin/accounts?" + params); code != http.StatusBadRequest {
+			t.Errorf("Expected [%s] to fail with %d, but was %d", params, http.StatusBadRequest, code)
+		}
+	}
+}
+
+func TestAdminAccountDetails(t *testing.T) {
+	s := adminTestStorage(t, "someone")
+	c := &Context{Storage: s, Hasher: testHasher}
+
+	r := HTTPRequest(t, "GET", "https://localhost/v1/admin/accounts/details?accountName=someone", "")
+	w := httptest.NewRecorder()
+	AdminAccountDetailsHandler(c, w, r, testAdmin)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusOK, w.Code)
+	}
+
+	var details AdminAccount
+	if err := json.NewDecoder(w.Body).Decode(&details); err != nil {
+		t.Fatalf("Unable to decode response: %v", err)
+	}
+	if details.Name != "someone" || details.KeyCount != 1 || len(details.Keys) != 1 {
+		t.Errorf("Unexpected account details: %+v", details)
+	}
+	if details.Keys[0].ID == "" || details.Keys[0].Digest != "" {
+		t.Errorf("Expected key metadata without its digest: %+v", details.Keys[0])
+	}
+
+	r = HTTPRequest(t, "GET", "https://localhost/v1/admin/accounts/details?accountName=nobody", "")
+	w = httptest.NewRecorder()
+	AdminAccountDetailsHandler(c, w, r, testAdmin)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected response code %d, but was %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestAdminAccountCreation(t *testing.T) {
+	s := NewMemoryStorage()
+	c := &Context{Storage: s, Hasher: testHasher}
+
+	r := HTTPRequest(t, "POST", "https://localhost/v1/admin/accounts", `accountName=someone&password=secret&admin=true`)
+	w := httptest.NewRecorder()
+	AdminAccountsHandler(c, w, r, testAdmin)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusCreated, w.Code)
+	}
+
+	found, err := s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if !found.Administrator || !found.HasPassword("secret") {
+		t.Errorf("Unexpected account created: %+v", found)
+	}
+
+	r = HTTPRequest(t, "POST", "https://localhost/v1/admin/accounts", `accountName=someone&password=other`)
+	w = httptest.NewRecorder()
+	AdminAccountsHandler(c, w, r, testAdmin)
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected response code %d, but was %d", http.StatusConflict, w.Code)
+	}
+}
+
+func TestAdminSetAdministrator(t *testing.T) {
+	s := adminTestStorage(t, "someone", testAdmin.Name)
+	c := &Context{Storage: s, Hasher: testHasher}
+
+	r := HTTPRequest(t, "POST", "https://localhost/v1/admin/accounts/admin", `accountName=someone&admin=true`)
+	w := httptest.NewRecorder()
+	AdminSetAdministratorHandler(c, w, r, testAdmin)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusNoContent, w.Code)
+	}
+	found, err := s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if !found.Administrator {
+		t.Error("Expected the account to be an administrator")
+	}
+
+	r = HTTPRequest(t, "POST", "https://localhost/v1/admin/accounts/admin", `accountName=root&admin=false`)
+	w = httptest.NewRecorder()
+	AdminSetAdministratorHandler(c, w, r, testAdmin)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected administrators to be unable to revoke their own status, but was %d", w.Code)
+	}
+}
+
+func TestAdminKeyRevocation(t *testing.T) {
+	s := adminTestStorage(t, "someone")
+	c := &Context{Storage: s, Hasher: testHasher}
+
+	a, err := s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+
+	r := HTTPRequest(t, "POST", "https://localhost/v1/admin/keys/revoke", `accountName=someone&keyId=unknown`)
+	w := httptest.NewRecorder()
+	AdminKeyRevocationHandler(c, w, r, testAdmin)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected response code %d, but was %d", http.StatusNotFound, w.Code)
+	}
+
+	r = HTTPRequest(t, "POST", "https://localhost/v1/admin/keys/revoke", `accountName=someone&keyId=`+a.APIKeys[0].ID)
+	w = httptest.NewRecorder()
+	AdminKeyRevocationHandler(c, w, r, testAdmin)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusNoContent, w.Code)
+	}
+	found, err := s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if len(found.APIKeys) != 0 {
+		t.Errorf("Expected the key to be revoked, but found %d keys", len(found.APIKeys))
+	}
+}
+
+func TestAdminAuditQuery(t *testing.T) {
+	s := adminTestStorage(t, "someone", "other")
+	c := &Context{Storage: s, AuditSink: s, Hasher: testHasher}
+
+	r := HTTPRequest(t, "POST", "https://localhost/v1/admin/keys/revoke-all", `accountName=someone`)
+	AdminRevokeAllHandler(c, httptest.NewRecorder(), r, testAdmin)
+
+	r = HTTPRequest(t, "GET", "https://localhost/v1/validate?accountName=other&apiKey=wrong", "")
+	ValidateHandler(c, httptest.NewRecorder(), r)
+
+	r = HTTPRequest(t, "GET", "https://localhost/v1/admin/audit?accountName=someone", "")
+	w := httptest.NewRecorder()
+	AdminAuditHandler(c, w, r, testAdmin)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusOK, w.Code)
+	}
+
+	var log AdminAuditLog
+	if err := json.NewDecoder(w.Body).Decode(&log); err != nil {
+		t.Fatalf("Unable to decode response: %v", err)
+	}
+	if len(log.Events) != 1 {
+		t.Fatalf("Expected 1 audit event, but found %+v", log.Events)
+	}
+	event := log.Events[0]
+	if event.Event != "key.revoked_all" || event.Actor != testAdmin.Name || event.Outcome != AuditSuccess {
+		t.Errorf("Unexpected audit event: %+v", event)
+	}
+
+	until := time.Unix(0, event.Time).Add(-time.Second).Format(time.RFC3339)
+	r = HTTPRequest(t, "GET", "https://localhost/v1/admin/audit?until="+until, "")
+	w = httptest.NewRecorder()
+	AdminAuditHandler(c, w, r, testAdmin)
+
+	log = AdminAuditLog{}
+	if err := json.NewDecoder(w.Body).Decode(&log); err != nil {
+		t.Fatalf("Unable to decode response: %v", err)
+	}
+	if log.Events == nil || len(log.Events) != 0 {
+		t.Errorf("Expected an empty list of events before the first, but found %+v", log.Events)
+	}
+
+	r = HTTPRequest(t, "GET", "https://localhost/v1/admin/audit?accountName=other", "")
+	w = httptest.NewRecorder()
+	AdminAuditHandler(c, w, r, testAdmin)
+
+	log = AdminAuditLog{}
+	if err := json.NewDecoder(w.Body).Decode(&log); err != nil {
+		t.Fatalf("Unable to decode response: %v", err)
+	}
+	if len(log.Events) != 1 || log.Events[0].Event != "key.validation" || log.Events[0].Outcome != AuditFailure {
+		t.Errorf("Expected a failed key validation to be audited, but found %+v", log.Events)
+	}
+}
+
+func TestAdminAuditQueryErrors(t *testing.T) {
+	s := NewMemoryStorage()
+
+	cases := []struct {
+		context *Context
+		url     string
+		status  int
+	}{
+		{&Context{Storage: s, AuditSink: s, Hasher: testHasher}, "/v1/admin/audit?since=yesterday", http.StatusBadRequest},
+		{&Context{Storage: s, AuditSink: s, Hasher: testHasher}, "/v1/admin/audit?limit=0", http.StatusBadRequest},
+		{&Context{Storage: s, Hasher: testHasher}, "/v1/admin/audit", http.StatusNotImplemented},
+	}
+	for _, tc := range cases {
+		r := HTTPRequest(t, "GET", "https://localhost"+tc.url, "")
+		w := httptest.NewRecorder()
+		AdminAuditHandler(tc.context, w, r, testAdmin)
+
+		if w.Code != tc.status {
+			t.Errorf("Expected %s to respond with %d, but was %d", tc.url, tc.status, w.Code)
+		}
+	}
+}
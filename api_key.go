@@ -1,30 +1,97 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"gopkg.in/mgo.v2"
 )
 
 // KeyHandler dispatches requests made to the /keys resource to relevant subhandlers
 func KeyHandler(c *Context, w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
+	case "GET":
+		KeyListHandler(c, w, r)
 	case "POST":
 		KeyGenerationHandler(c, w, r)
 	case "DELETE":
 		KeyRevocationHandler(c, w, r)
 	default:
 		APIError{
-			Message: fmt.Sprintf("Unsupported method %s. Only POST is accepted for this resource.",
+			Message: fmt.Sprintf(
+				"Unsupported method %s. Only GET, POST and DELETE are accepted for this resource.",
 				r.Method),
 		}.Log("").Report(w, http.StatusMethodNotAllowed)
 	}
 }
 
-// KeyGenerationHandler generates a new API key for a provided user account. It persists the new
-// key in storage and returns it as a plaintext string.
+// KeyList is the JSON representation of every API key on an account.
+type KeyList struct {
+	Keys []APIKey `json:"keys"`
+}
+
+// KeyListHandler describes every API key on an account, after verifying its password and, if it's
+// enabled, its second factor. Key metadata is returned, but never the keys themselves.
+func KeyListHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	accountName, password, ok := ExtractPasswordCredentials(w, r, "Key listing")
+	if !ok {
+		return
+	}
+
+	account, ok := AuthenticatePassword(c, w, r, accountName, password)
+	if !ok || !RequireSecondFactor(c, w, r, account) {
+		return
+	}
+
+	list := KeyList{Keys: make([]APIKey, len(account.APIKeys))}
+	for i, key := range account.APIKeys {
+		key.Scopes = key.GrantedScopes()
+		list.Keys[i] = key
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(list)
+}
+
+// GeneratedKey is the JSON representation of a newly generated API key. It's the only time that
+// the key itself is ever revealed.
+type GeneratedKey struct {
+	APIKey
+
+	Key string `json:"key"`
+}
+
+// RotatedKey is the JSON representation of an API key generated to replace an existing one.
+type RotatedKey struct {
+	GeneratedKey
+
+	PreviousKeyID        string `json:"previousKeyId"`
+	PreviousKeyExpiresAt int64  `json:"previousKeyExpiresAt"`
+}
+
+// writeGeneratedKey responds with a newly generated API key. Clients that accept JSON receive the
+// provided document; everyone else receives the key as plaintext.
+func writeGeneratedKey(w http.ResponseWriter, r *http.Request, key string, doc interface{}) {
+	if WantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(doc)
+	} else {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(key))
+	}
+}
+
+// KeyGenerationHandler generates a new API key for a provided user account, after verifying its
+// password and, if it's enabled, its second factor. It persists the new key's digest in storage and
+// returns the key itself, either as a plaintext string or, if the client accepts JSON, along with
+// the rest of the key's record.
 func KeyGenerationHandler(c *Context, w http.ResponseWriter, r *http.Request) {
 	// Validate the credentials provided as query parameters.
 	accountName, password, ok := ExtractPasswordCredentials(w, r, "Key generation")
@@ -32,39 +99,184 @@ func KeyGenerationHandler(c *Context, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rejectAuth := func() {
+	label := r.FormValue("label")
+	if len(label) > APIKeyLabelLength {
+		APIError{
+			Message: fmt.Sprintf("API key labels may be at most %d characters long.", APIKeyLabelLength),
+		}.Log(accountName).Report(w, http.StatusBadRequest)
+		return
+	}
+
+	scopes, err := ParseScopes(r.FormValue("scopes"))
+	if err != nil {
+		APIError{
+			Message: err.Error(),
+		}.Log(accountName).Report(w, http.StatusBadRequest)
+		return
+	}
+
+	expiresAt, err := ParseKeyExpiry(r, time.Now())
+	if err != nil {
+		APIError{
+			Message: err.Error(),
+		}.Log(accountName).Report(w, http.StatusBadRequest)
+		return
+	}
+
+	account, ok := AuthenticatePassword(c, w, r, accountName, password)
+	if !ok || !RequireSecondFactor(c, w, r, account) {
+		return
+	}
+
+	// Success. Generate the new key, store its digest, and return it as a plaintext response.
+	key, record, err := NewAPIKey()
+	if err != nil {
 		APIError{
-			UserMessage: "Incorrect account name or password.",
-			LogMessage:  "Authentication failure for account.",
+			UserMessage: "Unable to generate your API key. Please try again later.",
+			LogMessage:  fmt.Sprintf("Unable to generate API key: %v", err),
+		}.Log(accountName).Report(w, http.StatusInternalServerError)
+		return
+	}
+
+	record.Label = label
+	record.CreatedFrom = ClientIP(r)
+	record.ExpiresAt = expiresAt
+	record.Scopes = scopes
+	if expiresAt != 0 {
+		record.Lifetime = expiresAt - record.CreatedAt
+	}
+
+	if err := c.Storage.AddKeyToAccount(accountName, record); err != nil {
+		APIError{
+			UserMessage: "Unable to generate your API key. Please try again later.",
+			LogMessage:  fmt.Sprintf("Unable to store API key: %v", err),
+		}.Log(accountName).Report(w, StorageErrorStatus(err))
+		return
+	}
+
+	writeGeneratedKey(w, r, key, GeneratedKey{APIKey: record, Key: key})
+
+	log.WithFields(log.Fields{
+		"account":    accountName,
+		"key prefix": record.Prefix,
+		"key id":     record.ID,
+	}).Info("A new API key has been generated.")
+	Audit(c, r, AuditEvent{
+		Event:   "key.generated",
+		Account: accountName,
+		Actor:   accountName,
+		Details: AuditDetails(log.Fields{"key id": record.ID}),
+	})
+}
+
+// ParseKeyExpiry determines when a newly generated API key should expire from the request's
+// "expiresIn" parameter, a duration like "720h", or its "expiresAt" parameter, an RFC 3339
+// timestamp. It returns zero if neither is present, meaning that the key never expires.
+func ParseKeyExpiry(r *http.Request, now time.Time) (int64, error) {
+	expiresIn, expiresAt := r.FormValue("expiresIn"), r.FormValue("expiresAt")
+
+	switch {
+	case expiresIn != "" && expiresAt != "":
+		return 0, errors.New("Specify at most one of expiresIn and expiresAt.")
+	case expiresIn != "":
+		d, err := time.ParseDuration(expiresIn)
+		if err != nil || d <= 0 {
+			return 0, fmt.Errorf("Invalid expiresIn [%s]: must be a positive duration, like 720h.", expiresIn)
+		}
+		return now.Add(d).UnixNano(), nil
+	case expiresAt != "":
+		t, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid expiresAt [%s]: must be an RFC 3339 timestamp.", expiresAt)
+		}
+		if !t.After(now) {
+			return 0, fmt.Errorf("Invalid expiresAt [%s]: must be in the future.", expiresAt)
+		}
+		return t.UnixNano(), nil
+	}
+	return 0, nil
+}
+
+// KeyRotationHandler replaces an existing API key with a newly generated one. The existing key keeps
+// working for a grace period, so that clients can switch over without an interruption, and then
+// expires. Requests may shorten the grace period, but never extend it beyond RotationGrace. Only
+// keys that grant the keys:manage scope may rotate themselves, and each key may only be rotated
+// once.
+func KeyRotationHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	if !MethodOk(w, r, "POST") {
+		return
+	}
+
+	accountName, apiKey, ok := ExtractKeyCredentials(w, r, "Key rotation")
+	if !ok {
+		return
+	}
+
+	grace := c.RotationGrace
+	if raw := r.FormValue("gracePeriod"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d < 0 || d > c.RotationGrace {
+			APIError{
+				Message: fmt.Sprintf(
+					"Invalid gracePeriod [%s]: must be a duration, like 1h, no longer than %s.",
+					raw, c.RotationGrace),
+			}.Log(accountName).Report(w, http.StatusBadRequest)
+			return
+		}
+		grace = d
+	}
+
+	rejectKey := func() {
+		APIError{
+			Message: "Unrecognized account or API key.",
 		}.Log(accountName).Report(w, http.StatusUnauthorized)
 	}
 
+	// Otherwise, a key in its grace period could mint any number of live replacements.
+	rejectRotated := func() {
+		APIError{
+			Message: "This API key has already been rotated. Rotate its replacement instead.",
+		}.Log(accountName).Report(w, http.StatusConflict)
+	}
+
 	account, err := c.Storage.FindAccount(accountName)
+	if err == ErrAccountNotFound {
+		rejectKey()
+		return
+	}
 	if err != nil {
 		APIError{
-			UserMessage: "Internal storage error. Please try again later.",
+			UserMessage: "Internal storage error encountered. Please try again later.",
 			LogMessage:  fmt.Sprintf("Error finding account: %v", err),
-		}.Log(accountName).Report(w, http.StatusInternalServerError)
+		}.Log(accountName).Report(w, StorageErrorStatus(err))
 		return
 	}
-	if account == nil {
-		// Account does not exist. Treat this exactly like a failed password attempt.
 
-		// Thwart timing attacks by doing a fake bcrypt comparison.
-		(&Account{}).HasPassword(password)
+	if account.Disabled {
+		RejectDisabled(w, accountName)
+		return
+	}
 
-		rejectAuth()
+	now := time.Now()
+	previous := account.Key(DigestAPIKey(apiKey))
+	if previous == nil || previous.Expired(now.UnixNano()) {
+		rejectKey()
+		return
+	}
+	if previous.Rotated {
+		rejectRotated()
 		return
 	}
 
-	if !account.HasPassword(password) {
-		// BZZZZZZZT
-		rejectAuth()
+	// Otherwise, a narrowly scoped key could renew itself indefinitely.
+	if !previous.HasScope(ScopeKeysManage) {
+		APIError{
+			Message: fmt.Sprintf("Only API keys that grant the scope [%s] may be rotated.", ScopeKeysManage),
+		}.Log(accountName).Report(w, http.StatusForbidden)
 		return
 	}
 
-	// Success. Generate the new key, put it in Mongo, and return it as a plaintext response.
-	key, err := account.GenerateAPIKey()
+	key, record, err := NewAPIKey()
 	if err != nil {
 		APIError{
 			UserMessage: "Unable to generate your API key. Please try again later.",
@@ -73,22 +285,162 @@ func KeyGenerationHandler(c *Context, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := c.Storage.AddKeyToAccount(accountName, key); err != nil {
+	// The replacement inherits the label, scopes and lifetime of the key that it replaces. Keys
+	// without a recorded lifetime, including those migrated from earlier versions, pass on none.
+	record.Label = previous.Label
+	record.Scopes = previous.GrantedScopes()
+	record.CreatedFrom = ClientIP(r)
+	record.Lifetime = previous.Lifetime
+	if previous.Lifetime != 0 {
+		record.ExpiresAt = record.CreatedAt + previous.Lifetime
+	}
+
+	// Never extend the life of the previous key.
+	expiresAt := now.Add(grace).UnixNano()
+	if previous.ExpiresAt != 0 && previous.ExpiresAt < expiresAt {
+		expiresAt = previous.ExpiresAt
+	}
+
+	if err := c.Storage.RotateKey(accountName, previous.Digest, record, expiresAt); err != nil {
+		if err == ErrAccountNotFound || err == ErrKeyNotFound {
+			rejectKey()
+			return
+		}
+		if err == ErrKeyRotated {
+			rejectRotated()
+			return
+		}
 		APIError{
-			UserMessage: "Unable to generate your API key. Please try again later.",
-			LogMessage:  fmt.Sprintf("Unable to store API key in MongoDB: %v", err),
-		}.Log(accountName).Report(w, http.StatusInternalServerError)
+			UserMessage: "Unable to rotate your API key. Please try again later.",
+			LogMessage:  fmt.Sprintf("Unable to store rotated API key: %v", err),
+		}.Log(accountName).Report(w, StorageErrorStatus(err))
 		return
 	}
 
-	w.Header().Set("Content-Type", "text/plain")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(key))
+	writeGeneratedKey(w, r, key, RotatedKey{
+		GeneratedKey:         GeneratedKey{APIKey: record, Key: key},
+		PreviousKeyID:        previous.ID,
+		PreviousKeyExpiresAt: expiresAt,
+	})
 
 	log.WithFields(log.Fields{
+		"account":         accountName,
+		"key id":          record.ID,
+		"previous key id": previous.ID,
+	}).Info("An API key has been rotated.")
+	Audit(c, r, AuditEvent{
+		Event:   "key.rotated",
+		Account: accountName,
+		Actor:   accountName,
+		Details: AuditDetails(log.Fields{"key id": record.ID, "previous key id": previous.ID}),
+	})
+}
+
+// RevokedKeys is the JSON representation of the result of revoking every API key on an account.
+type RevokedKeys struct {
+	Revoked     int           `json:"revoked"`
+	Replacement *GeneratedKey `json:"replacement,omitempty"`
+}
+
+// KeyRevokeAllHandler revokes every API key on an account at once, for example when a device that
+// holds them has been lost. If requested, a single replacement key is issued in their place. The
+// account's password and, if it's enabled, its second factor must be provided.
+func KeyRevokeAllHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	if !MethodOk(w, r, "POST") {
+		return
+	}
+
+	accountName, password, ok := ExtractPasswordCredentials(w, r, "Key revocation")
+	if !ok {
+		return
+	}
+
+	account, ok := AuthenticatePassword(c, w, r, accountName, password)
+	if !ok || !RequireSecondFactor(c, w, r, account) {
+		return
+	}
+
+	RevokeAllKeys(c, w, r, accountName, accountName)
+}
+
+// RevokeAllKeys revokes every API key on an account that's already been authorized by the caller,
+// and reports the result. If the request's "replace" parameter is true, a single replacement key
+// with the requested label is issued in their place. The revocation is audited as the work of
+// actor.
+func RevokeAllKeys(c *Context, w http.ResponseWriter, r *http.Request, accountName, actor string) {
+	replace := false
+	if raw := r.FormValue("replace"); raw != "" {
+		var err error
+		if replace, err = strconv.ParseBool(raw); err != nil {
+			APIError{
+				Message: fmt.Sprintf("Invalid replace [%s]: must be true or false.", raw),
+			}.Log(accountName).Report(w, http.StatusBadRequest)
+			return
+		}
+	}
+
+	label := r.FormValue("label")
+	if len(label) > APIKeyLabelLength {
+		APIError{
+			Message: fmt.Sprintf("API key labels may be at most %d characters long.", APIKeyLabelLength),
+		}.Log(accountName).Report(w, http.StatusBadRequest)
+		return
+	}
+
+	var result RevokedKeys
+	var replacement *APIKey
+	if replace {
+		key, record, err := NewAPIKey()
+		if err != nil {
+			APIError{
+				UserMessage: "Unable to generate your API key. Please try again later.",
+				LogMessage:  fmt.Sprintf("Unable to generate API key: %v", err),
+			}.Log(accountName).Report(w, http.StatusInternalServerError)
+			return
+		}
+		record.Label = label
+		record.CreatedFrom = ClientIP(r)
+
+		replacement = &record
+		result.Replacement = &GeneratedKey{APIKey: record, Key: key}
+	}
+
+	n, err := c.Storage.RevokeAllKeys(accountName, replacement)
+	if err == ErrAccountNotFound {
+		APIError{
+			Message: "Unrecognized account.",
+		}.Log(accountName).Report(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		APIError{
+			UserMessage: "Internal storage error encountered. Please try again later.",
+			LogMessage:  fmt.Sprintf("Unable to revoke API keys: %v", err),
+		}.Log(accountName).Report(w, StorageErrorStatus(err))
+		return
+	}
+	result.Revoked = n
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+
+	fields := log.Fields{
 		"account": accountName,
-		"key":     key,
-	}).Info("A new API key has been generated.")
+		"revoked": n,
+	}
+	if replacement != nil {
+		fields["replacement key id"] = replacement.ID
+	}
+	log.WithFields(fields).Info("Every API key on an account has been revoked.")
+
+	delete(fields, "account")
+	Audit(c, r, AuditEvent{
+		Event:   "key.revoked_all",
+		Account: accountName,
+		Actor:   actor,
+		Details: AuditDetails(fields),
+	})
 }
 
 // KeyRevocationHandler marks an API key as invalid for a specific account.
@@ -98,8 +450,8 @@ func KeyRevocationHandler(c *Context, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := c.Storage.RevokeKeyFromAccount(accountName, apiKey); err != nil {
-		if err == mgo.ErrNotFound {
+	if err := c.Storage.RevokeKeyFromAccount(accountName, DigestAPIKey(apiKey)); err != nil {
+		if err == ErrAccountNotFound || err == ErrKeyNotFound {
 			APIError{
 				Message: "Unrecognized account or API key.",
 			}.Log(accountName).Report(w, http.StatusUnauthorized)
@@ -108,14 +460,23 @@ func KeyRevocationHandler(c *Context, w http.ResponseWriter, r *http.Request) {
 		APIError{
 			UserMessage: "Internal storage error encountered. Please try again later.",
 			LogMessage:  fmt.Sprintf("Storage error: %v", err),
-		}.Log(accountName).Report(w, http.StatusInternalServerError)
+		}.Log(accountName).Report(w, StorageErrorStatus(err))
+		return
 	}
 
 	// Success!
 	w.WriteHeader(http.StatusNoContent)
 
+	revoked := apiKeyRecord(apiKey)
 	log.WithFields(log.Fields{
-		"account": accountName,
-		"key":     apiKey,
+		"account":    accountName,
+		"key prefix": revoked.Prefix,
+		"key id":     revoked.ID,
 	}).Info("An existing API key has revoked.")
+	Audit(c, r, AuditEvent{
+		Event:   "key.revoked",
+		Account: accountName,
+		Actor:   accountName,
+		Details: AuditDetails(log.Fields{"key id": revoked.ID}),
+	})
 }
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 type KeyTestStorage struct {
@@ -14,8 +19,11 @@ type KeyTestStorage struct {
 	FoundAccount *Account
 
 	AccountName *string
-	Appended    *string
+	Appended    *APIKey
 	Revoked     *string
+	Rotated     *string
+	ExpiresAt   int64
+	RevokedAll  bool
 }
 
 func (storage *KeyTestStorage) consumeError() error {
@@ -29,10 +37,13 @@ func (storage *KeyTestStorage) FindAccount(name string) (*Account, error) {
 		return nil, err
 	}
 
+	if storage.FoundAccount == nil {
+		return nil, ErrAccountNotFound
+	}
 	return storage.FoundAccount, nil
 }
 
-func (storage *KeyTestStorage) AddKeyToAccount(name, key string) error {
+func (storage *KeyTestStorage) AddKeyToAccount(name string, key APIKey) error {
 	if err := storage.consumeError(); err != nil {
 		return err
 	}
@@ -42,26 +53,49 @@ func (storage *KeyTestStorage) AddKeyToAccount(name, key string) error {
 	return nil
 }
 
-func (storage *KeyTestStorage) RevokeKeyFromAccount(name, key string) error {
+func (storage *KeyTestStorage) RevokeKeyFromAccount(name, digest string) error {
+	if err := storage.consumeError(); err != nil {
+		return err
+	}
+
+	storage.AccountName = &name
+	storage.Revoked = &digest
+	return nil
+}
+
+func (storage *KeyTestStorage) RotateKey(name, digest string, replacement APIKey, expiresAt int64) error {
 	if err := storage.consumeError(); err != nil {
 		return err
 	}
 
 	storage.AccountName = &name
-	storage.Revoked = &key
+	storage.Rotated = &digest
+	storage.Appended = &replacement
+	storage.ExpiresAt = expiresAt
 	return nil
 }
 
+func (storage *KeyTestStorage) RevokeAllKeys(name string, replacement *APIKey) (int, error) {
+	if err := storage.consumeError(); err != nil {
+		return 0, err
+	}
+
+	storage.AccountName = &name
+	storage.Appended = replacement
+	storage.RevokedAll = true
+	return 3, nil
+}
+
 func TestKeyGenerationSuccess(t *testing.T) {
 	r := HTTPRequest(t, "POST", "https://localhost/v1/keys",
 		`accountName=someone%40gmail.com&password=secret`)
 	w := httptest.NewRecorder()
-	a, err := NewAccount("someone@gmail.com", "secret")
+	a, err := NewAccount(testHasher, "someone@gmail.com", "secret")
 	if err != nil {
 		t.Fatalf("Unable to create account: %v", err)
 	}
 	s := &KeyTestStorage{FoundAccount: a}
-	c := &Context{Storage: s}
+	c := &Context{Storage: s, Hasher: testHasher}
 
 	KeyHandler(c, w, r)
 
@@ -89,8 +123,168 @@ func TestKeyGenerationSuccess(t *testing.T) {
 		t.Errorf("Expected account [someone@gmail.com] to be modified, but was [%s]", *s.AccountName)
 	}
 
-	if *s.Appended != key {
-		t.Errorf("Expected API key [%s] to be appended to account, but was [%s]", key, *s.Appended)
+	if s.Appended.Digest != DigestAPIKey(key) {
+		t.Errorf("Expected the digest of API key [%s] to be appended to account, but was [%s]", key, s.Appended.Digest)
+	}
+}
+
+func TestKeyGenerationRecord(t *testing.T) {
+	r := HTTPRequest(t, "POST", "https://localhost/v1/keys",
+		`accountName=someone%40gmail.com&password=secret&label=laptop`)
+	r.RemoteAddr = "10.0.0.1:54321"
+	r.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	a, err := NewAccount(testHasher, "someone@gmail.com", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+	s := &KeyTestStorage{FoundAccount: a}
+	c := &Context{Storage: s, Hasher: testHasher}
+
+	KeyHandler(c, w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusOK, w.Code)
+	}
+
+	if ctype := w.HeaderMap.Get("Content-Type"); ctype != "application/json" {
+		t.Errorf("Expected content type of [application/json], but got [%s]", ctype)
+	}
+
+	var generated GeneratedKey
+	if err := json.NewDecoder(w.Body).Decode(&generated); err != nil {
+		t.Fatalf("Unable to decode response: %v", err)
+	}
+
+	if generated.Key == "" {
+		t.Error("Expected response to contain an API key")
+	}
+
+	if generated.ID != s.Appended.ID || generated.ID == "" {
+		t.Errorf("Expected response key ID [%s] to match stored ID [%s]", generated.ID, s.Appended.ID)
+	}
+
+	if generated.Digest != "" {
+		t.Error("Expected the key digest to be omitted from the response")
+	}
+
+	if s.Appended.Label != "laptop" {
+		t.Errorf("Unexpected stored label [%s]", s.Appended.Label)
+	}
+
+	if s.Appended.CreatedFrom != "10.0.0.1" {
+		t.Errorf("Unexpected stored origin [%s]", s.Appended.CreatedFrom)
+	}
+}
+
+func TestKeyGenerationLongLabel(t *testing.T) {
+	r := HTTPRequest(t, "POST", "https://localhost/v1/keys",
+		`accountName=someone%40gmail.com&password=secret&label=`+strings.Repeat("x", APIKeyLabelLength+1))
+	w := httptest.NewRecorder()
+	c := &Context{Storage: &KeyTestStorage{}, Hasher: testHasher}
+
+	KeyHandler(c, w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected response code %d, but was %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestKeyGenerationScopes(t *testing.T) {
+	r := HTTPRequest(t, "POST", "https://localhost/v1/keys",
+		`accountName=someone%40gmail.com&password=secret&scopes=jobs:submit,jobs:read`)
+	w := httptest.NewRecorder()
+	a, err := NewAccount(testHasher, "someone@gmail.com", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+	s := &KeyTestStorage{FoundAccount: a}
+	c := &Context{Storage: s, Hasher: testHasher}
+
+	KeyHandler(c, w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusOK, w.Code)
+	}
+
+	expected := []string{ScopeJobsSubmit, ScopeJobsRead}
+	if s.Appended == nil || !reflect.DeepEqual(s.Appended.Scopes, expected) {
+		t.Errorf("Expected the key to be stored with scopes %v, but stored %v", expected, s.Appended)
+	}
+}
+
+func TestKeyGenerationUnknownScope(t *testing.T) {
+	r := HTTPRequest(t, "POST", "https://localhost/v1/keys",
+		`accountName=someone%40gmail.com&password=secret&scopes=root`)
+	w := httptest.NewRecorder()
+	c := &Context{Storage: &KeyTestStorage{}, Hasher: testHasher}
+
+	KeyHandler(c, w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected response code %d, but was %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestKeyGenerationExpiresIn(t *testing.T) {
+	r := HTTPRequest(t, "POST", "https://localhost/v1/keys",
+		`accountName=someone%40gmail.com&password=secret&expiresIn=720h`)
+	w := httptest.NewRecorder()
+	a, err := NewAccount(testHasher, "someone@gmail.com", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+	s := &KeyTestStorage{FoundAccount: a}
+	c := &Context{Storage: s, Hasher: testHasher}
+
+	before := time.Now()
+	KeyHandler(c, w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusOK, w.Code)
+	}
+
+	earliest := before.Add(720 * time.Hour).UnixNano()
+	latest := time.Now().Add(720 * time.Hour).UnixNano()
+	if s.Appended == nil || s.Appended.ExpiresAt < earliest || s.Appended.ExpiresAt > latest {
+		t.Errorf("Expected the key to expire in 720h, but stored %v", s.Appended)
+	}
+	if s.Appended.Lifetime != s.Appended.ExpiresAt-s.Appended.CreatedAt {
+		t.Errorf("Expected the key to record its lifetime, but stored %v", s.Appended)
+	}
+}
+
+func TestParseKeyExpiry(t *testing.T) {
+	now := time.Date(2016, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		query    string
+		expected int64
+		ok       bool
+	}{
+		{"", 0, true},
+		{"expiresIn=1h", now.Add(time.Hour).UnixNano(), true},
+		{"expiresAt=2016-04-01T00:00:00Z", time.Date(2016, time.April, 1, 0, 0, 0, 0, time.UTC).UnixNano(), true},
+		{"expiresIn=soon", 0, false},
+		{"expiresIn=-1h", 0, false},
+		{"expiresAt=tomorrow", 0, false},
+		{"expiresAt=2016-02-01T00:00:00Z", 0, false},
+		{"expiresIn=1h&expiresAt=2016-04-01T00:00:00Z", 0, false},
+	}
+
+	for _, c := range cases {
+		r := HTTPRequest(t, "POST", "https://localhost/v1/keys", c.query)
+
+		expiresAt, err := ParseKeyExpiry(r, now)
+		if c.ok && err != nil {
+			t.Errorf("Unexpected error parsing [%s]: %v", c.query, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("Expected an error parsing [%s]", c.query)
+		}
+		if expiresAt != c.expected {
+			t.Errorf("Expected [%s] to expire at %d, but got %d", c.query, c.expected, expiresAt)
+		}
 	}
 }
 
@@ -98,12 +292,12 @@ func TestKeyGenerationBadPassword(t *testing.T) {
 	r := HTTPRequest(t, "POST", "https://localhost/v1/keys",
 		`accountName=someone%40gmail.com&password=wrongwrongwrong`)
 	w := httptest.NewRecorder()
-	a, err := NewAccount("someone@gmail.com", "correct")
+	a, err := NewAccount(testHasher, "someone@gmail.com", "correct")
 	if err != nil {
 		t.Fatalf("Unable to create account: %v", err)
 	}
 	s := &KeyTestStorage{FoundAccount: a}
-	c := &Context{Storage: s}
+	c := &Context{Storage: s, Hasher: testHasher}
 
 	KeyHandler(c, w, r)
 
@@ -116,7 +310,7 @@ func TestKeyGenerationBadAccountName(t *testing.T) {
 	r := HTTPRequest(t, "POST", "https://localhost/v1/keys",
 		`accountName=unknown%40gmail.com&password=vacuouslytrue`)
 	w := httptest.NewRecorder()
-	c := &Context{Storage: &KeyTestStorage{}}
+	c := &Context{Storage: &KeyTestStorage{}, Hasher: testHasher}
 
 	KeyHandler(c, w, r)
 
@@ -125,15 +319,289 @@ func TestKeyGenerationBadAccountName(t *testing.T) {
 	}
 }
 
+func TestKeyListSuccess(t *testing.T) {
+	a, err := NewAccount(testHasher, "someone@gmail.com", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+	legacy := apiKeyRecord("123abc")
+	legacy.Label = "laptop"
+	a.APIKeys = append(a.APIKeys, legacy)
+
+	r := HTTPRequest(t, "GET", "https://localhost/v1/keys?accountName=someone%40gmail.com&password=secret", "")
+	w := httptest.NewRecorder()
+	c := &Context{Storage: &KeyTestStorage{FoundAccount: a}, Hasher: testHasher}
+
+	KeyHandler(c, w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusOK, w.Code)
+	}
+
+	if strings.Contains(w.Body.String(), legacy.Digest) {
+		t.Error("Expected key digests to be omitted from the listing")
+	}
+
+	var list KeyList
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatalf("Unable to decode response: %v", err)
+	}
+	if len(list.Keys) != 2 {
+		t.Fatalf("Expected 2 keys to be listed, but got %d", len(list.Keys))
+	}
+	if list.Keys[1].ID != legacy.ID || list.Keys[1].Label != "laptop" || list.Keys[1].Prefix != "123abc" {
+		t.Errorf("Unexpected key in listing: %+v", list.Keys[1])
+	}
+	if !reflect.DeepEqual(list.Keys[1].Scopes, KnownScopes) {
+		t.Errorf("Expected a legacy key to be listed with every scope, but got %v", list.Keys[1].Scopes)
+	}
+}
+
+func TestKeyListBadPassword(t *testing.T) {
+	a, err := NewAccount(testHasher, "someone@gmail.com", "correct")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+
+	r := HTTPRequest(t, "GET", "https://localhost/v1/keys?accountName=someone%40gmail.com&password=wrong", "")
+	w := httptest.NewRecorder()
+	c := &Context{Storage: &KeyTestStorage{FoundAccount: a}, Hasher: testHasher}
+
+	KeyHandler(c, w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected response code %d, but was %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestKeyRotationSuccess(t *testing.T) {
+	a, err := NewAccount(testHasher, "someone@gmail.com", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+	previous := apiKeyRecord("123abc")
+	previous.Label = "ci"
+	previous.CreatedAt = time.Now().Add(-time.Hour).UnixNano()
+	previous.ExpiresAt = previous.CreatedAt + int64(72*time.Hour)
+	previous.Lifetime = int64(72 * time.Hour)
+	a.APIKeys = append(a.APIKeys, previous)
+
+	r := HTTPRequest(t, "POST", "https://localhost/v1/keys/rotate",
+		`accountName=someone%40gmail.com&apiKey=123abc&gracePeriod=1h`)
+	r.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	s := &KeyTestStorage{FoundAccount: a}
+	c := &Context{Storage: s, RotationGrace: 24 * time.Hour, Hasher: testHasher}
+
+	before := time.Now()
+	KeyRotationHandler(c, w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusOK, w.Code)
+	}
+
+	if s.Rotated == nil || *s.Rotated != previous.Digest {
+		t.Errorf("Expected key [%s] to be rotated, but got %v", previous.Digest, s.Rotated)
+	}
+	if s.ExpiresAt < before.Add(time.Hour).UnixNano() || s.ExpiresAt > time.Now().Add(time.Hour).UnixNano() {
+		t.Errorf("Expected the previous key to expire in an hour, but got %d", s.ExpiresAt)
+	}
+
+	var doc RotatedKey
+	if err := json.NewDecoder(w.Body).Decode(&doc); err != nil {
+		t.Fatalf("Unable to decode response: %v", err)
+	}
+	if DigestAPIKey(doc.Key) != s.Appended.Digest {
+		t.Errorf("Response key doesn't match the stored replacement")
+	}
+	if doc.PreviousKeyID != previous.ID || doc.PreviousKeyExpiresAt != s.ExpiresAt {
+		t.Errorf("Unexpected previous key in response: %s, %d", doc.PreviousKeyID, doc.PreviousKeyExpiresAt)
+	}
+	if s.Appended.Label != "ci" {
+		t.Errorf("Expected the replacement to inherit its label, but got [%s]", s.Appended.Label)
+	}
+	if lifetime := s.Appended.ExpiresAt - s.Appended.CreatedAt; lifetime != int64(72*time.Hour) {
+		t.Errorf("Expected the replacement to inherit a 72h lifetime, but got %v", time.Duration(lifetime))
+	}
+	if s.Appended.Lifetime != previous.Lifetime {
+		t.Errorf("Expected the replacement to record a 72h lifetime, but got %v", time.Duration(s.Appended.Lifetime))
+	}
+}
+
+func TestKeyRotationRejectsRotatedKey(t *testing.T) {
+	a, err := NewAccount(testHasher, "someone@gmail.com", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+
+	// A key in the grace period that followed its rotation.
+	previous := apiKeyRecord("123abc")
+	previous.CreatedAt = time.Now().Add(-time.Hour).UnixNano()
+	previous.ExpiresAt = time.Now().Add(time.Hour).UnixNano()
+	previous.Rotated = true
+	a.APIKeys = append(a.APIKeys, previous)
+
+	r := HTTPRequest(t, "POST", "https://localhost/v1/keys/rotate",
+		`accountName=someone%40gmail.com&apiKey=123abc`)
+	w := httptest.NewRecorder()
+	s := &KeyTestStorage{FoundAccount: a}
+	c := &Context{Storage: s, RotationGrace: 24 * time.Hour, Hasher: testHasher}
+
+	KeyRotationHandler(c, w, r)
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected response code %d, but was %d", http.StatusConflict, w.Code)
+	}
+	if s.Rotated != nil {
+		t.Errorf("Expected no key to be rotated, but [%s] was", *s.Rotated)
+	}
+}
+
+func TestKeyRotationMigratedKey(t *testing.T) {
+	a, err := NewAccount(testHasher, "someone@gmail.com", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+
+	// Keys migrated from earlier versions have no creation time or recorded lifetime.
+	previous := apiKeyRecord("123abc")
+	previous.ExpiresAt = time.Now().Add(time.Hour).UnixNano()
+	a.APIKeys = append(a.APIKeys, previous)
+
+	r := HTTPRequest(t, "POST", "https://localhost/v1/keys/rotate",
+		`accountName=someone%40gmail.com&apiKey=123abc`)
+	w := httptest.NewRecorder()
+	s := &KeyTestStorage{FoundAccount: a}
+	c := &Context{Storage: s, RotationGrace: 24 * time.Hour, Hasher: testHasher}
+
+	KeyRotationHandler(c, w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusOK, w.Code)
+	}
+	if s.Appended.ExpiresAt != 0 || s.Appended.Lifetime != 0 {
+		t.Errorf("Expected the replacement to inherit no expiry, but got (%d, %d)",
+			s.Appended.ExpiresAt, s.Appended.Lifetime)
+	}
+}
+
+func TestKeyRotationKeepsEarlierExpiry(t *testing.T) {
+	a, err := NewAccount(testHasher, "someone@gmail.com", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+	previous := apiKeyRecord("123abc")
+	previous.ExpiresAt = time.Now().Add(time.Minute).UnixNano()
+	a.APIKeys = append(a.APIKeys, previous)
+
+	r := HTTPRequest(t, "POST", "https://localhost/v1/keys/rotate",
+		`accountName=someone%40gmail.com&apiKey=123abc`)
+	w := httptest.NewRecorder()
+	s := &KeyTestStorage{FoundAccount: a}
+	c := &Context{Storage: s, RotationGrace: 24 * time.Hour, Hasher: testHasher}
+
+	KeyRotationHandler(c, w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusOK, w.Code)
+	}
+	if s.ExpiresAt != previous.ExpiresAt {
+		t.Errorf("Expected rotation to keep the earlier expiry %d, but got %d", previous.ExpiresAt, s.ExpiresAt)
+	}
+}
+
+func TestKeyRotationLimitsGracePeriod(t *testing.T) {
+	a, err := NewAccount(testHasher, "someone@gmail.com", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+	a.APIKeys = append(a.APIKeys, apiKeyRecord("123abc"))
+
+	r := HTTPRequest(t, "POST", "https://localhost/v1/keys/rotate",
+		`accountName=someone%40gmail.com&apiKey=123abc&gracePeriod=876000h`)
+	w := httptest.NewRecorder()
+	s := &KeyTestStorage{FoundAccount: a}
+	c := &Context{Storage: s, RotationGrace: 24 * time.Hour, Hasher: testHasher}
+
+	KeyRotationHandler(c, w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected response code %d, but was %d", http.StatusBadRequest, w.Code)
+	}
+	if s.Rotated != nil {
+		t.Errorf("Expected no key to be rotated, but [%s] was", *s.Rotated)
+	}
+}
+
+func TestKeyRotationRequiresManagementScope(t *testing.T) {
+	a, err := NewAccount(testHasher, "someone@gmail.com", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+	previous := apiKeyRecord("123abc")
+	previous.Scopes = []string{ScopeJobsRead}
+	a.APIKeys = append(a.APIKeys, previous)
+
+	r := HTTPRequest(t, "POST", "https://localhost/v1/keys/rotate",
+		`accountName=someone%40gmail.com&apiKey=123abc`)
+	w := httptest.NewRecorder()
+	s := &KeyTestStorage{FoundAccount: a}
+	c := &Context{Storage: s, RotationGrace: 24 * time.Hour, Hasher: testHasher}
+
+	KeyRotationHandler(c, w, r)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected response code %d, but was %d", http.StatusForbidden, w.Code)
+	}
+	if s.Rotated != nil {
+		t.Errorf("Expected no key to be rotated, but [%s] was", *s.Rotated)
+	}
+}
+
+func TestKeyRotationUnknownKey(t *testing.T) {
+	a, err := NewAccount(testHasher, "someone@gmail.com", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+
+	r := HTTPRequest(t, "POST", "https://localhost/v1/keys/rotate",
+		`accountName=someone%40gmail.com&apiKey=123abc`)
+	w := httptest.NewRecorder()
+	s := &KeyTestStorage{FoundAccount: a}
+	c := &Context{Storage: s, Hasher: testHasher}
+
+	KeyRotationHandler(c, w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected response code %d, but was %d", http.StatusUnauthorized, w.Code)
+	}
+	if s.Rotated != nil {
+		t.Errorf("Expected no key to be rotated, but [%s] was", *s.Rotated)
+	}
+}
+
+func TestKeyRotationBadGracePeriod(t *testing.T) {
+	r := HTTPRequest(t, "POST", "https://localhost/v1/keys/rotate",
+		`accountName=someone%40gmail.com&apiKey=123abc&gracePeriod=-1h`)
+	w := httptest.NewRecorder()
+	c := &Context{Storage: &KeyTestStorage{}, Hasher: testHasher}
+
+	KeyRotationHandler(c, w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected response code %d, but was %d", http.StatusBadRequest, w.Code)
+	}
+}
+
 func TestKeyRevocationSuccess(t *testing.T) {
 	r := HTTPRequest(t, "DELETE", "https://localhost/v1/keys?accountName=someone&apiKey=123abc", "")
 	w := httptest.NewRecorder()
-	a, err := NewAccount("someone", "secret")
+	a, err := NewAccount(testHasher, "someone", "secret")
 	if err != nil {
 		t.Fatalf("Unable to create account: %v", err)
 	}
 	s := &KeyTestStorage{FoundAccount: a}
-	c := &Context{Storage: s}
+	c := &Context{Storage: s, Hasher: testHasher}
 
 	KeyRevocationHandler(c, w, r)
 
@@ -149,7 +617,94 @@ func TestKeyRevocationSuccess(t *testing.T) {
 		t.Errorf("Unexpected account name [%s]", *s.AccountName)
 	}
 
-	if *s.Revoked != "123abc" {
-		t.Errorf("Unexpected revoked key [%s]", *s.Revoked)
+	if *s.Revoked != DigestAPIKey("123abc") {
+		t.Errorf("Unexpected revoked key digest [%s]", *s.Revoked)
+	}
+}
+
+func TestKeyRevocationUnknownKey(t *testing.T) {
+	r := HTTPRequest(t, "DELETE", "https://localhost/v1/keys?accountName=someone&apiKey=123abc", "")
+	w := httptest.NewRecorder()
+	s := &KeyTestStorage{NextError: ErrKeyNotFound}
+	c := &Context{Storage: s, Hasher: testHasher}
+
+	KeyRevocationHandler(c, w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected response code %d, but was %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestKeyRevocationStorageFailure(t *testing.T) {
+	r := HTTPRequest(t, "DELETE", "https://localhost/v1/keys?accountName=someone&apiKey=123abc", "")
+	w := httptest.NewRecorder()
+	s := &KeyTestStorage{NextError: errors.New("WTF")}
+	c := &Context{Storage: s, Hasher: testHasher}
+
+	KeyRevocationHandler(c, w, r)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected response code %d, but was %d", http.StatusInternalServerError, w.Code)
+	}
+}
+
+func TestKeyRevokeAllSuccess(t *testing.T) {
+	a, err := NewAccount(testHasher, "someone@gmail.com", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+
+	r := HTTPRequest(t, "POST", "https://localhost/v1/keys/revoke-all",
+		`accountName=someone%40gmail.com&password=secret&replace=true&label=new+laptop`)
+	w := httptest.NewRecorder()
+	s := &KeyTestStorage{FoundAccount: a}
+	c := &Context{Storage: s, Hasher: testHasher}
+
+	KeyRevokeAllHandler(c, w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusOK, w.Code)
+	}
+	if !s.RevokedAll || s.AccountName == nil || *s.AccountName != "someone@gmail.com" {
+		t.Fatal("Expected every key on the account to be revoked")
+	}
+
+	var result RevokedKeys
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("Unable to decode response: %v", err)
+	}
+	if result.Revoked != 3 {
+		t.Errorf("Expected 3 keys to be reported as revoked, but got %d", result.Revoked)
+	}
+	if result.Replacement == nil || s.Appended == nil {
+		t.Fatal("Expected a replacement key to be issued")
+	}
+	if DigestAPIKey(result.Replacement.Key) != s.Appended.Digest {
+		t.Error("Response key doesn't match the stored replacement")
+	}
+	if s.Appended.Label != "new laptop" {
+		t.Errorf("Expected the replacement to be labelled, but got [%s]", s.Appended.Label)
+	}
+}
+
+func TestKeyRevokeAllBadPassword(t *testing.T) {
+	a, err := NewAccount(testHasher, "someone@gmail.com", "correct")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+
+	r := HTTPRequest(t, "POST", "https://localhost/v1/keys/revoke-all",
+		`accountName=someone%40gmail.com&password=wrong`)
+	w := httptest.NewRecorder()
+	s := &KeyTestStorage{FoundAccount: a}
+	c := &Context{Storage: s, Hasher: testHasher}
+
+	KeyRevokeAllHandler(c, w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected response code %d, but was %d", http.StatusUnauthorized, w.Code)
+	}
+	if s.RevokedAll {
+		t.Error("Expected no keys to be revoked")
 	}
 }
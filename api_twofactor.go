@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// TwoFactorEnrollment is the JSON representation of a new, unconfirmed TOTP enrollment.
+type TwoFactorEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// TwoFactorConfirmation is the JSON representation of a confirmed TOTP enrollment. It's the only
+// time that the recovery codes are revealed.
+type TwoFactorConfirmation struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// TwoFactorEnrollHandler begins enrolling an account in two-factor authentication, after verifying
+// its password. It generates a TOTP secret and returns it, along with an otpauth URI for
+// authenticator apps. The enrollment isn't enforced until it's been confirmed.
+func TwoFactorEnrollHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	if !MethodOk(w, r, "POST") {
+		return
+	}
+
+	accountName, password, ok := ExtractPasswordCredentials(w, r, "Two-factor enrollment")
+	if !ok {
+		return
+	}
+
+	account, ok := AuthenticatePassword(c, w, r, accountName, password)
+	if !ok {
+		return
+	}
+
+	if account.TwoFactorEnabled() {
+		APIError{
+			Message: "Two-factor authentication is already enabled for this account.",
+		}.Log(accountName).Report(w, http.StatusConflict)
+		return
+	}
+
+	twoFactor, err := NewTwoFactor()
+	if err != nil {
+		APIError{
+			UserMessage: "Unable to enroll in two-factor authentication. Please try again later.",
+			LogMessage:  fmt.Sprintf("Unable to generate TOTP secret: %v", err),
+		}.Log(accountName).Report(w, http.StatusInternalServerError)
+		return
+	}
+
+	if err := c.Storage.SetTwoFactor(accountName, twoFactor); err != nil {
+		APIError{
+			UserMessage: "Internal storage error.",
+			LogMessage:  fmt.Sprintf("Unable to store TOTP enrollment: %v", err),
+		}.Log(accountName).Report(w, StorageErrorStatus(err))
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"account": accountName,
+	}).Info("Two-factor enrollment started.")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(TwoFactorEnrollment{
+		Secret: twoFactor.Secret,
+		URI:    twoFactor.URI(accountName),
+	})
+}
+
+// TwoFactorConfirmHandler enables two-factor authentication for an account, once it's proven that
+// it can generate codes from its enrolled secret. It issues and returns a set of recovery codes.
+func TwoFactorConfirmHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	if !MethodOk(w, r, "POST") {
+		return
+	}
+
+	accountName, password, ok := ExtractPasswordCredentials(w, r, "Two-factor confirmation")
+	if !ok {
+		return
+	}
+
+	code := r.FormValue("otp")
+	if code == "" {
+		APIError{
+			UserMessage: `Missing required parameter "otp".`,
+			LogMessage:  "Two-factor confirmation request missing required query parameters.",
+		}.Log(accountName).Report(w, http.StatusBadRequest)
+		return
+	}
+
+	account, ok := AuthenticatePassword(c, w, r, accountName, password)
+	if !ok {
+		return
+	}
+
+	if account.TwoFactor == nil || account.TwoFactor.Confirmed {
+		APIError{
+			Message: "There's no two-factor enrollment waiting to be confirmed for this account.",
+		}.Log(accountName).Report(w, http.StatusConflict)
+		return
+	}
+
+	now := time.Now()
+	step, ok := account.TwoFactor.MatchCode(code, now)
+	if !ok {
+		rejectSecondFactor(c, w, r, accountName, now)
+		return
+	}
+
+	codes, digests, err := NewRecoveryCodes()
+	if err != nil {
+		APIError{
+			UserMessage: "Unable to enable two-factor authentication. Please try again later.",
+			LogMessage:  fmt.Sprintf("Unable to generate recovery codes: %v", err),
+		}.Log(accountName).Report(w, http.StatusInternalServerError)
+		return
+	}
+
+	confirmed := &TwoFactor{
+		Secret:        account.TwoFactor.Secret,
+		Confirmed:     true,
+		LastStep:      step,
+		RecoveryCodes: digests,
+	}
+	if err := c.Storage.SetTwoFactor(accountName, confirmed); err != nil {
+		APIError{
+			UserMessage: "Internal storage error.",
+			LogMessage:  fmt.Sprintf("Unable to confirm TOTP enrollment: %v", err),
+		}.Log(accountName).Report(w, StorageErrorStatus(err))
+		return
+	}
+
+	Audit(c, r, AuditEvent{Event: "twofactor.enabled", Account: accountName, Actor: accountName})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(TwoFactorConfirmation{RecoveryCodes: codes})
+}
+
+// TwoFactorDisableHandler removes an account's two-factor enrollment, after verifying its password
+// and a second factor.
+func TwoFactorDisableHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	if !MethodOk(w, r, "POST") {
+		return
+	}
+
+	accountName, password, ok := ExtractPasswordCredentials(w, r, "Two-factor removal")
+	if !ok {
+		return
+	}
+
+	account, ok := AuthenticatePassword(c, w, r, accountName, password)
+	if !ok {
+		return
+	}
+
+	if !RequireSecondFactor(c, w, r, account) {
+		return
+	}
+
+	if err := c.Storage.SetTwoFactor(accountName, nil); err != nil {
+		APIError{
+			UserMessage: "Internal storage error.",
+			LogMessage:  fmt.Sprintf("Unable to remove TOTP enrollment: %v", err),
+		}.Log(accountName).Report(w, StorageErrorStatus(err))
+		return
+	}
+
+	Audit(c, r, AuditEvent{Event: "twofactor.disabled", Account: accountName, Actor: accountName})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RequireSecondFactor verifies the second factor in a request's "otp" parameter, if an account has
+// enabled two-factor authentication. It may be a TOTP code or an unused recovery code. If it's
+// missing or incorrect, it reports an error and returns false.
+func RequireSecondFactor(c *Context, w http.ResponseWriter, r *http.Request, account *Account) bool {
+	if !account.TwoFactorEnabled() {
+		return true
+	}
+
+	code := r.FormValue("otp")
+	if code == "" {
+		APIError{
+			UserMessage: "This account requires a two-factor authentication code.",
+			LogMessage:  "Request missing a required two-factor authentication code.",
+		}.Log(account.Name).Report(w, http.StatusUnauthorized)
+		return false
+	}
+
+	now := time.Now()
+	recovery := !IsTOTPCode(code)
+
+	var err error
+	if recovery {
+		err = c.Storage.UseRecoveryCode(account.Name, DigestRecoveryCode(code))
+	} else if step, ok := account.TwoFactor.MatchCode(code, now); ok {
+		err = c.Storage.UseTwoFactorStep(account.Name, step)
+	} else {
+		err = ErrTwoFactorInvalid
+	}
+
+	if err == ErrTwoFactorInvalid {
+		rejectSecondFactor(c, w, r, account.Name, now)
+		return false
+	}
+	if err != nil {
+		APIError{
+			UserMessage: "Internal storage error. Please try again later.",
+			LogMessage:  fmt.Sprintf("Error verifying second factor: %v", err),
+		}.Log(account.Name).Report(w, StorageErrorStatus(err))
+		return false
+	}
+
+	if recovery {
+		Audit(c, r, AuditEvent{
+			Event:   "twofactor.recovery_code_used",
+			Account: account.Name,
+			Actor:   account.Name,
+			Details: AuditDetails(log.Fields{
+				"remaining": len(account.TwoFactor.RecoveryCodes) - 1,
+			}),
+		})
+	}
+
+	if err := ClearPasswordFailures(c, account.Name); err != nil {
+		log.WithFields(log.Fields{
+			"account": account.Name,
+			"error":   err,
+		}).Error("Unable to clear failed password attempts.")
+	}
+	return true
+}
+
+// rejectSecondFactor reports an incorrect second factor. It counts as a failed password attempt,
+// so that codes can't be guessed any faster than passwords.
+func rejectSecondFactor(c *Context, w http.ResponseWriter, r *http.Request, accountName string, now time.Time) {
+	if err := RecordPasswordFailure(c, accountName, ClientIP(r), now); err != nil {
+		log.WithFields(log.Fields{
+			"account": accountName,
+			"error":   err,
+		}).Error("Unable to record a failed second factor.")
+	}
+
+	APIError{
+		UserMessage: "Incorrect two-factor authentication code.",
+		LogMessage:  "Two-factor authentication failure for account.",
+	}.Log(accountName).Report(w, http.StatusUnauthorized)
+}
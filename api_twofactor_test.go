@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testTOTPSecret decodes the secret of a TOTP enrollment.
+func testTOTPSecret(t *testing.T, twoFactor *TwoFactor) []byte {
+	secret, err := base32.StdEncoding.DecodeString(twoFactor.Secret)
+	if err != nil {
+		t.Fatalf("Unable to decode TOTP secret: %v", err)
+	}
+	return secret
+}
+
+// twoFactorTestContext stores an account that has enabled two-factor authentication, and returns
+// its TOTP secret and recovery codes.
+func twoFactorTestContext(t *testing.T) (*Context, []byte, []string) {
+	s := NewMemoryStorage()
+	a, err := NewAccount(testHasher, "someone", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+	if err := s.CreateAccount(a); err != nil {
+		t.Fatalf("Unable to store account: %v", err)
+	}
+	c := &Context{Storage: s, Hasher: testHasher}
+
+	r := HTTPRequest(t, "POST", "https://localhost/v1/accounts/2fa/enroll", "accountName=someone&password=secret")
+	w := httptest.NewRecorder()
+	TwoFactorEnrollHandler(c, w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected enrollment to succeed, but was %d", w.Code)
+	}
+
+	var enrollment TwoFactorEnrollment
+	if err := json.NewDecoder(w.Body).Decode(&enrollment); err != nil {
+		t.Fatalf("Unable to decode enrollment: %v", err)
+	}
+	secret := testTOTPSecret(t, &TwoFactor{Secret: enrollment.Secret})
+
+	code := TOTPCode(secret, TOTPStep(time.Now()))
+	r = HTTPRequest(t, "POST", "https://localhost/v1/accounts/2fa/confirm",
+		"accountName=someone&password=secret&otp="+code)
+	w = httptest.NewRecorder()
+	TwoFactorConfirmHandler(c, w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected confirmation to succeed, but was %d", w.Code)
+	}
+
+	var confirmation TwoFactorConfirmation
+	if err := json.NewDecoder(w.Body).Decode(&confirmation); err != nil {
+		t.Fatalf("Unable to decode confirmation: %v", err)
+	}
+	if len(confirmation.RecoveryCodes) != RecoveryCodeCount {
+		t.Fatalf("Expected %d recovery codes, but got %d", RecoveryCodeCount, len(confirmation.RecoveryCodes))
+	}
+	return c, secret, confirmation.RecoveryCodes
+}
+
+func generateKeyWithSecondFactor(t *testing.T, c *Context, otp string) int {
+	r := HTTPRequest(t, "POST", "https://localhost/v1/keys",
+		fmt.Sprintf("accountName=someone&password=secret&otp=%s", otp))
+	w := httptest.NewRecorder()
+	KeyGenerationHandler(c, w, r)
+	return w.Code
+}
+
+func TestTwoFactorEnrollment(t *testing.T) {
+	c, _, _ := twoFactorTestContext(t)
+
+	account, err := c.Storage.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if !account.TwoFactorEnabled() {
+		t.Error("Expected two-factor authentication to be enabled")
+	}
+
+	r := HTTPRequest(t, "POST", "https://localhost/v1/accounts/2fa/enroll", "accountName=someone&password=secret")
+	w := httptest.NewRecorder()
+	TwoFactorEnrollHandler(c, w, r)
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected a second enrollment to conflict, but was %d", w.Code)
+	}
+}
+
+func TestTwoFactorConfirmWrongCode(t *testing.T) {
+	s := NewMemoryStorage()
+	a, err := NewAccount(testHasher, "someone", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+	a.TwoFactor = &TwoFactor{Secret: "JBSWY3DPEHPK3PXP"}
+	if err := s.CreateAccount(a); err != nil {
+		t.Fatalf("Unable to store account: %v", err)
+	}
+	c := &Context{Storage: s, Hasher: testHasher}
+
+	r := HTTPRequest(t, "POST", "https://localhost/v1/accounts/2fa/confirm",
+		"accountName=someone&password=secret&otp=000000")
+	w := httptest.NewRecorder()
+	TwoFactorConfirmHandler(c, w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected response code %d, but was %d", http.StatusUnauthorized, w.Code)
+	}
+
+	account, err := s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if account.TwoFactorEnabled() {
+		t.Error("Expected two-factor authentication to remain unconfirmed")
+	}
+}
+
+func TestKeyGenerationRequiresSecondFactor(t *testing.T) {
+	c, secret, _ := twoFactorTestContext(t)
+
+	if code := generateKeyWithSecondFactor(t, c, ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected a missing code to be unauthorized, but was %d", code)
+	}
+	if code := generateKeyWithSecondFactor(t, c, "000000"); code != http.StatusUnauthorized {
+		t.Errorf("Expected an incorrect code to be unauthorized, but was %d", code)
+	}
+
+	// The confirmation used the current step, so the next one is still accepted.
+	next := TOTPCode(secret, TOTPStep(time.Now())+1)
+	if code := generateKeyWithSecondFactor(t, c, next); code != http.StatusOK {
+		t.Errorf("Expected a valid code to be accepted, but was %d", code)
+	}
+	if code := generateKeyWithSecondFactor(t, c, next); code != http.StatusUnauthorized {
+		t.Errorf("Expected a code to be usable only once, but was %d", code)
+	}
+}
+
+func TestRecoveryCodeUsedOnce(t *testing.T) {
+	c, _, recoveryCodes := twoFactorTestContext(t)
+
+	if code := generateKeyWithSecondFactor(t, c, recoveryCodes[0]); code != http.StatusOK {
+		t.Errorf("Expected a recovery code to be accepted, but was %d", code)
+	}
+	if code := generateKeyWithSecondFactor(t, c, recoveryCodes[0]); code != http.StatusUnauthorized {
+		t.Errorf("Expected a recovery code to be usable only once, but was %d", code)
+	}
+}
+
+func TestPasswordChangeRequiresSecondFactor(t *testing.T) {
+	c, _, recoveryCodes := twoFactorTestContext(t)
+
+	r := HTTPRequest(t, "POST", "https://localhost/v1/accounts/password",
+		"accountName=someone&password=secret&newPassword=changed")
+	w := httptest.NewRecorder()
+	PasswordChangeHandler(c, w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusUnauthorized, w.Code)
+	}
+
+	r = HTTPRequest(t, "POST", "https://localhost/v1/accounts/password",
+		"accountName=someone&password=secret&newPassword=changed&otp="+recoveryCodes[1])
+	w = httptest.NewRecorder()
+	PasswordChangeHandler(c, w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusNoContent, w.Code)
+	}
+}
+
+func TestAccountDeletionRequiresSecondFactor(t *testing.T) {
+	c, _, recoveryCodes := twoFactorTestContext(t)
+
+	r := HTTPRequest(t, "DELETE", "https://localhost/v1/accounts?accountName=someone&password=secret", "")
+	w := httptest.NewRecorder()
+	AccountDeletionHandler(c, w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusUnauthorized, w.Code)
+	}
+
+	r = HTTPRequest(t, "DELETE",
+		"https://localhost/v1/accounts?accountName=someone&password=secret&otp="+recoveryCodes[2], "")
+	w = httptest.NewRecorder()
+	AccountDeletionHandler(c, w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusNoContent, w.Code)
+	}
+}
+
+func TestKeyRevokeAllRequiresSecondFactor(t *testing.T) {
+	c, _, recoveryCodes := twoFactorTestContext(t)
+
+	r := HTTPRequest(t, "POST", "https://localhost/v1/keys/revoke-all",
+		"accountName=someone&password=secret&replace=true")
+	w := httptest.NewRecorder()
+	KeyRevokeAllHandler(c, w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusUnauthorized, w.Code)
+	}
+
+	account, err := c.Storage.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if len(account.APIKeys) != 1 {
+		t.Fatalf("Expected the account's key to survive, but it has %d keys", len(account.APIKeys))
+	}
+
+	r = HTTPRequest(t, "POST", "https://localhost/v1/keys/revoke-all",
+		"accountName=someone&password=secret&replace=true&otp="+recoveryCodes[3])
+	w = httptest.NewRecorder()
+	KeyRevokeAllHandler(c, w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestKeyListRequiresSecondFactor(t *testing.T) {
+	c, _, recoveryCodes := twoFactorTestContext(t)
+
+	r := HTTPRequest(t, "GET", "https://localhost/v1/keys?accountName=someone&password=secret", "")
+	w := httptest.NewRecorder()
+	KeyListHandler(c, w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusUnauthorized, w.Code)
+	}
+
+	r = HTTPRequest(t, "GET",
+		"https://localhost/v1/keys?accountName=someone&password=secret&otp="+recoveryCodes[4], "")
+	w = httptest.NewRecorder()
+	KeyListHandler(c, w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestTwoFactorDisable(t *testing.T) {
+	c, _, recoveryCodes := twoFactorTestContext(t)
+
+	r := HTTPRequest(t, "POST", "https://localhost/v1/accounts/2fa/disable",
+		"accountName=someone&password=secret&otp="+recoveryCodes[0])
+	w := httptest.NewRecorder()
+	TwoFactorDisableHandler(c, w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusNoContent, w.Code)
+	}
+
+	if code := generateKeyWithSecondFactor(t, c, ""); code != http.StatusOK {
+		t.Errorf("Expected a key to be generated without a second factor, but was %d", code)
+	}
+}
+
+func TestSecondFactorFailuresCountTowardLockout(t *testing.T) {
+	c, _, _ := twoFactorTestContext(t)
+	c.Lockout = testLockoutPolicy()
+
+	for i := 0; i < 3; i++ {
+		if code := generateKeyWithSecondFactor(t, c, "000000"); code != http.StatusUnauthorized {
+			t.Fatalf("Expected attempt %d to be unauthorized, but was %d", i+1, code)
+		}
+	}
+
+	if code := generateKeyWithSecondFactor(t, c, "000000"); code != 429 {
+		t.Errorf("Expected repeated incorrect codes to be locked out, but was %d", code)
+	}
+}
@@ -1,14 +1,25 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"gopkg.in/mgo.v2"
 )
 
-// ValidateHandler determines whether or not an API key is valid for a specific account.
+// ValidatedKey is the JSON representation of a successfully validated API key.
+type ValidatedKey struct {
+	AccountName string   `json:"accountName"`
+	KeyID       string   `json:"keyId"`
+	Scopes      []string `json:"scopes"`
+	ExpiresAt   int64    `json:"expiresAt,omitempty"`
+}
+
+// ValidateHandler determines whether or not an API key is valid for a specific account. If the
+// request names a scope, the key must also grant it. Clients that accept JSON are told which
+// scopes the key grants.
 func ValidateHandler(c *Context, w http.ResponseWriter, r *http.Request) {
 	if !MethodOk(w, r, "GET") {
 		return
@@ -19,32 +30,71 @@ func ValidateHandler(c *Context, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ok, err := c.Storage.AccountHasKey(accountName, apiKey)
-	if err != nil {
-		if err == mgo.ErrNotFound {
-			APIError{
-				Message: "Unrecognized account or API key.",
-			}.Log(accountName).Report(w, http.StatusUnauthorized)
-			return
-		}
+	digest := DigestAPIKey(apiKey)
+	key, err := c.Storage.FindKey(accountName, digest)
+	if err != nil && err != ErrAccountNotFound && err != ErrKeyNotFound && err != ErrAccountDisabled {
 		APIError{
 			UserMessage: "Internal storage error encountered. Please try again later.",
 			LogMessage:  fmt.Sprintf("Storage error: %v", err),
-		}.Log(accountName).Report(w, http.StatusInternalServerError)
+		}.Log(accountName).Report(w, StorageErrorStatus(err))
 		return
 	}
 
+	scope := r.FormValue("scope")
+
 	var message string
-	if ok {
-		w.WriteHeader(http.StatusNoContent)
-		message = "API key successfully validated."
-	} else {
+	success := false
+	switch {
+	case err == ErrAccountDisabled:
+		w.WriteHeader(http.StatusForbidden)
+		message = "API key for a disabled account encountered."
+	case key == nil:
 		w.WriteHeader(http.StatusNotFound)
 		message = "Invalid API key encountered."
+	case scope != "" && !key.HasScope(scope):
+		w.WriteHeader(http.StatusForbidden)
+		message = fmt.Sprintf("API key does not grant the scope [%s].", scope)
+	default:
+		// Failing to record usage shouldn't cause an otherwise valid key to be rejected.
+		if err := c.Storage.TouchAPIKey(accountName, digest, time.Now().UnixNano()); err != nil {
+			log.WithFields(log.Fields{
+				"account": accountName,
+				"error":   err,
+			}).Warn("Unable to record API key usage.")
+		}
+
+		if WantsJSON(r) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(ValidatedKey{
+				AccountName: accountName,
+				KeyID:       key.ID,
+				Scopes:      key.GrantedScopes(),
+				ExpiresAt:   key.ExpiresAt,
+			})
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		message = "API key successfully validated."
+		success = true
 	}
 
+	validated := apiKeyRecord(apiKey)
 	log.WithFields(log.Fields{
-		"account": accountName,
-		"key":     apiKey,
+		"account":    accountName,
+		"key prefix": validated.Prefix,
+		"key id":     validated.ID,
 	}).Info(message)
+
+	// Successful validations are far too frequent to audit, but failures may reveal a leaked or
+	// guessed key.
+	if !success {
+		Audit(c, r, AuditEvent{
+			Event:   "key.validation",
+			Account: accountName,
+			Actor:   accountName,
+			Outcome: AuditFailure,
+			Details: AuditDetails(log.Fields{"key id": validated.ID, "reason": message}),
+		})
+	}
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -9,35 +10,102 @@ import (
 type ValidateTestStorage struct {
 	NullStorage
 
-	Accept bool
+	Key     *APIKey
+	Digest  string
+	Touched bool
 }
 
-func (storage *ValidateTestStorage) AccountHasKey(name, key string) (bool, error) {
-	return storage.Accept, nil
+func (storage *ValidateTestStorage) FindKey(name, digest string) (*APIKey, error) {
+	storage.Digest = digest
+	if storage.Key == nil {
+		return nil, ErrKeyNotFound
+	}
+	return storage.Key, nil
+}
+
+func (storage *ValidateTestStorage) TouchAPIKey(name, digest string, usedAt int64) error {
+	storage.Touched = usedAt != 0
+	return nil
 }
 
 func TestValidateHandlerSuccess(t *testing.T) {
 	r := HTTPRequest(t, "GET", "https://localhost/v1/validate?accountName=someone&apiKey=ff01ab", "")
 	w := httptest.NewRecorder()
-	s := &ValidateTestStorage{Accept: true}
-	c := &Context{Storage: s}
+	key := apiKeyRecord("ff01ab")
+	s := &ValidateTestStorage{Key: &key}
+	c := &Context{Storage: s, Hasher: testHasher}
 
 	ValidateHandler(c, w, r)
 
 	if w.Code != http.StatusNoContent {
 		t.Errorf("Expected response code %d, but was %d", http.StatusNoContent, w.Code)
 	}
+
+	if s.Digest != DigestAPIKey("ff01ab") {
+		t.Errorf("Expected the key to be looked up by digest, but got [%s]", s.Digest)
+	}
+
+	if !s.Touched {
+		t.Error("Expected the key's last use to be recorded")
+	}
 }
 
 func TestValidateHandlerReject(t *testing.T) {
 	r := HTTPRequest(t, "GET", "https://localhost/v1/validate?accountName=someone&apiKey=ff01ab", "")
 	w := httptest.NewRecorder()
-	s := &ValidateTestStorage{Accept: false}
-	c := &Context{Storage: s}
+	s := &ValidateTestStorage{}
+	c := &Context{Storage: s, Hasher: testHasher}
 
 	ValidateHandler(c, w, r)
 
 	if w.Code != http.StatusNotFound {
 		t.Errorf("Expected response code %d, but was %d", http.StatusNotFound, w.Code)
 	}
+
+	if s.Touched {
+		t.Error("Expected a rejected key's last use not to be recorded")
+	}
+}
+
+func TestValidateHandlerScopes(t *testing.T) {
+	r := HTTPRequest(t, "GET", "https://localhost/v1/validate?accountName=someone&apiKey=ff01ab", "")
+	r.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	key := apiKeyRecord("ff01ab")
+	key.Scopes = []string{ScopeJobsRead}
+	c := &Context{Storage: &ValidateTestStorage{Key: &key}, Hasher: testHasher}
+
+	ValidateHandler(c, w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusOK, w.Code)
+	}
+
+	var doc ValidatedKey
+	if err := json.NewDecoder(w.Body).Decode(&doc); err != nil {
+		t.Fatalf("Unable to decode response: %v", err)
+	}
+	if doc.KeyID != key.ID || len(doc.Scopes) != 1 || doc.Scopes[0] != ScopeJobsRead {
+		t.Errorf("Unexpected validation response: %+v", doc)
+	}
+}
+
+func TestValidateHandlerMissingScope(t *testing.T) {
+	r := HTTPRequest(t, "GET",
+		"https://localhost/v1/validate?accountName=someone&apiKey=ff01ab&scope=jobs:submit", "")
+	w := httptest.NewRecorder()
+	key := apiKeyRecord("ff01ab")
+	key.Scopes = []string{ScopeJobsRead}
+	s := &ValidateTestStorage{Key: &key}
+	c := &Context{Storage: s, Hasher: testHasher}
+
+	ValidateHandler(c, w, r)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected response code %d, but was %d", http.StatusForbidden, w.Code)
+	}
+
+	if s.Touched {
+		t.Error("Expected a rejected key's last use not to be recorded")
+	}
 }
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Outcomes of an audited event.
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// DefaultAuditQueryLimit and MaxAuditQueryLimit bound the number of events returned by a single
+// audit query.
+const (
+	DefaultAuditQueryLimit = 100
+	MaxAuditQueryLimit     = 1000
+)
+
+// Counter of audit events that couldn't be recorded by the audit sink, published with expvar.
+var auditSinkFailures = expvar.NewInt("audit_sink_failures")
+
+// AuditEvent is a single entry in the audit trail: a security-relevant event, such as an account
+// being deleted, that operators may need to reconstruct later.
+type AuditEvent struct {
+	// Event names what happened, like "account.deleted".
+	Event string `json:"event" bson:"event"`
+
+	// Account is the account that the event affected, and Actor is the account or process that
+	// caused it.
+	Account string `json:"account" bson:"account"`
+	Actor   string `json:"actor" bson:"actor"`
+
+	// Address and CertificateSubject identify the client that made the request, if there was one.
+	Address            string `json:"address,omitempty" bson:"address"`
+	CertificateSubject string `json:"certificateSubject,omitempty" bson:"certificate_subject"`
+
+	// Outcome is AuditSuccess or AuditFailure.
+	Outcome string `json:"outcome" bson:"outcome"`
+	Time    int64  `json:"time" bson:"time"`
+
+	Details map[string]string `json:"details,omitempty" bson:"details,omitempty"`
+}
+
+// AuditSink records audit events somewhere more durable than the process log.
+type AuditSink interface {
+	RecordAuditEvent(event AuditEvent) error
+}
+
+// AuditReader is implemented by AuditSinks that can be queried.
+type AuditReader interface {
+	FindAuditEvents(query AuditQuery) ([]AuditEvent, error)
+}
+
+// AuditQuery selects audit events, in the order that they happened.
+type AuditQuery struct {
+	// Account, if it's set, only matches events that affected that account.
+	Account string
+
+	// Since and Until, if they're nonzero, only match events that happened at or after Since, and
+	// before Until.
+	Since int64
+	Until int64
+
+	// Limit is the most events to return, and defaults to DefaultAuditQueryLimit.
+	Limit int
+}
+
+// normalize fills in the query's defaults.
+func (query *AuditQuery) normalize() {
+	if query.Limit <= 0 {
+		query.Limit = DefaultAuditQueryLimit
+	}
+	if query.Limit > MaxAuditQueryLimit {
+		query.Limit = MaxAuditQueryLimit
+	}
+}
+
+// matches returns true if an event satisfies every filter of the query.
+func (query AuditQuery) matches(event AuditEvent) bool {
+	switch {
+	case query.Account != "" && event.Account != query.Account:
+		return false
+	case query.Since != 0 && event.Time < query.Since:
+		return false
+	case query.Until != 0 && event.Time >= query.Until:
+		return false
+	}
+	return true
+}
+
+// auditOrder sorts audit events in the order that they happened.
+type auditOrder []AuditEvent
+
+func (o auditOrder) Len() int           { return len(o) }
+func (o auditOrder) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
+func (o auditOrder) Less(i, j int) bool { return o[i].Time < o[j].Time }
+
+// queryAuditEvents selects events from every event, for sinks that can't filter events themselves.
+func queryAuditEvents(events []AuditEvent, query AuditQuery) []AuditEvent {
+	query.normalize()
+
+	var selected []AuditEvent
+	for _, event := range events {
+		if query.matches(event) {
+			selected = append(selected, event)
+		}
+	}
+	sort.Stable(auditOrder(selected))
+
+	if len(selected) > query.Limit {
+		selected = selected[:query.Limit]
+	}
+	return selected
+}
+
+// Audit records a security-relevant event. If it was caused by a request, r identifies the client
+// that made it. The event is written to the process log, marked with an "audit" field, and to the
+// context's AuditSink, if it has one. Failures to record it are logged, but don't interrupt the
+// request.
+func Audit(c *Context, r *http.Request, event AuditEvent) {
+	if event.Outcome == "" {
+		event.Outcome = AuditSuccess
+	}
+	if event.Time == 0 {
+		event.Time = time.Now().UnixNano()
+	}
+	if r != nil {
+		event.Address = ClientIP(r)
+		event.CertificateSubject = certificateSubject(r)
+	}
+
+	fields := log.Fields{
+		"audit":   event.Event,
+		"account": event.Account,
+		"actor":   event.Actor,
+		"outcome": event.Outcome,
+	}
+	if event.Address != "" {
+		fields["from"] = event.Address
+	}
+	if event.CertificateSubject != "" {
+		fields["certificate"] = event.CertificateSubject
+	}
+	for k, v := range event.Details {
+		fields[k] = v
+	}
+	log.WithFields(fields).Info("Audit event recorded.")
+
+	if c.AuditSink == nil {
+		return
+	}
+	if err := c.AuditSink.RecordAuditEvent(event); err != nil {
+		auditSinkFailures.Add(1)
+		log.WithFields(log.Fields{
+			"audit": event.Event,
+			"error": err,
+		}).Error("Unable to record audit event.")
+	}
+}
+
+// AuditDetails formats the details of an audit event as strings.
+func AuditDetails(details log.Fields) map[string]string {
+	if len(details) == 0 {
+		return nil
+	}
+
+	formatted := make(map[string]string, len(details))
+	for k, v := range details {
+		formatted[k] = fmt.Sprint(v)
+	}
+	return formatted
+}
+
+// FileAuditSink appends audit events to a file as JSON lines, for another process to collect.
+// It's queried by reading the whole file, so it's best suited to small installations, or to files
+// that are rotated regularly.
+type FileAuditSink struct {
+	Path string
+
+	mutex sync.Mutex
+}
+
+// RecordAuditEvent appends an event to the file.
+func (sink *FileAuditSink) RecordAuditEvent(event AuditEvent) error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	f, err := os.OpenFile(sink.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(f).Encode(event); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// FindAuditEvents reads the events in the file that match a query.
+func (sink *FileAuditSink) FindAuditEvents(query AuditQuery) ([]AuditEvent, error) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	f, err := os.Open(sink.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []AuditEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return queryAuditEvents(events, query), nil
+}
+
+// Ensure that FileAuditSink obeys the AuditSink and AuditReader interfaces.
+var (
+	_ AuditSink   = &FileAuditSink{}
+	_ AuditReader = &FileAuditSink{}
+)
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// RecordingAuditSink remembers every audit event that it's asked to record.
+type RecordingAuditSink struct {
+	Events []AuditEvent
+}
+
+func (sink *RecordingAuditSink) RecordAuditEvent(event AuditEvent) error {
+	sink.Events = append(sink.Events, event)
+	return nil
+}
+
+func TestAuditFillsInRequestDetails(t *testing.T) {
+	sink := &RecordingAuditSink{}
+	c := &Context{AuditSink: sink}
+
+	r := HTTPRequest(t, "DELETE", "https://localhost/v1/accounts", "")
+	r.RemoteAddr = "10.0.0.5:4321"
+	Audit(c, r, AuditEvent{Event: "account.deleted", Account: "someone", Actor: "someone"})
+
+	if len(sink.Events) != 1 {
+		t.Fatalf("Expected 1 audit event, but found %d", len(sink.Events))
+	}
+	event := sink.Events[0]
+	if event.Outcome != AuditSuccess {
+		t.Errorf("Expected the outcome to default to %s, but was [%s]", AuditSuccess, event.Outcome)
+	}
+	if event.Time == 0 {
+		t.Error("Expected the event to be timestamped")
+	}
+	if event.Address != "10.0.0.5" {
+		t.Errorf("Unexpected address: [%s]", event.Address)
+	}
+	if event.CertificateSubject != "" {
+		t.Errorf("Expected no certificate subject without a client certificate, but found [%s]",
+			event.CertificateSubject)
+	}
+}
+
+func TestFileAuditSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth-store-audit")
+	if err != nil {
+		t.Fatalf("Unable to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink := &FileAuditSink{Path: filepath.Join(dir, "audit.jsonl")}
+
+	events, err := sink.FindAuditEvents(AuditQuery{})
+	if err != nil || len(events) != 0 {
+		t.Fatalf("Expected no events before any are recorded, but found %+v (%v)", events, err)
+	}
+
+	recorded := []AuditEvent{
+		{Event: "key.generated", Account: "someone", Actor: "someone", Outcome: AuditSuccess, Time: 200,
+			Details: map[string]string{"key id": "abc123"}},
+		{Event: "account.created", Account: "someone", Actor: "someone", Outcome: AuditSuccess, Time: 100},
+		{Event: "account.created", Account: "other", Actor: "root", Outcome: AuditSuccess, Time: 150},
+	}
+	for _, event := range recorded {
+		if err := sink.RecordAuditEvent(event); err != nil {
+			t.Fatalf("Unexpected error recording an audit event: %v", err)
+		}
+	}
+
+	events, err = sink.FindAuditEvents(AuditQuery{Account: "someone"})
+	if err != nil {
+		t.Fatalf("Unexpected error querying audit events: %v", err)
+	}
+	expected := []AuditEvent{recorded[1], recorded[0]}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Expected events %+v, but found %+v", expected, events)
+	}
+
+	info, err := os.Stat(sink.Path)
+	if err != nil {
+		t.Fatalf("Unable to stat the audit file: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the audit file to be private, but its mode was %v", info.Mode())
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// SetupTokenLength determines how large generated setup tokens are.
+const SetupTokenLength = 32
+
+// ErrSetupTokenInvalid indicates that a setup token is unknown or has already been used.
+var ErrSetupTokenInvalid = errors.New("Setup token is invalid or has already been used")
+
+// SetupToken is a one-time token that may be used to create the first administrator of a fresh
+// install. It's only ever held in process memory, so it stops working when the process exits.
+type SetupToken struct {
+	mutex  sync.Mutex
+	digest string
+}
+
+// NewSetupToken securely generates a random setup token. It returns the plaintext token, which
+// should be shown to the operator, and the SetupToken that accepts it.
+func NewSetupToken() (string, *SetupToken, error) {
+	b := make([]byte, SetupTokenLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	token := hex.EncodeToString(b)
+
+	return token, &SetupToken{digest: digestSecret(token)}, nil
+}
+
+// Redeem invokes use if token is correct, and invalidates the token once use succeeds. It returns
+// ErrSetupTokenInvalid if the token is incorrect or has already been redeemed, or any error that
+// use returns.
+func (setup *SetupToken) Redeem(token string, use func() error) error {
+	setup.mutex.Lock()
+	defer setup.mutex.Unlock()
+
+	digest := digestSecret(token)
+	if setup.digest == "" || subtle.ConstantTimeCompare([]byte(digest), []byte(setup.digest)) != 1 {
+		return ErrSetupTokenInvalid
+	}
+
+	if err := use(); err != nil {
+		return err
+	}
+	setup.digest = ""
+	return nil
+}
+
+// BootstrapAdministrator ensures that a fresh install can be administered. If no enabled
+// administrator exists, the account named by the BootstrapAdmin setting is made one, or, if there's
+// no such setting, a one-time setup token is issued to the log.
+func BootstrapAdministrator(c *Context) error {
+	found, err := c.Storage.HasAdministrator()
+	if err != nil {
+		return err
+	}
+	if found {
+		return nil
+	}
+
+	if c.BootstrapAdmin != "" {
+		return bootstrapFromSettings(c)
+	}
+
+	token, setup, err := NewSetupToken()
+	if err != nil {
+		return err
+	}
+	c.Setup = setup
+
+	log.WithFields(log.Fields{
+		"setup token": RevealedSecret(token),
+	}).Warn("No administrator exists. Use this one-time token with /v1/admin/setup to create one.")
+	return nil
+}
+
+// bootstrapFromSettings creates the administrator named by the BootstrapAdmin setting. If the
+// account already exists, it's only made an administrator if its password matches.
+func bootstrapFromSettings(c *Context) error {
+	name := c.BootstrapAdmin
+
+	data, err := ioutil.ReadFile(c.BootstrapPasswordFile)
+	if err != nil {
+		return fmt.Errorf("Unable to read bootstrap password: %v", err)
+	}
+	password := strings.TrimRight(string(data), "\r\n")
+	if password == "" {
+		return fmt.Errorf("Bootstrap password file %s is empty", c.BootstrapPasswordFile)
+	}
+
+	account, err := c.Storage.FindAccount(name)
+	if err == ErrAccountNotFound {
+		if account, err = NewAccount(c.Hasher, name, password); err != nil {
+			return err
+		}
+		account.Administrator = true
+
+		if err := c.Storage.CreateAccount(account); err != nil {
+			return err
+		}
+		Audit(c, nil, AuditEvent{
+			Event:   "account.created",
+			Account: name,
+			Actor:   "bootstrap",
+			Details: AuditDetails(log.Fields{"admin": true}),
+		})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !account.HasPassword(password) {
+		return fmt.Errorf("Bootstrap account %s already exists with a different password", name)
+	}
+	if account.Disabled {
+		return fmt.Errorf("Bootstrap account %s is disabled", name)
+	}
+
+	if err := c.Storage.SetAdministrator(name, true); err != nil {
+		return err
+	}
+	Audit(c, nil, AuditEvent{Event: "account.admin.granted", Account: name, Actor: "bootstrap"})
+	return nil
+}
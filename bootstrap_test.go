@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// bootstrapPasswordFile writes a password to a temporary file, and returns its path.
+func bootstrapPasswordFile(t *testing.T, password string) string {
+	f, err := ioutil.TempFile("", "bootstrap-password")
+	if err != nil {
+		t.Fatalf("Unable to create password file: %v", err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(password); err != nil {
+		t.Fatalf("Unable to write password file: %v", err)
+	}
+	return f.Name()
+}
+
+func TestBootstrapFromSettings(t *testing.T) {
+	path := bootstrapPasswordFile(t, "hunter2\n")
+	defer os.Remove(path)
+
+	s := NewMemoryStorage()
+	c := &Context{Storage: s, Hasher: testHasher}
+	c.BootstrapAdmin = "root"
+	c.BootstrapPasswordFile = path
+
+	if err := BootstrapAdministrator(c); err != nil {
+		t.Fatalf("Unable to bootstrap an administrator: %v", err)
+	}
+
+	found, err := s.FindAccount("root")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if !found.Administrator || !found.HasPassword("hunter2") {
+		t.Errorf("Unexpected bootstrap account: %+v", found)
+	}
+	if c.Setup != nil {
+		t.Error("Expected no setup token to be issued")
+	}
+}
+
+func TestBootstrapExistingAccount(t *testing.T) {
+	path := bootstrapPasswordFile(t, "hunter2")
+	defer os.Remove(path)
+
+	s := adminTestStorage(t, "root")
+	c := &Context{Storage: s, Hasher: testHasher}
+	c.BootstrapAdmin = "root"
+	c.BootstrapPasswordFile = path
+
+	if err := BootstrapAdministrator(c); err == nil {
+		t.Error("Expected an existing account with a different password not to be bootstrapped")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("secret"), 0600); err != nil {
+		t.Fatalf("Unable to write password file: %v", err)
+	}
+	if err := BootstrapAdministrator(c); err != nil {
+		t.Fatalf("Unable to bootstrap an administrator: %v", err)
+	}
+
+	found, err := s.FindAccount("root")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if !found.Administrator {
+		t.Error("Expected the existing account to be made an administrator")
+	}
+}
+
+func TestBootstrapSkippedWithAdministrator(t *testing.T) {
+	s := adminTestStorage(t, "root")
+	if err := s.SetAdministrator("root", true); err != nil {
+		t.Fatalf("Unable to grant administrator status: %v", err)
+	}
+	c := &Context{Storage: s, Hasher: testHasher}
+
+	if err := BootstrapAdministrator(c); err != nil {
+		t.Fatalf("Unexpected error bootstrapping: %v", err)
+	}
+	if c.Setup != nil {
+		t.Error("Expected no setup token to be issued")
+	}
+}
+
+func TestBootstrapSetupToken(t *testing.T) {
+	s := NewMemoryStorage()
+	c := &Context{Storage: s, Hasher: testHasher}
+
+	token, setup, err := NewSetupToken()
+	if err != nil {
+		t.Fatalf("Unable to generate setup token: %v", err)
+	}
+	c.Setup = setup
+
+	setupRequest := func(body string) *httptest.ResponseRecorder {
+		r := HTTPRequest(t, "POST", "https://localhost/v1/admin/setup", body)
+		w := httptest.NewRecorder()
+		AdminSetupHandler(c, w, r)
+		return w
+	}
+
+	if code := setupRequest(`accountName=root&password=secret&token=wrong`).Code; code != http.StatusUnauthorized {
+		t.Errorf("Expected an incorrect token to fail with %d, but was %d", http.StatusUnauthorized, code)
+	}
+
+	w := setupRequest(`accountName=root&password=secret&token=` + token)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusCreated, w.Code)
+	}
+
+	var result AdminSetupResult
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("Unable to decode response: %v", err)
+	}
+	if result.Key.Key == "" {
+		t.Fatal("Expected the response to include the administrator's API key")
+	}
+	if _, err := s.FindKey("root", DigestAPIKey(result.Key.Key)); err != nil {
+		t.Errorf("Expected the returned API key to be stored, but got: %v", err)
+	}
+
+	found, err := s.FindAccount("root")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if !found.Administrator {
+		t.Error("Expected the account to be an administrator")
+	}
+
+	if code := setupRequest(`accountName=other&password=secret&token=` + token).Code; code != http.StatusConflict {
+		t.Errorf("Expected setup to fail once an administrator exists with %d, but was %d", http.StatusConflict, code)
+	}
+
+	if err := setup.Redeem(token, func() error { return nil }); err != ErrSetupTokenInvalid {
+		t.Errorf("Expected the token to be used up, but got: %v", err)
+	}
+}
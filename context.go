@@ -2,16 +2,46 @@ package main
 
 import (
 	"fmt"
+	"net/url"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/kelseyhightower/envconfig"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // Context provides shared state among route handlers.
 type Context struct {
 	Settings
 
-	Storage Storage
+	// ReapInterval and ReapAge are parsed from KeyReapInterval and KeyReapAge.
+	ReapInterval time.Duration
+	ReapAge      time.Duration
+
+	// RotationGrace is parsed from KeyRotationGrace.
+	RotationGrace time.Duration
+
+	// ResetTTL is parsed from ResetTokenTTL.
+	ResetTTL time.Duration
+
+	// Lockout is assembled from the Lockout settings.
+	Lockout LockoutPolicy
+
+	// RateLimits are parsed from the RateLimit settings.
+	RateLimits RateLimits
+
+	// Hasher is assembled from the password hashing settings.
+	Hasher PasswordHasher
+
+	Storage  Storage
+	Notifier Notifier
+
+	// AuditSink is chosen by the AuditBackend setting. It's nil if audit events are only logged.
+	AuditSink AuditSink
+
+	// Setup is the one-time token that may create the first administrator, if there's none.
+	Setup *SetupToken
 }
 
 // Settings contains configuration options loaded from the environment.
@@ -20,12 +50,66 @@ type Settings struct {
 	ExternalPort   int
 	LogLevel       string
 	LogColors      bool
+	StorageBackend string `envconfig:"storage"`
 	MongoURL       string
+	BoltPath       string
+	DatabaseURL    string
 	InternalCACert string
 	InternalCert   string
 	InternalKey    string
 	ExternalCert   string
 	ExternalKey    string
+
+	// KeyReapInterval is how often expired API keys are removed from storage. Zero disables it.
+	KeyReapInterval string
+	// KeyReapAge is how long an API key remains in storage after it expires.
+	KeyReapAge string
+	// KeyRotationGrace is how long a rotated API key keeps working, unless a request asks otherwise.
+	KeyRotationGrace string
+	// ResetTokenTTL is how long a password reset token may be used for.
+	ResetTokenTTL string
+
+	// LockoutThreshold and LockoutAddressThreshold are the number of consecutive password
+	// failures for an account, or from a client address, that lock out further attempts. Zero
+	// means that the default applies, so a negative value disables either one.
+	LockoutThreshold        int
+	LockoutAddressThreshold int
+	// LockoutDelay is how long the first lockout lasts. It doubles with each further failure, up
+	// to LockoutMaxDelay.
+	LockoutDelay    string
+	LockoutMaxDelay string
+	// LockoutResetAfter is how long password failures are remembered for.
+	LockoutResetAfter string
+
+	// PasswordHash chooses how new passwords are hashed: "bcrypt", with BcryptCost, or "argon2id",
+	// with the Argon2 settings. Argon2Memory is in KiB. Existing hashes that differ are replaced
+	// when their owners next log in.
+	PasswordHash  string
+	BcryptCost    int
+	Argon2Time    int
+	Argon2Memory  int
+	Argon2Threads int
+
+	// RateLimitInternal and RateLimitExternal limit the requests that each client may make to each
+	// route of the internal and external APIs, like "10/s". RateLimitRoutes overrides them for
+	// individual routes, like "/v1/accounts=5/m,/v1/validate=200/s".
+	RateLimitInternal string
+	RateLimitExternal string
+	RateLimitRoutes   string
+
+	// NotifierBackend chooses how secrets are delivered to account owners: "log" or "file".
+	NotifierBackend string `envconfig:"notifier"`
+	NotifierPath    string
+
+	// AuditBackend chooses where the audit trail is recorded: "storage", "file", or "log" for the
+	// process log alone.
+	AuditBackend string `envconfig:"audit"`
+	AuditPath    string
+
+	// BootstrapAdmin names an administrator to create on startup, if there's none, with the
+	// password stored in BootstrapPasswordFile.
+	BootstrapAdmin        string `envconfig:"bootstrap_admin"`
+	BootstrapPasswordFile string `envconfig:"bootstrap_password_file"`
 }
 
 // Load reads configuration settings from the environment and validates them.
@@ -46,10 +130,22 @@ func (c *Context) Load() error {
 		c.LogLevel = "info"
 	}
 
+	if c.StorageBackend == "" {
+		if c.DatabaseURL != "" {
+			c.StorageBackend = "sql"
+		} else {
+			c.StorageBackend = "mongo"
+		}
+	}
+
 	if c.MongoURL == "" {
 		c.MongoURL = "mongo"
 	}
 
+	if c.BoltPath == "" {
+		c.BoltPath = "/data/auth-store.db"
+	}
+
 	if c.InternalCACert == "" {
 		c.InternalCACert = "/certificates/ca.pem"
 	}
@@ -70,10 +166,176 @@ func (c *Context) Load() error {
 		c.ExternalKey = "/certificates/external-key.pem"
 	}
 
+	if c.KeyReapInterval == "" {
+		c.KeyReapInterval = "1h"
+	}
+
+	if c.KeyReapAge == "" {
+		c.KeyReapAge = "720h"
+	}
+
+	if c.KeyRotationGrace == "" {
+		c.KeyRotationGrace = "24h"
+	}
+
+	if c.ResetTokenTTL == "" {
+		c.ResetTokenTTL = "1h"
+	}
+
+	if c.LockoutThreshold == 0 {
+		c.LockoutThreshold = 5
+	}
+
+	if c.LockoutAddressThreshold == 0 {
+		c.LockoutAddressThreshold = 20
+	}
+
+	if c.PasswordHash == "" {
+		c.PasswordHash = PasswordHashBcrypt
+	}
+
+	if c.BcryptCost == 0 {
+		c.BcryptCost = bcrypt.DefaultCost
+	}
+
+	if c.Argon2Time == 0 {
+		c.Argon2Time = DefaultArgon2Time
+	}
+
+	if c.Argon2Memory == 0 {
+		c.Argon2Memory = DefaultArgon2Memory
+	}
+
+	if c.Argon2Threads == 0 {
+		c.Argon2Threads = DefaultArgon2Threads
+	}
+
+	if c.LockoutDelay == "" {
+		c.LockoutDelay = "30s"
+	}
+
+	if c.LockoutMaxDelay == "" {
+		c.LockoutMaxDelay = "15m"
+	}
+
+	if c.LockoutResetAfter == "" {
+		c.LockoutResetAfter = "24h"
+	}
+
+	if c.RateLimitInternal == "" {
+		c.RateLimitInternal = "100/s"
+	}
+
+	if c.RateLimitExternal == "" {
+		c.RateLimitExternal = "10/s"
+	}
+
+	if c.NotifierBackend == "" {
+		c.NotifierBackend = "log"
+	}
+
+	if c.NotifierPath == "" {
+		c.NotifierPath = "/data/notifications.jsonl"
+	}
+
+	if c.AuditBackend == "" {
+		c.AuditBackend = "storage"
+	}
+
+	if c.AuditPath == "" {
+		c.AuditPath = "/data/audit.jsonl"
+	}
+
 	if _, err := log.ParseLevel(c.LogLevel); err != nil {
 		return err
 	}
 
+	var err error
+	if c.ReapInterval, err = time.ParseDuration(c.KeyReapInterval); err != nil {
+		return fmt.Errorf("Invalid key reap interval: %v", err)
+	}
+	if c.ReapAge, err = time.ParseDuration(c.KeyReapAge); err != nil {
+		return fmt.Errorf("Invalid key reap age: %v", err)
+	}
+	if c.RotationGrace, err = time.ParseDuration(c.KeyRotationGrace); err != nil || c.RotationGrace < 0 {
+		return fmt.Errorf("Invalid key rotation grace period: %s", c.KeyRotationGrace)
+	}
+	if c.ResetTTL, err = time.ParseDuration(c.ResetTokenTTL); err != nil || c.ResetTTL <= 0 {
+		return fmt.Errorf("Invalid password reset token TTL: %s", c.ResetTokenTTL)
+	}
+
+	c.Lockout.AccountThreshold = c.LockoutThreshold
+	c.Lockout.AddressThreshold = c.LockoutAddressThreshold
+	if c.Lockout.BaseDelay, err = time.ParseDuration(c.LockoutDelay); err != nil || c.Lockout.BaseDelay <= 0 {
+		return fmt.Errorf("Invalid lockout delay: %s", c.LockoutDelay)
+	}
+	if c.Lockout.MaxDelay, err = time.ParseDuration(c.LockoutMaxDelay); err != nil || c.Lockout.MaxDelay < c.Lockout.BaseDelay {
+		return fmt.Errorf("Invalid maximum lockout delay: %s", c.LockoutMaxDelay)
+	}
+	if c.Lockout.ResetAfter, err = time.ParseDuration(c.LockoutResetAfter); err != nil || c.Lockout.ResetAfter <= 0 {
+		return fmt.Errorf("Invalid lockout reset period: %s", c.LockoutResetAfter)
+	}
+
+	if c.RateLimits.Internal, err = ParseRateLimit(c.RateLimitInternal); err != nil {
+		return err
+	}
+	if c.RateLimits.External, err = ParseRateLimit(c.RateLimitExternal); err != nil {
+		return err
+	}
+	if c.RateLimits.Routes, err = ParseRouteRateLimits(c.RateLimitRoutes); err != nil {
+		return err
+	}
+
+	switch c.PasswordHash {
+	case PasswordHashBcrypt:
+		if c.BcryptCost < bcrypt.MinCost || c.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("Invalid bcrypt cost: %d", c.BcryptCost)
+		}
+		c.Hasher = BcryptHasher{Cost: c.BcryptCost}
+	case PasswordHashArgon2id:
+		switch {
+		case c.Argon2Time < 1:
+			return fmt.Errorf("Invalid Argon2 time: %d", c.Argon2Time)
+		case c.Argon2Threads < 1 || c.Argon2Threads > 255:
+			return fmt.Errorf("Invalid Argon2 threads: %d", c.Argon2Threads)
+		case c.Argon2Memory < 8*c.Argon2Threads:
+			return fmt.Errorf("Invalid Argon2 memory: %d", c.Argon2Memory)
+		}
+		c.Hasher = Argon2idHasher{
+			Time:    uint32(c.Argon2Time),
+			Memory:  uint32(c.Argon2Memory),
+			Threads: uint8(c.Argon2Threads),
+		}
+	default:
+		return fmt.Errorf("Unrecognized password hash: %s", c.PasswordHash)
+	}
+
+	if c.BootstrapAdmin != "" && c.BootstrapPasswordFile == "" {
+		return fmt.Errorf("A bootstrap password file is required to bootstrap %s", c.BootstrapAdmin)
+	}
+
+	switch c.NotifierBackend {
+	case "log", "file":
+	default:
+		return fmt.Errorf("Unrecognized notifier: %s", c.NotifierBackend)
+	}
+
+	switch c.AuditBackend {
+	case "storage", "file", "log":
+	default:
+		return fmt.Errorf("Unrecognized audit backend: %s", c.AuditBackend)
+	}
+
+	switch c.StorageBackend {
+	case "mongo", "memory", "bolt":
+	case "sql":
+		if _, _, err := parseDatabaseURL(c.DatabaseURL); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Unrecognized storage backend: %s", c.StorageBackend)
+	}
+
 	return nil
 }
 
@@ -85,7 +347,7 @@ func NewContext() (*Context, error) {
 		return c, err
 	}
 
-	// Configure the logging level and formatter.
+	// Configure the logging level and formatter. Secrets are redacted from every log entry.
 
 	level, err := log.ParseLevel(c.LogLevel)
 	if err != nil {
@@ -93,29 +355,114 @@ func NewContext() (*Context, error) {
 	}
 	log.SetLevel(level)
 
-	log.SetFormatter(&log.TextFormatter{
-		ForceColors: c.LogColors,
+	log.SetFormatter(&RedactingFormatter{
+		Formatter: &log.TextFormatter{
+			ForceColors: c.LogColors,
+		},
 	})
 
 	// Summarize the loaded settings.
 
 	log.WithFields(log.Fields{
-		"internal port":    c.InternalPort,
-		"external port":    c.ExternalPort,
-		"logging level":    c.LogLevel,
-		"log with color":   c.LogColors,
-		"mongo URL":        c.MongoURL,
-		"internal CA cert": c.InternalCACert,
-		"internal cert":    c.InternalCert,
-		"internal key":     c.InternalKey,
-		"external cert":    c.ExternalCert,
-		"external key":     c.ExternalKey,
+		"internal port":      c.InternalPort,
+		"external port":      c.ExternalPort,
+		"logging level":      c.LogLevel,
+		"log with color":     c.LogColors,
+		"storage backend":    c.StorageBackend,
+		"mongo URL":          redactURL(c.MongoURL),
+		"bolt path":          c.BoltPath,
+		"database URL":       redactURL(c.DatabaseURL),
+		"internal CA cert":   c.InternalCACert,
+		"internal cert":      c.InternalCert,
+		"internal key":       c.InternalKey,
+		"external cert":      c.ExternalCert,
+		"external key":       c.ExternalKey,
+		"key reap interval":  c.KeyReapInterval,
+		"key reap age":       c.KeyReapAge,
+		"key rotation grace": c.KeyRotationGrace,
+		"reset token TTL":    c.ResetTokenTTL,
+		"lockout threshold":  c.LockoutThreshold,
+		"address threshold":  c.LockoutAddressThreshold,
+		"lockout delay":      c.LockoutDelay,
+		"max lockout delay":  c.LockoutMaxDelay,
+		"lockout reset":      c.LockoutResetAfter,
+		"internal limit":     c.RateLimitInternal,
+		"external limit":     c.RateLimitExternal,
+		"route limits":       c.RateLimitRoutes,
+		"password hash":      c.PasswordHash,
+		"bcrypt cost":        c.BcryptCost,
+		"argon2 time":        c.Argon2Time,
+		"argon2 memory":      c.Argon2Memory,
+		"argon2 threads":     c.Argon2Threads,
+		"notifier":           c.NotifierBackend,
+		"notifier path":      c.NotifierPath,
+		"audit backend":      c.AuditBackend,
+		"audit path":         c.AuditPath,
+		"bootstrap admin":    c.BootstrapAdmin,
+		"bootstrap password": c.BootstrapPasswordFile,
 	}).Info("Initializing with loaded settings.")
 
-	// Connect to MongoDB
+	// Connect to the configured storage backend.
 
-	c.Storage, err = NewMongoStorage(c)
-	if err != nil {
+	switch c.StorageBackend {
+	case "memory":
+		log.Warn("Using in-memory storage. All accounts will be lost when the process exits.")
+		c.Storage = NewMemoryStorage()
+	case "bolt":
+		c.Storage, err = NewBoltStorage(c)
+		if err != nil {
+			return c, err
+		}
+	case "sql":
+		c.Storage, err = NewSQLStorage(c)
+		if err != nil {
+			return c, err
+		}
+	default:
+		c.Storage, err = NewMongoStorage(c)
+		if err != nil {
+			return c, err
+		}
+	}
+
+	// Choose how to deliver secrets to account owners.
+
+	switch c.NotifierBackend {
+	case "file":
+		c.Notifier = &FileNotifier{Path: c.NotifierPath}
+	default:
+		log.Warn("Delivering password reset tokens to the log. Use AUTH_NOTIFIER=file in production.")
+		c.Notifier = LogNotifier{}
+	}
+
+	// Choose where to record the audit trail.
+
+	switch c.AuditBackend {
+	case "file":
+		c.AuditSink = &FileAuditSink{Path: c.AuditPath}
+	case "log":
+		log.Warn("Recording audit events to the log only. They can't be queried.")
+	default:
+		c.AuditSink = c.Storage
+	}
+
+	// Convert any API keys that were stored by an earlier version.
+
+	if migrator, ok := c.Storage.(KeyMigrator); ok {
+		n, err := migrator.MigrateKeys()
+		if err != nil {
+			return c, err
+		}
+		if n > 0 {
+			log.WithFields(log.Fields{
+				"accounts": n,
+			}).Info("Converted API keys from an earlier storage format.")
+		}
+	}
+
+	// Make sure that a fresh install can be administered.
+
+	if err := BootstrapAdministrator(c); err != nil {
 		return c, err
 	}
 
@@ -131,3 +478,24 @@ func (c *Context) InternalListenAddr() string {
 func (c *Context) ExternalListenAddr() string {
 	return fmt.Sprintf(":%d", c.ExternalPort)
 }
+
+// redactURL masks any password embedded in a URL, so that it can be safely logged. URLs without a
+// scheme, which mgo also accepts, are handled too.
+func redactURL(raw string) string {
+	if !strings.Contains(raw, "://") {
+		return strings.TrimPrefix(redactURL("mongodb://"+raw), "mongodb://")
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil && strings.Contains(raw, "@") {
+		return Redacted
+	}
+	if err != nil || u.User == nil {
+		return raw
+	}
+
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
@@ -5,8 +5,13 @@ import (
 	"net/http"
 	"strings"
 	"testing"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
+// testHasher uses the cheapest bcrypt cost, so that tests run quickly.
+var testHasher = BcryptHasher{Cost: bcrypt.MinCost}
+
 func HTTPRequest(t *testing.T, method, url, body string) *http.Request {
 	var bodyReader io.Reader
 	if body != "" {
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Counters of lockout events, published with expvar.
+var (
+	lockoutsStarted  = expvar.NewInt("lockouts_started")
+	lockoutsRejected = expvar.NewInt("lockouts_rejected")
+)
+
+// LoginFailures counts the consecutive failed password attempts made for an account, or from a
+// client address. Each is identified by its Source.
+type LoginFailures struct {
+	Source        string `bson:"_id"`
+	Count         int    `bson:"count"`
+	LastFailureAt int64  `bson:"last_failure_at"`
+}
+
+// LockoutPolicy determines how long repeated password failures lock out further attempts.
+type LockoutPolicy struct {
+	// AccountThreshold and AddressThreshold are the number of consecutive failures for a single
+	// account, or from a single client address, that cause a lockout. Zero or a negative value
+	// disables either one.
+	AccountThreshold int
+	AddressThreshold int
+
+	// BaseDelay is how long the first lockout lasts. Each further failure doubles it, up to
+	// MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// ResetAfter is how long failures are remembered for.
+	ResetAfter time.Duration
+}
+
+// lockoutSource identifies failures that are counted together, and the threshold that applies to
+// them.
+type lockoutSource struct {
+	Key       string
+	Threshold int
+}
+
+// sources returns the sources that a password attempt for an account, from an address, counts
+// against.
+func (policy LockoutPolicy) sources(accountName, address string) []lockoutSource {
+	return []lockoutSource{
+		{Key: "account:" + accountName, Threshold: policy.AccountThreshold},
+		{Key: "address:" + address, Threshold: policy.AddressThreshold},
+	}
+}
+
+// LockedUntil returns the time until which failures lock out further attempts, or zero if they
+// don't.
+func (policy LockoutPolicy) LockedUntil(failures LoginFailures, threshold int) int64 {
+	if threshold <= 0 || failures.Count < threshold {
+		return 0
+	}
+
+	delay := policy.MaxDelay
+	if doublings := uint(failures.Count - threshold); doublings < 32 {
+		if d := policy.BaseDelay << doublings; d > 0 && d < delay {
+			delay = d
+		}
+	}
+	return failures.LastFailureAt + int64(delay)
+}
+
+// CheckLockout returns the time until which password attempts for an account, from an address, are
+// locked out. It returns the zero time if an attempt may be made now.
+func CheckLockout(c *Context, accountName, address string, now time.Time) (time.Time, error) {
+	var until int64
+	for _, source := range c.Lockout.sources(accountName, address) {
+		if source.Threshold <= 0 {
+			continue
+		}
+
+		failures, err := c.Storage.FindLoginFailures(source.Key)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if failures.LastFailureAt < now.Add(-c.Lockout.ResetAfter).UnixNano() {
+			continue
+		}
+		if t := c.Lockout.LockedUntil(failures, source.Threshold); t > until {
+			until = t
+		}
+	}
+
+	if until <= now.UnixNano() {
+		return time.Time{}, nil
+	}
+	return time.Unix(0, until), nil
+}
+
+// RecordPasswordFailure counts a failed password attempt for an account, from an address. Any
+// lockout that it causes is logged and counted.
+func RecordPasswordFailure(c *Context, accountName, address string, now time.Time) error {
+	for _, source := range c.Lockout.sources(accountName, address) {
+		if source.Threshold <= 0 {
+			continue
+		}
+
+		failures, err := c.Storage.RecordLoginFailure(
+			source.Key, now.UnixNano(), now.Add(-c.Lockout.ResetAfter).UnixNano())
+		if err != nil {
+			return err
+		}
+
+		if until := c.Lockout.LockedUntil(failures, source.Threshold); until > now.UnixNano() {
+			lockoutsStarted.Add(1)
+			log.WithFields(log.Fields{
+				"account":      accountName,
+				"address":      address,
+				"source":       source.Key,
+				"failures":     failures.Count,
+				"locked until": time.Unix(0, until),
+			}).Warn("Locking out repeated password failures.")
+			Audit(c, nil, AuditEvent{
+				Event:   "account.locked_out",
+				Account: accountName,
+				Actor:   accountName,
+				Address: address,
+				Outcome: AuditFailure,
+				Details: AuditDetails(log.Fields{"source": source.Key, "locked until": time.Unix(0, until)}),
+			})
+		}
+	}
+	return nil
+}
+
+// ClearPasswordFailures forgets the failed password attempts for an account, once its password has
+// been verified. Failures from the client's address are kept, so that an attacker can't reset them
+// by logging in to an account of their own.
+func ClearPasswordFailures(c *Context, accountName string) error {
+	if c.Lockout.AccountThreshold <= 0 {
+		return nil
+	}
+	return c.Storage.ClearLoginFailures("account:" + accountName)
+}
+
+// RejectLockedOut reports that a password attempt has been locked out, and when it may be retried.
+func RejectLockedOut(w http.ResponseWriter, accountName string, retryAfter time.Duration) {
+	lockoutsRejected.Add(1)
+	setRetryAfter(w, retryAfter)
+
+	APIError{
+		UserMessage: "Too many failed attempts. Please try again later.",
+		LogMessage:  "Rejected a locked out password attempt.",
+	}.Log(accountName).Report(w, 429)
+}
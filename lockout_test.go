@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testLockoutPolicy() LockoutPolicy {
+	return LockoutPolicy{
+		AccountThreshold: 3,
+		AddressThreshold: 10,
+		BaseDelay:        30 * time.Second,
+		MaxDelay:         5 * time.Minute,
+		ResetAfter:       24 * time.Hour,
+	}
+}
+
+func TestLockedUntil(t *testing.T) {
+	policy := testLockoutPolicy()
+
+	expectations := []struct {
+		Count int
+		Delay time.Duration
+	}{
+		{Count: 0, Delay: 0},
+		{Count: 2, Delay: 0},
+		{Count: 3, Delay: 30 * time.Second},
+		{Count: 4, Delay: time.Minute},
+		{Count: 6, Delay: 4 * time.Minute},
+		{Count: 7, Delay: 5 * time.Minute},
+		{Count: 100, Delay: 5 * time.Minute},
+	}
+
+	for _, e := range expectations {
+		failures := LoginFailures{Count: e.Count, LastFailureAt: 1000}
+		until := policy.LockedUntil(failures, policy.AccountThreshold)
+
+		expected := int64(0)
+		if e.Delay > 0 {
+			expected = 1000 + int64(e.Delay)
+		}
+		if until != expected {
+			t.Errorf("Expected %d failures to lock out until %d, but was %d", e.Count, expected, until)
+		}
+	}
+
+	if until := policy.LockedUntil(LoginFailures{Count: 100}, 0); until != 0 {
+		t.Errorf("Expected a zero threshold to disable lockout, but was locked until %d", until)
+	}
+}
+
+func TestLockoutAfterRepeatedFailures(t *testing.T) {
+	s := NewMemoryStorage()
+	a, err := NewAccount(testHasher, "someone", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+	if err := s.CreateAccount(a); err != nil {
+		t.Fatalf("Unable to store account: %v", err)
+	}
+	c := &Context{Storage: s, Lockout: testLockoutPolicy(), Hasher: testHasher}
+
+	attempt := func(password string) *httptest.ResponseRecorder {
+		r := HTTPRequest(t, "POST", "https://localhost/v1/accounts/password",
+			"accountName=someone&password="+password+"&newPassword=changed")
+		r.RemoteAddr = "10.0.0.1:4567"
+		w := httptest.NewRecorder()
+		PasswordChangeHandler(c, w, r)
+		return w
+	}
+
+	for i := 0; i < 3; i++ {
+		if w := attempt("wrong"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected attempt %d to be unauthorized, but was %d", i+1, w.Code)
+		}
+	}
+
+	// The correct password is refused while the account is locked out.
+	w := attempt("secret")
+	if w.Code != 429 {
+		t.Fatalf("Expected response code 429, but was %d", w.Code)
+	}
+	if retry := w.Header().Get("Retry-After"); retry != "30" {
+		t.Errorf("Expected Retry-After of 30 seconds, but was [%s]", retry)
+	}
+
+	failures, err := s.FindLoginFailures("address:10.0.0.1")
+	if err != nil {
+		t.Fatalf("Unable to find login failures: %v", err)
+	}
+	if failures.Count != 3 {
+		t.Errorf("Expected 3 failures from the client address, but found %d", failures.Count)
+	}
+}
+
+func TestLockoutClearedBySuccess(t *testing.T) {
+	s := NewMemoryStorage()
+	a, err := NewAccount(testHasher, "someone", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+	if err := s.CreateAccount(a); err != nil {
+		t.Fatalf("Unable to store account: %v", err)
+	}
+	c := &Context{Storage: s, Lockout: testLockoutPolicy(), Hasher: testHasher}
+
+	now := time.Now()
+	if err := RecordPasswordFailure(c, "someone", "10.0.0.1", now); err != nil {
+		t.Fatalf("Unable to record a failure: %v", err)
+	}
+
+	r := HTTPRequest(t, "POST", "https://localhost/v1/accounts/password",
+		"accountName=someone&password=secret&newPassword=changed")
+	r.RemoteAddr = "10.0.0.1:4567"
+	w := httptest.NewRecorder()
+	PasswordChangeHandler(c, w, r)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusNoContent, w.Code)
+	}
+
+	failures, err := s.FindLoginFailures("account:someone")
+	if err != nil {
+		t.Fatalf("Unable to find login failures: %v", err)
+	}
+	if failures.Count != 0 {
+		t.Errorf("Expected account failures to be cleared, but found %d", failures.Count)
+	}
+
+	failures, err = s.FindLoginFailures("address:10.0.0.1")
+	if err != nil {
+		t.Fatalf("Unable to find login failures: %v", err)
+	}
+	if failures.Count != 1 {
+		t.Errorf("Expected address failures to be kept, but found %d", failures.Count)
+	}
+}
+
+func TestLockoutExpires(t *testing.T) {
+	c := &Context{Storage: NewMemoryStorage(), Lockout: testLockoutPolicy(), Hasher: testHasher}
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := RecordPasswordFailure(c, "someone", "10.0.0.1", now); err != nil {
+			t.Fatalf("Unable to record a failure: %v", err)
+		}
+	}
+
+	until, err := CheckLockout(c, "someone", "10.0.0.2", now.Add(time.Second))
+	if err != nil {
+		t.Fatalf("Unable to check lockout: %v", err)
+	}
+	if !until.Equal(now.Add(30 * time.Second)) {
+		t.Errorf("Expected a lockout until %v, but was %v", now.Add(30*time.Second), until)
+	}
+
+	until, err = CheckLockout(c, "someone", "10.0.0.2", now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Unable to check lockout: %v", err)
+	}
+	if !until.IsZero() {
+		t.Errorf("Expected the lockout to have expired, but was locked until %v", until)
+	}
+}
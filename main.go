@@ -4,9 +4,13 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 )
@@ -20,6 +24,7 @@ func main() {
 		return
 	}
 
+	go ReapExpiredKeys(c)
 	go ServeInternal(c)
 	ServeExternal(c)
 }
@@ -33,8 +38,32 @@ func ServeInternal(c *Context) {
 		w.Write([]byte("auth-store internal API alive and running.\n"))
 	})
 
-	mux.HandleFunc("/v1/style", BindContext(c, StyleHandler))
-	mux.HandleFunc("/v1/validate", BindContext(c, ValidateHandler))
+	// Counters published with expvar, including lockout events.
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	// Internal clients are rate limited by the subject of their client certificate.
+	route := func(path string, handler ContextHandler) {
+		limiter := NewRateLimiter(c.RateLimits.For(path, c.RateLimits.Internal))
+		mux.HandleFunc(path, BindContext(c, RateLimited(limiter, ClientCertificateSubject, handler)))
+	}
+
+	route("/v1/style", StyleHandler)
+	route("/v1/validate", ValidateHandler)
+	route("/v1/admin/setup", AdminSetupHandler)
+
+	// Administrative requests must also authenticate as an administrator.
+	admin := func(path string, handler AdminHandler) {
+		route(path, RequireAdministrator(handler))
+	}
+	admin("/v1/admin/accounts", AdminAccountsHandler)
+	admin("/v1/admin/accounts/details", AdminAccountDetailsHandler)
+	admin("/v1/admin/accounts/admin", AdminSetAdministratorHandler)
+	admin("/v1/admin/accounts/disable", AdminDisableHandler)
+	admin("/v1/admin/accounts/enable", AdminEnableHandler)
+	admin("/v1/admin/keys/revoke", AdminKeyRevocationHandler)
+	admin("/v1/admin/keys/revoke-all", AdminRevokeAllHandler)
+	admin("/v1/admin/password-reset", AdminPasswordResetHandler)
+	admin("/v1/admin/audit", AdminAuditHandler)
 
 	// Load TLS credentials used by the internal API.
 
@@ -81,8 +110,21 @@ func ServeExternal(c *Context) {
 		w.Write([]byte("auth-store external API alive and running.\n"))
 	})
 
-	mux.HandleFunc("/v1/accounts", BindContext(c, AccountHandler))
-	mux.HandleFunc("/v1/keys", BindContext(c, KeyHandler))
+	// External clients are rate limited by IP address.
+	route := func(path string, handler ContextHandler) {
+		limiter := NewRateLimiter(c.RateLimits.For(path, c.RateLimits.External))
+		mux.HandleFunc(path, BindContext(c, RateLimited(limiter, ClientIP, handler)))
+	}
+
+	route("/v1/accounts", AccountHandler)
+	route("/v1/accounts/password", PasswordChangeHandler)
+	route("/v1/accounts/password/reset", PasswordResetHandler)
+	route("/v1/accounts/2fa/enroll", TwoFactorEnrollHandler)
+	route("/v1/accounts/2fa/confirm", TwoFactorConfirmHandler)
+	route("/v1/accounts/2fa/disable", TwoFactorDisableHandler)
+	route("/v1/keys", KeyHandler)
+	route("/v1/keys/rotate", KeyRotationHandler)
+	route("/v1/keys/revoke-all", KeyRevokeAllHandler)
 
 	server := &http.Server{
 		Addr:    c.ExternalListenAddr(),
@@ -152,6 +194,28 @@ func (err APIError) Report(w http.ResponseWriter, status int) APIError {
 	return err
 }
 
+// StorageErrorStatus chooses the HTTP status code used to report an unexpected storage error.
+func StorageErrorStatus(err error) int {
+	if err == ErrUnavailable {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// WantsJSON returns true if the client has asked for a JSON response with its Accept header.
+func WantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// ClientIP returns the IP address that a request was made from.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 // MethodOk tests the HTTP request method. If the method is correct, it does nothing and
 // returns true. If it's incorrect, it generates a JSON error and returns false.
 func MethodOk(w http.ResponseWriter, r *http.Request, method string) bool {
@@ -201,3 +265,95 @@ func extractCredentials(w http.ResponseWriter, r *http.Request, requestName, cre
 	}
 	return accountName, credential, true
 }
+
+// RejectDisabled reports that an account can't be used because it's been disabled.
+func RejectDisabled(w http.ResponseWriter, accountName string) {
+	APIError{
+		UserMessage: "This account has been disabled.",
+		LogMessage:  "Attempt to use a disabled account.",
+	}.Log(accountName).Report(w, http.StatusForbidden)
+}
+
+// AuthenticatePassword verifies an account's password. If the account exists and the password is
+// correct, it returns the account. Otherwise, or if the account is disabled or locked out by
+// repeated failures, it reports an error and returns false.
+func AuthenticatePassword(c *Context, w http.ResponseWriter, r *http.Request, accountName, password string) (*Account, bool) {
+	address, now := ClientIP(r), time.Now()
+
+	until, err := CheckLockout(c, accountName, address, now)
+	if err != nil {
+		APIError{
+			UserMessage: "Internal storage error. Please try again later.",
+			LogMessage:  fmt.Sprintf("Error checking login failures: %v", err),
+		}.Log(accountName).Report(w, StorageErrorStatus(err))
+		return nil, false
+	}
+	if !until.IsZero() {
+		RejectLockedOut(w, accountName, until.Sub(now))
+		return nil, false
+	}
+
+	rejectAuth := func() {
+		if err := RecordPasswordFailure(c, accountName, address, now); err != nil {
+			log.WithFields(log.Fields{
+				"account": accountName,
+				"error":   err,
+			}).Error("Unable to record a failed password attempt.")
+		}
+		Audit(c, r, AuditEvent{
+			Event:   "password.authentication",
+			Account: accountName,
+			Actor:   accountName,
+			Outcome: AuditFailure,
+		})
+
+		APIError{
+			UserMessage: "Incorrect account name or password.",
+			LogMessage:  "Authentication failure for account.",
+		}.Log(accountName).Report(w, http.StatusUnauthorized)
+	}
+
+	account, err := c.Storage.FindAccount(accountName)
+	if err != nil && err != ErrAccountNotFound {
+		APIError{
+			UserMessage: "Internal storage error. Please try again later.",
+			LogMessage:  fmt.Sprintf("Error finding account: %v", err),
+		}.Log(accountName).Report(w, StorageErrorStatus(err))
+		return nil, false
+	}
+	if err == ErrAccountNotFound {
+		// Account does not exist. Treat this exactly like a failed password attempt.
+
+		// Thwart timing attacks by hashing the password, which costs as much as verifying it.
+		c.Hasher.Hash(password)
+
+		rejectAuth()
+		return nil, false
+	}
+
+	if !account.HasPassword(password) {
+		// BZZZZZZZT
+		rejectAuth()
+		return nil, false
+	}
+
+	// Accounts with two-factor authentication keep their failures until RequireSecondFactor
+	// verifies their second factor, so that it can't be guessed without limit.
+	if !account.TwoFactorEnabled() {
+		if err := ClearPasswordFailures(c, accountName); err != nil {
+			log.WithFields(log.Fields{
+				"account": accountName,
+				"error":   err,
+			}).Error("Unable to clear failed password attempts.")
+		}
+	}
+
+	if account.Disabled {
+		RejectDisabled(w, accountName)
+		return nil, false
+	}
+
+	UpgradePasswordHash(c, account, password)
+
+	return account, true
+}
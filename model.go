@@ -2,29 +2,65 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
+	"strings"
 	"time"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 // APIKeyLength determines how large generated API keys are.
 const APIKeyLength = 64
 
+// APIKeyPrefixLength is the number of leading characters of an API key that are stored in the
+// clear, so that a key can be identified without revealing it.
+const APIKeyPrefixLength = 8
+
+// APIKeyIDLength is the length of the identifier assigned to each API key.
+const APIKeyIDLength = 16
+
+// APIKeyLabelLength limits the length of user-supplied API key labels.
+const APIKeyLabelLength = 128
+
+// ResetTokenLength determines how large generated password reset tokens are.
+const ResetTokenLength = 32
+
+// Scopes that may be granted to an API key. auth-store only records and reports them; it's up to
+// the services that validate keys to enforce them.
+const (
+	ScopeJobsSubmit = "jobs:submit"
+	ScopeJobsRead   = "jobs:read"
+	ScopeKeysManage = "keys:manage"
+)
+
+// KnownScopes lists every scope that may be granted to an API key.
+var KnownScopes = []string{ScopeJobsSubmit, ScopeJobsRead, ScopeKeysManage}
+
 // Account is a user account.
 type Account struct {
 	Name           string `json:"name" bson:"_id"`
 	HashedPassword []byte `json:"-" bson:"password"`
 	Administrator  bool   `json:"admin" bson:"admin"`
 
-	APIKeys []string `json:"-" bson:"api_keys"`
+	// Disabled accounts keep their data, but can't authenticate in any way until they're enabled.
+	Disabled       bool   `json:"disabled" bson:"disabled"`
+	DisabledReason string `json:"disabledReason,omitempty" bson:"disabled_reason"`
+	DisabledAt     int64  `json:"disabledAt,omitempty" bson:"disabled_at"`
+
+	APIKeys []APIKey `json:"-" bson:"api_keys"`
+
+	// PasswordReset is the outstanding password reset token for the account, if there is one.
+	PasswordReset *ResetToken `json:"-" bson:"password_reset,omitempty"`
+
+	// TwoFactor is the account's TOTP enrollment, if it has one.
+	TwoFactor *TwoFactor `json:"-" bson:"two_factor,omitempty"`
 
 	CreatedAt int64 `json:"-" bson:"created_at"`
 	UpdatedAt int64 `json:"-" bson:"updated_at"`
 }
 
-// NewAccount initializes a new Account given a username and password.
-func NewAccount(name, password string) (*Account, error) {
+// NewAccount initializes a new Account given a username and password, which is hashed by hasher.
+func NewAccount(hasher PasswordHasher, name, password string) (*Account, error) {
 	now := time.Now().UnixNano()
 	account := &Account{
 		Name:      name,
@@ -32,34 +68,226 @@ func NewAccount(name, password string) (*Account, error) {
 		UpdatedAt: now,
 	}
 
-	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
+	if err := account.SetPassword(hasher, password, now); err != nil {
 		return nil, err
 	}
-	account.HashedPassword = hashed
 
-	if _, err = account.GenerateAPIKey(); err != nil {
+	if _, err := account.GenerateAPIKey(); err != nil {
 		return account, err
 	}
 
 	return account, nil
 }
 
-// HasPassword returns true if the supplied password is correct for the existing account.
+// SetDisabled disables or enables the account. The reason and time are recorded while it's
+// disabled, and cleared when it's enabled.
+func (account *Account) SetDisabled(disabled bool, reason string, at int64) {
+	account.Disabled = disabled
+	account.DisabledReason = ""
+	account.DisabledAt = 0
+	if disabled {
+		account.DisabledReason = reason
+		account.DisabledAt = at
+	}
+}
+
+// TwoFactorEnabled returns true if the account must provide a second factor along with its
+// password.
+func (account *Account) TwoFactorEnabled() bool {
+	return account.TwoFactor != nil && account.TwoFactor.Confirmed
+}
+
+// HasPassword returns true if the supplied password is correct for the existing account, whichever
+// algorithm its password was hashed with.
 func (account *Account) HasPassword(password string) bool {
-	return bcrypt.CompareHashAndPassword(account.HashedPassword, []byte(password)) == nil
+	return CheckPassword(account.HashedPassword, password)
 }
 
-// GenerateAPIKey securely creates an API key and attaches it to the associated account.
+// SetPassword replaces the account's password, and records the time at which it changed.
+func (account *Account) SetPassword(hasher PasswordHasher, password string, now int64) error {
+	hashed, err := hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	account.HashedPassword = hashed
+	account.UpdatedAt = now
+	return nil
+}
+
+// GenerateAPIKey securely creates an API key and attaches it to the associated account. The
+// plaintext key is returned; only its digest is kept on the account.
 func (account *Account) GenerateAPIKey() (string, error) {
-	b := make([]byte, APIKeyLength)
-	_, err := rand.Read(b)
+	key, record, err := NewAPIKey()
 	if err != nil {
 		return "", err
 	}
-	key := hex.EncodeToString(b)
 
-	account.APIKeys = append(account.APIKeys, key)
+	account.APIKeys = append(account.APIKeys, record)
 
 	return key, nil
 }
+
+// Key returns the account's API key with the provided digest, or nil if it has none.
+func (account *Account) Key(digest string) *APIKey {
+	for i := range account.APIKeys {
+		if account.APIKeys[i].Digest == digest {
+			return &account.APIKeys[i]
+		}
+	}
+	return nil
+}
+
+// APIKey is the stored form of an API key. The key itself is never persisted: only its SHA-256
+// digest, which is used to look it up, and a short prefix that identifies it to its owner. Every
+// other field is safe to show to the account's owner.
+type APIKey struct {
+	ID     string `json:"id" bson:"id"`
+	Label  string `json:"label,omitempty" bson:"label"`
+	Prefix string `json:"prefix" bson:"prefix"`
+	Digest string `json:"-" bson:"digest"`
+
+	CreatedAt   int64  `json:"createdAt" bson:"created_at"`
+	CreatedFrom string `json:"createdFrom,omitempty" bson:"created_from"`
+	LastUsedAt  int64  `json:"lastUsedAt,omitempty" bson:"last_used_at"`
+
+	// ExpiresAt is the time after which the key is no longer valid, or zero if it never expires.
+	ExpiresAt int64 `json:"expiresAt,omitempty" bson:"expires_at"`
+
+	// Lifetime is how long the key was issued to last, in nanoseconds, or zero if it never expires
+	// or was issued before lifetimes were recorded. Unlike ExpiresAt, rotation doesn't shorten it.
+	Lifetime int64 `json:"-" bson:"lifetime"`
+
+	// Rotated is true once the key has been replaced by rotation, and is only valid for the rest
+	// of its grace period. It can't be rotated again.
+	Rotated bool `json:"rotated,omitempty" bson:"rotated"`
+
+	// Scopes are the permissions granted to the key. Keys created before scopes existed have none
+	// recorded, and are granted every scope.
+	Scopes []string `json:"scopes,omitempty" bson:"scopes,omitempty"`
+}
+
+// GrantedScopes returns the scopes that the key grants.
+func (key APIKey) GrantedScopes() []string {
+	if len(key.Scopes) == 0 {
+		return KnownScopes
+	}
+	return key.Scopes
+}
+
+// HasScope returns true if the key grants a scope.
+func (key APIKey) HasScope(scope string) bool {
+	for _, granted := range key.GrantedScopes() {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseScopes reads a comma-separated list of scopes. It returns every known scope if the list is
+// empty, or an error if it names a scope that isn't known. Scopes are returned in the order that
+// they appear in KnownScopes, without duplicates.
+func ParseScopes(raw string) ([]string, error) {
+	requested := make(map[string]bool)
+	for _, scope := range strings.Split(raw, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			requested[scope] = true
+		}
+	}
+	if len(requested) == 0 {
+		return append([]string(nil), KnownScopes...), nil
+	}
+
+	var scopes []string
+	for _, scope := range KnownScopes {
+		if requested[scope] {
+			scopes = append(scopes, scope)
+			delete(requested, scope)
+		}
+	}
+	for scope := range requested {
+		return nil, fmt.Errorf("Unrecognized scope [%s]. Known scopes are: %s.",
+			scope, strings.Join(KnownScopes, ", "))
+	}
+	return scopes, nil
+}
+
+// Expired returns true if the key has an expiration time that has passed as of now.
+func (key APIKey) Expired(now int64) bool {
+	return key.ExpiresAt != 0 && key.ExpiresAt <= now
+}
+
+// NewAPIKey securely generates a random API key. It returns the plaintext key, which should be
+// shown to its owner exactly once, and the APIKey record that's safe to store.
+func NewAPIKey() (string, APIKey, error) {
+	b := make([]byte, APIKeyLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", APIKey{}, err
+	}
+	key := hex.EncodeToString(b)
+
+	record := apiKeyRecord(key)
+	record.CreatedAt = time.Now().UnixNano()
+	record.Scopes = append([]string(nil), KnownScopes...)
+
+	return key, record, nil
+}
+
+// DigestAPIKey computes the digest that an API key is stored and looked up under.
+func DigestAPIKey(key string) string {
+	return digestSecret(key)
+}
+
+// ResetToken is the stored form of a password reset token. Like an API key, the token itself is
+// never persisted. Tokens may be used at most once, and only until they expire.
+type ResetToken struct {
+	Digest    string `bson:"digest"`
+	ExpiresAt int64  `bson:"expires_at"`
+}
+
+// NewResetToken securely generates a random password reset token that expires after ttl. It
+// returns the plaintext token, which should be delivered to the account's owner, and the
+// ResetToken record that's safe to store.
+func NewResetToken(now time.Time, ttl time.Duration) (string, ResetToken, error) {
+	b := make([]byte, ResetTokenLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", ResetToken{}, err
+	}
+	token := hex.EncodeToString(b)
+
+	return token, ResetToken{
+		Digest:    DigestResetToken(token),
+		ExpiresAt: now.Add(ttl).UnixNano(),
+	}, nil
+}
+
+// DigestResetToken computes the digest that a password reset token is stored under.
+func DigestResetToken(token string) string {
+	return digestSecret(token)
+}
+
+// digestSecret computes the hex-encoded SHA-256 digest of a secret.
+func digestSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKeyID derives the stable, non-secret identifier of an API key from its digest.
+func APIKeyID(digest string) string {
+	if len(digest) > APIKeyIDLength {
+		return digest[:APIKeyIDLength]
+	}
+	return digest
+}
+
+// apiKeyRecord derives the stored form of a plaintext API key.
+func apiKeyRecord(key string) APIKey {
+	prefix := key
+	if len(prefix) > APIKeyPrefixLength {
+		prefix = prefix[:APIKeyPrefixLength]
+	}
+
+	digest := DigestAPIKey(key)
+	return APIKey{ID: APIKeyID(digest), Prefix: prefix, Digest: digest}
+}
@@ -1,9 +1,13 @@
 package main
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+	"time"
+)
 
 func TestCreateAccount(t *testing.T) {
-	account, err := NewAccount("sample", "secret")
+	account, err := NewAccount(testHasher, "sample", "secret")
 	if err != nil {
 		t.Fatalf("Unable to create account: %v", err)
 	}
@@ -27,7 +31,7 @@ func TestCreateAccount(t *testing.T) {
 }
 
 func TestHasPassword(t *testing.T) {
-	account, err := NewAccount("sample", "secret")
+	account, err := NewAccount(testHasher, "sample", "secret")
 	if err != nil {
 		t.Fatalf("Unable to create account: %v", err)
 	}
@@ -42,7 +46,7 @@ func TestHasPassword(t *testing.T) {
 }
 
 func TestGenerateAPIKey(t *testing.T) {
-	account, err := NewAccount("sample", "secret")
+	account, err := NewAccount(testHasher, "sample", "secret")
 	if err != nil {
 		t.Fatalf("Unable to create account: %v", err)
 	}
@@ -60,7 +64,99 @@ func TestGenerateAPIKey(t *testing.T) {
 		t.Errorf("Expected account to have two API keys, but had %d", len(account.APIKeys))
 	}
 
-	if account.APIKeys[1] != key {
-		t.Errorf("Expected the generated key [%s] to match the account [%s]", key, account.APIKeys[1])
+	if account.APIKeys[1].Digest != DigestAPIKey(key) {
+		t.Errorf("Expected the generated key [%s] to match the account digest [%s]", key, account.APIKeys[1].Digest)
+	}
+
+	if account.APIKeys[1].Prefix != key[:APIKeyPrefixLength] {
+		t.Errorf("Expected the key prefix [%s] to match the generated key [%s]", account.APIKeys[1].Prefix, key)
+	}
+}
+
+func TestDigestAPIKey(t *testing.T) {
+	// echo -n "123abc" | sha256sum
+	expected := "dd130a849d7b29e5541b05d2f7f86a4acd4f1ec598c1c9438783f56bc4f0ff80"
+
+	if digest := DigestAPIKey("123abc"); digest != expected {
+		t.Errorf("Unexpected digest [%s]", digest)
+	}
+}
+
+func TestNewAPIKey(t *testing.T) {
+	key, record, err := NewAPIKey()
+	if err != nil {
+		t.Fatalf("Unexpected error generating an API key: %v", err)
+	}
+
+	if record.ID != APIKeyID(DigestAPIKey(key)) {
+		t.Errorf("Unexpected key ID [%s]", record.ID)
+	}
+
+	if len(record.ID) != APIKeyIDLength {
+		t.Errorf("Expected a key ID of length %d, but got [%s]", APIKeyIDLength, record.ID)
+	}
+
+	if record.CreatedAt == 0 {
+		t.Error("Key did not have creation time populated")
+	}
+
+	if record.LastUsedAt != 0 {
+		t.Errorf("Expected a new key to be unused, but it was last used at %d", record.LastUsedAt)
+	}
+}
+
+func TestParseScopes(t *testing.T) {
+	cases := []struct {
+		raw      string
+		expected []string
+	}{
+		{"", KnownScopes},
+		{"jobs:read", []string{ScopeJobsRead}},
+		{"keys:manage, jobs:submit,jobs:submit", []string{ScopeJobsSubmit, ScopeKeysManage}},
+	}
+
+	for _, c := range cases {
+		scopes, err := ParseScopes(c.raw)
+		if err != nil {
+			t.Errorf("Unexpected error parsing [%s]: %v", c.raw, err)
+		}
+		if !reflect.DeepEqual(scopes, c.expected) {
+			t.Errorf("Expected [%s] to parse as %v, but got %v", c.raw, c.expected, scopes)
+		}
+	}
+
+	if _, err := ParseScopes("jobs:read,everything"); err == nil {
+		t.Error("Expected an error for an unrecognized scope")
+	}
+}
+
+func TestLegacyKeyScopes(t *testing.T) {
+	key := apiKeyRecord("123abc")
+
+	if !reflect.DeepEqual(key.GrantedScopes(), KnownScopes) {
+		t.Errorf("Expected a key without scopes to grant every scope, but got %v", key.GrantedScopes())
+	}
+
+	key.Scopes = []string{ScopeJobsRead}
+	if key.HasScope(ScopeJobsSubmit) || !key.HasScope(ScopeJobsRead) {
+		t.Errorf("Unexpected scopes granted by %v", key.Scopes)
+	}
+}
+
+func TestNewResetToken(t *testing.T) {
+	now := time.Now()
+	token, record, err := NewResetToken(now, time.Hour)
+	if err != nil {
+		t.Fatalf("Unexpected error generating a reset token: %v", err)
+	}
+
+	if len(token) != ResetTokenLength*2 {
+		t.Errorf("Expected a hex token of length %d, but got [%s]", ResetTokenLength*2, token)
+	}
+	if record.Digest != DigestResetToken(token) {
+		t.Errorf("Unexpected token digest [%s]", record.Digest)
+	}
+	if record.ExpiresAt != now.Add(time.Hour).UnixNano() {
+		t.Errorf("Unexpected token expiry %d", record.ExpiresAt)
 	}
 }
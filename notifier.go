@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Notifier delivers secrets, like password reset tokens, to the owners of accounts. auth-store has
+// no idea how to reach its users, so deployments choose how notifications are delivered.
+type Notifier interface {
+	NotifyPasswordReset(accountName, token string, expiresAt time.Time) error
+}
+
+// LogNotifier writes notifications to the process log. It's only suitable for local development,
+// because anyone who can read the log can reset any password.
+type LogNotifier struct{}
+
+// NotifyPasswordReset logs a password reset token. The token is deliberately exempt from redaction,
+// since delivering it is the point.
+func (notifier LogNotifier) NotifyPasswordReset(accountName, token string, expiresAt time.Time) error {
+	log.WithFields(log.Fields{
+		"account":    accountName,
+		"token":      RevealedSecret(token),
+		"expires at": expiresAt,
+	}).Warn("Password reset requested.")
+	return nil
+}
+
+// FileNotifier appends notifications to a file as JSON lines, so that they can be picked up and
+// delivered by another process.
+type FileNotifier struct {
+	Path string
+
+	mutex sync.Mutex
+}
+
+// fileNotification is a single line written by a FileNotifier.
+type fileNotification struct {
+	Kind        string `json:"kind"`
+	AccountName string `json:"accountName"`
+	Token       string `json:"token"`
+	ExpiresAt   int64  `json:"expiresAt"`
+}
+
+// NotifyPasswordReset appends a password reset token to the notification file.
+func (notifier *FileNotifier) NotifyPasswordReset(accountName, token string, expiresAt time.Time) error {
+	return notifier.append(fileNotification{
+		Kind:        "password-reset",
+		AccountName: accountName,
+		Token:       token,
+		ExpiresAt:   expiresAt.UnixNano(),
+	})
+}
+
+func (notifier *FileNotifier) append(n fileNotification) error {
+	notifier.mutex.Lock()
+	defer notifier.mutex.Unlock()
+
+	f, err := os.OpenFile(notifier.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(f).Encode(n); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Ensure that LogNotifier and FileNotifier obey the Notifier interface.
+var (
+	_ Notifier = LogNotifier{}
+	_ Notifier = &FileNotifier{}
+)
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// RecordingNotifier remembers the last password reset token that it was asked to deliver.
+type RecordingNotifier struct {
+	AccountName string
+	Token       string
+}
+
+func (notifier *RecordingNotifier) NotifyPasswordReset(accountName, token string, expiresAt time.Time) error {
+	notifier.AccountName = accountName
+	notifier.Token = token
+	return nil
+}
+
+func TestFileNotifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth-store-notifier")
+	if err != nil {
+		t.Fatalf("Unable to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	n := &FileNotifier{Path: filepath.Join(dir, "notifications.jsonl")}
+	for _, token := range []string{"123abc", "456def"} {
+		if err := n.NotifyPasswordReset("someone", token, time.Unix(0, 12345)); err != nil {
+			t.Fatalf("Unexpected error notifying: %v", err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(n.Path)
+	if err != nil {
+		t.Fatalf("Unable to read notifications: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 notifications, but found %d", len(lines))
+	}
+
+	var notification fileNotification
+	if err := json.Unmarshal([]byte(lines[1]), &notification); err != nil {
+		t.Fatalf("Unable to decode notification: %v", err)
+	}
+	expected := fileNotification{
+		Kind:        "password-reset",
+		AccountName: "someone",
+		Token:       "456def",
+		ExpiresAt:   12345,
+	}
+	if notification != expected {
+		t.Errorf("Expected notification %+v, but got %+v", expected, notification)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"expvar"
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Names of the supported password hashing algorithms, as chosen by the PasswordHash setting.
+const (
+	PasswordHashBcrypt   = "bcrypt"
+	PasswordHashArgon2id = "argon2id"
+)
+
+// Default Argon2id parameters, from the second recommended option of RFC 9106. Memory is in KiB.
+const (
+	DefaultArgon2Time    = 3
+	DefaultArgon2Memory  = 64 * 1024
+	DefaultArgon2Threads = 4
+)
+
+// Lengths of the random salt and of the derived key in Argon2id hashes, in bytes.
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+// argon2Prefix begins every Argon2id hash, which is stored in the PHC string format:
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+const argon2Prefix = "$argon2id$"
+
+// Counter of password hashes that were upgraded to the current algorithm or parameters when their
+// owners logged in, published with expvar.
+var passwordsRehashed = expvar.NewInt("passwords_rehashed")
+
+// PasswordHasher computes the hashes that passwords are stored as. Hashes describe the algorithm
+// and parameters that produced them, so CheckPassword can verify any of them, whichever hasher is
+// configured.
+type PasswordHasher interface {
+	// Hash computes a new hash of a password, with a random salt.
+	Hash(password string) ([]byte, error)
+
+	// Current returns true if a hash was computed by this hasher with its current parameters, and
+	// false if it should be replaced when its password is next presented.
+	Current(hashed []byte) bool
+}
+
+// UpgradePasswordHash rehashes an account's password with the context's hasher, once the password
+// has been verified, if its stored hash uses a different algorithm or outdated parameters. Failures
+// are logged, but don't prevent the login that triggered the upgrade.
+func UpgradePasswordHash(c *Context, account *Account, password string) {
+	if c.Hasher.Current(account.HashedPassword) {
+		return
+	}
+
+	hashed, err := c.Hasher.Hash(password)
+	if err == nil {
+		err = c.Storage.RehashPassword(account.Name, account.HashedPassword, hashed)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"account": account.Name,
+			"error":   err,
+		}).Warn("Unable to upgrade password hash.")
+		return
+	}
+
+	account.HashedPassword = hashed
+	passwordsRehashed.Add(1)
+	log.WithFields(log.Fields{
+		"account": account.Name,
+	}).Info("Password hash upgraded.")
+}
+
+// CheckPassword returns true if a password matches a hash computed by any supported algorithm.
+func CheckPassword(hashed []byte, password string) bool {
+	if bytes.HasPrefix(hashed, []byte(argon2Prefix)) {
+		return checkArgon2id(hashed, password)
+	}
+	return bcrypt.CompareHashAndPassword(hashed, []byte(password)) == nil
+}
+
+// BcryptHasher hashes passwords with bcrypt at a fixed cost.
+type BcryptHasher struct {
+	Cost int
+}
+
+// Hash computes a bcrypt hash of a password.
+func (hasher BcryptHasher) Hash(password string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(password), hasher.Cost)
+}
+
+// Current returns true if a hash is a bcrypt hash with the hasher's cost.
+func (hasher BcryptHasher) Current(hashed []byte) bool {
+	cost, err := bcrypt.Cost(hashed)
+	return err == nil && cost == hasher.Cost
+}
+
+// Argon2idHasher hashes passwords with Argon2id. Memory is in KiB.
+type Argon2idHasher struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+// Hash computes an Argon2id hash of a password, encoded in the PHC string format.
+func (hasher Argon2idHasher) Hash(password string) ([]byte, error) {
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, hasher.Time, hasher.Memory, hasher.Threads, argon2KeyLength)
+	return []byte(fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2Prefix, argon2.Version, hasher.Memory, hasher.Time, hasher.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)), nil
+}
+
+// Current returns true if a hash is an Argon2id hash with the hasher's parameters.
+func (hasher Argon2idHasher) Current(hashed []byte) bool {
+	params, _, key, err := parseArgon2id(hashed)
+	return err == nil && params == hasher && len(key) == argon2KeyLength
+}
+
+// parseArgon2id decodes the parameters, salt and derived key of an Argon2id hash.
+func parseArgon2id(hashed []byte) (Argon2idHasher, []byte, []byte, error) {
+	var params Argon2idHasher
+
+	// "", "argon2id", "v=19", "m=65536,t=3,p=4", salt, key
+	parts := strings.Split(string(hashed), "$")
+	if len(parts) != 6 || parts[1] != PasswordHashArgon2id {
+		return params, nil, nil, fmt.Errorf("Malformed Argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("Unsupported Argon2id version: %s", parts[2])
+	}
+
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads)
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("Malformed Argon2id parameters: %s", parts[3])
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	return params, salt, key, nil
+}
+
+// checkArgon2id returns true if a password matches an Argon2id hash, with whatever parameters it
+// was computed with.
+func checkArgon2id(hashed []byte, password string) bool {
+	params, salt, key, err := parseArgon2id(hashed)
+	if err != nil || len(key) == 0 || params.Time == 0 || params.Threads == 0 {
+		return false
+	}
+
+	derived := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(derived, key) == 1
+}
+
+// Ensure that the hashers obey the PasswordHasher interface.
+var (
+	_ PasswordHasher = BcryptHasher{}
+	_ PasswordHasher = Argon2idHasher{}
+)
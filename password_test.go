@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testArgon2idHasher uses the cheapest Argon2id parameters, so that tests run quickly.
+var testArgon2idHasher = Argon2idHasher{Time: 1, Memory: 64, Threads: 1}
+
+func TestPasswordHashers(t *testing.T) {
+	hashers := []PasswordHasher{BcryptHasher{Cost: 4}, testArgon2idHasher}
+	for _, hasher := range hashers {
+		hashed, err := hasher.Hash("correct horse")
+		if err != nil {
+			t.Fatalf("Unexpected error hashing with %+v: %v", hasher, err)
+		}
+
+		if !CheckPassword(hashed, "correct horse") {
+			t.Errorf("Expected %s to match its password", hashed)
+		}
+		if CheckPassword(hashed, "battery staple") {
+			t.Errorf("Expected %s not to match another password", hashed)
+		}
+		if !hasher.Current(hashed) {
+			t.Errorf("Expected %s to be current for %+v", hashed, hasher)
+		}
+
+		again, err := hasher.Hash("correct horse")
+		if err != nil {
+			t.Fatalf("Unexpected error hashing with %+v: %v", hasher, err)
+		}
+		if bytes.Equal(hashed, again) {
+			t.Errorf("Expected each hash to be salted differently, but both were %s", hashed)
+		}
+	}
+}
+
+func TestArgon2idHashFormat(t *testing.T) {
+	hashed, err := testArgon2idHasher.Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Unexpected error hashing: %v", err)
+	}
+	if !strings.HasPrefix(string(hashed), "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("Expected a self-describing PHC string, but got %s", hashed)
+	}
+
+	params, salt, key, err := parseArgon2id(hashed)
+	if err != nil {
+		t.Fatalf("Unable to parse %s: %v", hashed, err)
+	}
+	if params != testArgon2idHasher || len(salt) != argon2SaltLength || len(key) != argon2KeyLength {
+		t.Errorf("Unexpected parameters %+v, salt %x or key %x parsed from %s", params, salt, key, hashed)
+	}
+
+	malformed := []string{
+		"$argon2id$v=19$m=64,t=1,p=1$c29tZXNhbHQ",
+		"$argon2id$v=16$m=64,t=1,p=1$c29tZXNhbHQ$c29tZWtleQ",
+		"$argon2id$v=19$m=64,t=0,p=1$c29tZXNhbHQ$c29tZWtleQ",
+		"$argon2id$v=19$m=64,t=1,p=1$c29tZXNhbHQ$!!!",
+	}
+	for _, hashed := range malformed {
+		if CheckPassword([]byte(hashed), "correct horse") {
+			t.Errorf("Expected malformed hash %s never to match", hashed)
+		}
+	}
+}
+
+func TestHasherCurrency(t *testing.T) {
+	bcryptHash, err := BcryptHasher{Cost: 4}.Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Unexpected error hashing: %v", err)
+	}
+	argon2Hash, err := testArgon2idHasher.Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Unexpected error hashing: %v", err)
+	}
+
+	if (BcryptHasher{Cost: 5}).Current(bcryptHash) {
+		t.Error("Expected a bcrypt hash with a lower cost to be outdated")
+	}
+	if (BcryptHasher{Cost: 4}).Current(argon2Hash) {
+		t.Error("Expected an Argon2id hash to be outdated for bcrypt")
+	}
+	if testArgon2idHasher.Current(bcryptHash) {
+		t.Error("Expected a bcrypt hash to be outdated for Argon2id")
+	}
+	if (Argon2idHasher{Time: 2, Memory: 64, Threads: 1}).Current(argon2Hash) {
+		t.Error("Expected an Argon2id hash with a lower time to be outdated")
+	}
+}
+
+func TestPasswordRehashedOnLogin(t *testing.T) {
+	s := NewMemoryStorage()
+	a, err := NewAccount(testHasher, "someone", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+	if err := s.CreateAccount(a); err != nil {
+		t.Fatalf("Unable to store account: %v", err)
+	}
+	c := &Context{Storage: s, Lockout: testLockoutPolicy(), Hasher: testArgon2idHasher}
+
+	r := HTTPRequest(t, "POST", "https://localhost/v1/keys", "")
+	if _, ok := AuthenticatePassword(c, httptest.NewRecorder(), r, "someone", "wrong"); ok {
+		t.Fatal("Expected an incorrect password to be refused")
+	}
+	found, err := s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if !bytes.Equal(found.HashedPassword, a.HashedPassword) {
+		t.Error("Expected an incorrect password to leave the hash alone")
+	}
+
+	if _, ok := AuthenticatePassword(c, httptest.NewRecorder(), r, "someone", "secret"); !ok {
+		t.Fatal("Expected the correct password to be accepted")
+	}
+	found, err = s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if !testArgon2idHasher.Current(found.HashedPassword) {
+		t.Errorf("Expected the hash to be upgraded to Argon2id, but found %s", found.HashedPassword)
+	}
+	if !found.HasPassword("secret") {
+		t.Error("Expected the upgraded hash to match the same password")
+	}
+
+	if err := s.SetAccountDisabled("someone", true, "testing", 1); err != nil {
+		t.Fatalf("Unable to disable account: %v", err)
+	}
+	c.Hasher = BcryptHasher{Cost: 5}
+	if _, ok := AuthenticatePassword(c, httptest.NewRecorder(), r, "someone", "secret"); ok {
+		t.Fatal("Expected a disabled account to be refused")
+	}
+	disabled, err := s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if !bytes.Equal(disabled.HashedPassword, found.HashedPassword) {
+		t.Error("Expected a disabled account's hash to be left alone")
+	}
+}
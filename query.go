@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Orders in which accounts may be listed.
+const (
+	AccountSortName    = "name"
+	AccountSortCreated = "created"
+)
+
+// DefaultAccountPageSize and MaxAccountPageSize bound the number of accounts in each page of a
+// listing.
+const (
+	DefaultAccountPageSize = 50
+	MaxAccountPageSize     = 500
+)
+
+// AccountQuery selects a page of accounts to list. The zero value selects the first page of every
+// account, ordered by name.
+type AccountQuery struct {
+	// Prefix matches the start of account names, and Contains matches any part of them. Both
+	// ignore case.
+	Prefix   string
+	Contains string
+
+	// Administrator and Disabled, if they're set, only match accounts with that status.
+	Administrator *bool
+	Disabled      *bool
+
+	// CreatedAfter and CreatedBefore, if they're nonzero, only match accounts that were created
+	// strictly after or before them.
+	CreatedAfter  int64
+	CreatedBefore int64
+
+	// Sort is AccountSortName, the default, or AccountSortCreated. Accounts that were created at
+	// the same time are ordered by name.
+	Sort       string
+	Descending bool
+
+	// Limit is the most accounts to return, and defaults to DefaultAccountPageSize. Cursor
+	// continues a listing from the end of a previous page.
+	Limit  int
+	Cursor string
+}
+
+// AccountPage is a single page of an account listing.
+type AccountPage struct {
+	Accounts []*Account
+
+	// NextCursor continues the listing after this page, or is empty if this is the last page.
+	NextCursor string
+}
+
+// accountCursor is the decoded form of a pagination cursor. It records the position of the last
+// account on a page, along with the order of the listing that it belongs to.
+type accountCursor struct {
+	Sort       string `json:"s"`
+	Descending bool   `json:"d,omitempty"`
+	Name       string `json:"n"`
+	CreatedAt  int64  `json:"c,omitempty"`
+}
+
+// normalize validates a query and fills in its defaults. It returns the query's decoded cursor, or
+// nil if it's the first page of a listing.
+func (query *AccountQuery) normalize() (*accountCursor, error) {
+	switch query.Sort {
+	case "":
+		query.Sort = AccountSortName
+	case AccountSortName, AccountSortCreated:
+	default:
+		return nil, fmt.Errorf("Unrecognized account sort: %s", query.Sort)
+	}
+
+	if query.Limit <= 0 {
+		query.Limit = DefaultAccountPageSize
+	}
+	if query.Limit > MaxAccountPageSize {
+		query.Limit = MaxAccountPageSize
+	}
+
+	if query.Cursor == "" {
+		return nil, nil
+	}
+
+	data, err := base64.URLEncoding.DecodeString(query.Cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var cursor accountCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if cursor.Sort != query.Sort || cursor.Descending != query.Descending {
+		return nil, ErrInvalidCursor
+	}
+	return &cursor, nil
+}
+
+// page builds an AccountPage from accounts that were selected in order, with a limit of one more
+// than the query's own, so that it can tell whether there's a next page.
+func (query AccountQuery) page(accounts []*Account) AccountPage {
+	if len(accounts) <= query.Limit {
+		return AccountPage{Accounts: accounts}
+	}
+
+	accounts = accounts[:query.Limit]
+	last := accounts[len(accounts)-1]
+	cursor := accountCursor{Sort: query.Sort, Descending: query.Descending, Name: last.Name}
+	if query.Sort == AccountSortCreated {
+		cursor.CreatedAt = last.CreatedAt
+	}
+
+	data, _ := json.Marshal(cursor)
+	return AccountPage{Accounts: accounts, NextCursor: base64.URLEncoding.EncodeToString(data)}
+}
+
+// matches returns true if an account satisfies every filter of the query.
+func (query AccountQuery) matches(account *Account) bool {
+	name := strings.ToLower(account.Name)
+	switch {
+	case !strings.HasPrefix(name, strings.ToLower(query.Prefix)):
+		return false
+	case !strings.Contains(name, strings.ToLower(query.Contains)):
+		return false
+	case query.Administrator != nil && account.Administrator != *query.Administrator:
+		return false
+	case query.Disabled != nil && account.Disabled != *query.Disabled:
+		return false
+	case query.CreatedAfter != 0 && account.CreatedAt <= query.CreatedAfter:
+		return false
+	case query.CreatedBefore != 0 && account.CreatedAt >= query.CreatedBefore:
+		return false
+	}
+	return true
+}
+
+// less returns true if account a is listed before account b in ascending order.
+func (query AccountQuery) less(a, b accountCursor) bool {
+	if query.Sort == AccountSortCreated && a.CreatedAt != b.CreatedAt {
+		return a.CreatedAt < b.CreatedAt
+	}
+	return a.Name < b.Name
+}
+
+// follows returns true if an account is listed after the cursor.
+func (query AccountQuery) follows(account *Account, cursor accountCursor) bool {
+	position := accountCursor{Name: account.Name, CreatedAt: account.CreatedAt}
+	if query.Descending {
+		return query.less(position, cursor)
+	}
+	return query.less(cursor, position)
+}
+
+// accountOrder sorts accounts in the order that a query lists them.
+type accountOrder struct {
+	query    AccountQuery
+	accounts []*Account
+}
+
+func (o accountOrder) Len() int      { return len(o.accounts) }
+func (o accountOrder) Swap(i, j int) { o.accounts[i], o.accounts[j] = o.accounts[j], o.accounts[i] }
+func (o accountOrder) Less(i, j int) bool {
+	a := accountCursor{Name: o.accounts[i].Name, CreatedAt: o.accounts[i].CreatedAt}
+	b := accountCursor{Name: o.accounts[j].Name, CreatedAt: o.accounts[j].CreatedAt}
+	if o.query.Descending {
+		return o.query.less(b, a)
+	}
+	return o.query.less(a, b)
+}
+
+// queryAccounts selects a page of accounts from every account, for backends that can't filter or
+// sort accounts themselves.
+func queryAccounts(accounts []*Account, query AccountQuery) (AccountPage, error) {
+	cursor, err := query.normalize()
+	if err != nil {
+		return AccountPage{}, err
+	}
+
+	var selected []*Account
+	for _, account := range accounts {
+		if query.matches(account) && (cursor == nil || query.follows(account, *cursor)) {
+			selected = append(selected, account)
+		}
+	}
+	sort.Sort(accountOrder{query: query, accounts: selected})
+
+	if len(selected) > query.Limit+1 {
+		selected = selected[:query.Limit+1]
+	}
+	return query.page(selected), nil
+}
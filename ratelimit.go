@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/x509/pkix"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Counter of requests that were refused by a rate limit, published with expvar.
+var requestsRateLimited = expvar.NewInt("requests_rate_limited")
+
+// RateLimit allows each client Count requests per Period. Clients may spend them in a single burst.
+// The zero value allows any number of requests.
+type RateLimit struct {
+	Count  int
+	Period time.Duration
+}
+
+// ParseRateLimit parses a rate limit like "10/s", "5/m" or "100/10s". An empty limit, "0" or "off"
+// allows any number of requests.
+func ParseRateLimit(spec string) (RateLimit, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" || spec == "0" || spec == "off" {
+		return RateLimit{}, nil
+	}
+
+	parts := strings.SplitN(spec, "/", 2)
+	if len(parts) != 2 {
+		return RateLimit{}, fmt.Errorf("Invalid rate limit: %s", spec)
+	}
+
+	count, err := strconv.Atoi(parts[0])
+	if err != nil || count <= 0 {
+		return RateLimit{}, fmt.Errorf("Invalid rate limit: %s", spec)
+	}
+
+	unit := parts[1]
+	switch unit {
+	case "s", "m", "h":
+		unit = "1" + unit
+	}
+	period, err := time.ParseDuration(unit)
+	if err != nil || period <= 0 {
+		return RateLimit{}, fmt.Errorf("Invalid rate limit: %s", spec)
+	}
+
+	return RateLimit{Count: count, Period: period}, nil
+}
+
+// ParseRouteRateLimits parses a comma-separated list of rate limits for individual routes, like
+// "/v1/accounts=5/m,/v1/validate=200/s".
+func ParseRouteRateLimits(spec string) (map[string]RateLimit, error) {
+	limits := make(map[string]RateLimit)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") {
+			return nil, fmt.Errorf("Invalid route rate limit: %s", entry)
+		}
+
+		limit, err := ParseRateLimit(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		limits[parts[0]] = limit
+	}
+	return limits, nil
+}
+
+// RateLimits are the limits that apply to each route of the internal and external APIs.
+type RateLimits struct {
+	Internal RateLimit
+	External RateLimit
+
+	// Routes overrides the limit of individual routes, on either API.
+	Routes map[string]RateLimit
+}
+
+// For returns the limit that applies to a route, or fallback if the route has no limit of its own.
+func (limits RateLimits) For(route string, fallback RateLimit) RateLimit {
+	if limit, ok := limits.Routes[route]; ok {
+		return limit
+	}
+	return fallback
+}
+
+// tokenBucket holds the requests that a single client may still make.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// RateLimiter tracks the requests made by each client against a single RateLimit.
+type RateLimiter struct {
+	Limit RateLimit
+
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+// NewRateLimiter creates a RateLimiter that enforces limit.
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	return &RateLimiter{Limit: limit, buckets: make(map[string]*tokenBucket)}
+}
+
+// Allow spends one of a client's requests, if it has any left. Otherwise, it returns false and how
+// long the client must wait before its next request will be allowed.
+func (limiter *RateLimiter) Allow(client string, now time.Time) (bool, time.Duration) {
+	limit := limiter.Limit
+	if limit.Count <= 0 {
+		return true, 0
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	// Forget clients whose buckets have refilled completely, since they're no different from new
+	// ones.
+	if now.Sub(limiter.swept) >= limit.Period {
+		for key, bucket := range limiter.buckets {
+			if now.Sub(bucket.updated) >= limit.Period {
+				delete(limiter.buckets, key)
+			}
+		}
+		limiter.swept = now
+	}
+
+	capacity := float64(limit.Count)
+	bucket, ok := limiter.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: capacity, updated: now}
+		limiter.buckets[client] = bucket
+	}
+
+	if elapsed := now.Sub(bucket.updated); elapsed > 0 {
+		bucket.tokens += capacity * float64(elapsed) / float64(limit.Period)
+		if bucket.tokens > capacity {
+			bucket.tokens = capacity
+		}
+		bucket.updated = now
+	}
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - bucket.tokens) * float64(limit.Period) / capacity)
+	return false, wait
+}
+
+// RateLimited wraps a ContextHandler so that it refuses requests from clients that have exceeded the
+// limiter's rate limit. Clients are identified by clientKey.
+func RateLimited(limiter *RateLimiter, clientKey func(r *http.Request) string, handler ContextHandler) ContextHandler {
+	return func(c *Context, w http.ResponseWriter, r *http.Request) {
+		client := clientKey(r)
+		if ok, wait := limiter.Allow(client, time.Now()); !ok {
+			requestsRateLimited.Add(1)
+			setRetryAfter(w, wait)
+
+			APIError{
+				UserMessage: "Too many requests. Please try again later.",
+				LogMessage:  fmt.Sprintf("Rate limit exceeded on %s by %s.", r.URL.Path, client),
+			}.Log("").Report(w, 429)
+			return
+		}
+
+		handler(c, w, r)
+	}
+}
+
+// ClientCertificateSubject identifies a client of the internal API by the subject of the
+// certificate that it presented, or by its IP address if it didn't present one.
+func ClientCertificateSubject(r *http.Request) string {
+	if subject := certificateSubject(r); subject != "" {
+		return subject
+	}
+	return ClientIP(r)
+}
+
+// certificateSubject returns the subject of the certificate that a client presented, or an empty
+// string if it didn't present one.
+func certificateSubject(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return formatSubject(r.TLS.PeerCertificates[0].Subject)
+}
+
+// formatSubject renders the distinguishing parts of a certificate subject.
+func formatSubject(subject pkix.Name) string {
+	var parts []string
+	add := func(key string, values []string) {
+		for _, value := range values {
+			parts = append(parts, key+"="+value)
+		}
+	}
+
+	add("C", subject.Country)
+	add("O", subject.Organization)
+	add("OU", subject.OrganizationalUnit)
+	if subject.CommonName != "" {
+		add("CN", []string{subject.CommonName})
+	}
+	if subject.SerialNumber != "" {
+		add("SERIALNUMBER", []string{subject.SerialNumber})
+	}
+	return strings.Join(parts, ",")
+}
+
+// setRetryAfter tells a client how long to wait before retrying a request, in whole seconds.
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	seconds := int64((wait + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	expectations := map[string]RateLimit{
+		"":       {},
+		"off":    {},
+		"0":      {},
+		"10/s":   {Count: 10, Period: time.Second},
+		"5/m":    {Count: 5, Period: time.Minute},
+		"100/h":  {Count: 100, Period: time.Hour},
+		"20/10s": {Count: 20, Period: 10 * time.Second},
+	}
+
+	for spec, expected := range expectations {
+		limit, err := ParseRateLimit(spec)
+		if err != nil {
+			t.Errorf("Unexpected error parsing [%s]: %v", spec, err)
+			continue
+		}
+		if limit != expected {
+			t.Errorf("Expected [%s] to parse as %+v, but was %+v", spec, expected, limit)
+		}
+	}
+
+	for _, spec := range []string{"10", "ten/s", "-1/s", "10/fortnight", "10/0s"} {
+		if _, err := ParseRateLimit(spec); err == nil {
+			t.Errorf("Expected [%s] to be rejected", spec)
+		}
+	}
+}
+
+func TestParseRouteRateLimits(t *testing.T) {
+	limits, err := ParseRouteRateLimits("/v1/accounts=5/m, /v1/validate=off")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if limit := limits["/v1/accounts"]; limit != (RateLimit{Count: 5, Period: time.Minute}) {
+		t.Errorf("Unexpected limit for /v1/accounts: %+v", limit)
+	}
+	if limit, ok := limits["/v1/validate"]; !ok || limit != (RateLimit{}) {
+		t.Errorf("Expected /v1/validate to be unlimited, but was %+v", limit)
+	}
+
+	for _, spec := range []string{"/v1/accounts", "v1/accounts=5/m", "/v1/accounts=often"} {
+		if _, err := ParseRouteRateLimits(spec); err == nil {
+			t.Errorf("Expected [%s] to be rejected", spec)
+		}
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	limiter := NewRateLimiter(RateLimit{Count: 2, Period: time.Second})
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.Allow("10.0.0.1", now); !ok {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+	}
+
+	ok, wait := limiter.Allow("10.0.0.1", now)
+	if ok {
+		t.Fatal("Expected a request beyond the burst to be refused")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("Expected to wait 500ms, but was %v", wait)
+	}
+
+	if ok, _ := limiter.Allow("10.0.0.2", now); !ok {
+		t.Error("Expected another client to be allowed")
+	}
+
+	if ok, _ := limiter.Allow("10.0.0.1", now.Add(500*time.Millisecond)); !ok {
+		t.Error("Expected a request to be allowed once a token was refilled")
+	}
+	if ok, _ := limiter.Allow("10.0.0.1", now.Add(500*time.Millisecond)); ok {
+		t.Error("Expected only one token to have been refilled")
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	limiter := NewRateLimiter(RateLimit{})
+	now := time.Now()
+
+	for i := 0; i < 1000; i++ {
+		if ok, _ := limiter.Allow("10.0.0.1", now); !ok {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+	}
+}
+
+func TestRateLimiterForgetsIdleClients(t *testing.T) {
+	limiter := NewRateLimiter(RateLimit{Count: 1, Period: time.Second})
+	now := time.Now()
+
+	limiter.Allow("10.0.0.1", now)
+	limiter.Allow("10.0.0.2", now.Add(2*time.Second))
+
+	if _, ok := limiter.buckets["10.0.0.1"]; ok {
+		t.Error("Expected an idle client to be forgotten")
+	}
+	if _, ok := limiter.buckets["10.0.0.2"]; !ok {
+		t.Error("Expected an active client to be remembered")
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	called := 0
+	handler := RateLimited(NewRateLimiter(RateLimit{Count: 1, Period: time.Minute}), ClientIP,
+		func(c *Context, w http.ResponseWriter, r *http.Request) {
+			called++
+			w.WriteHeader(http.StatusNoContent)
+		})
+
+	request := func() *httptest.ResponseRecorder {
+		r := HTTPRequest(t, "GET", "https://localhost/v1/keys", "")
+		r.RemoteAddr = "10.0.0.1:4567"
+		w := httptest.NewRecorder()
+		handler(&Context{}, w, r)
+		return w
+	}
+
+	if w := request(); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected response code %d, but was %d", http.StatusNoContent, w.Code)
+	}
+
+	w := request()
+	if w.Code != 429 {
+		t.Fatalf("Expected response code 429, but was %d", w.Code)
+	}
+	if retry := w.Header().Get("Retry-After"); retry != "60" {
+		t.Errorf("Expected Retry-After of 60 seconds, but was [%s]", retry)
+	}
+	if called != 1 {
+		t.Errorf("Expected the handler to be called once, but was called %d times", called)
+	}
+}
+
+func TestClientCertificateSubject(t *testing.T) {
+	r := HTTPRequest(t, "GET", "https://localhost/v1/validate", "")
+	r.RemoteAddr = "10.0.0.1:4567"
+
+	if client := ClientCertificateSubject(r); client != "10.0.0.1" {
+		t.Errorf("Expected a request without a certificate to use its address, but was [%s]", client)
+	}
+
+	r.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{
+			{Subject: pkix.Name{Organization: []string{"cloudpipe"}, CommonName: "api-server"}},
+		},
+	}
+	if client := ClientCertificateSubject(r); client != "O=cloudpipe,CN=api-server" {
+		t.Errorf("Unexpected certificate subject: [%s]", client)
+	}
+}
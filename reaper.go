@@ -0,0 +1,56 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ReapExpiredKeys periodically removes API keys from storage once they've been expired for longer
+// than the configured reap age. It runs until the process exits.
+func ReapExpiredKeys(c *Context) {
+	if c.ReapInterval <= 0 {
+		log.Info("Expired API key reaping is disabled.")
+		return
+	}
+
+	for now := range time.Tick(c.ReapInterval) {
+		ReapOnce(c, now)
+	}
+}
+
+// ReapOnce removes every API key that expired more than the configured reap age before now, along
+// with any failed password attempts that are too old to cause a lockout. It returns the number of
+// accounts that were modified.
+func ReapOnce(c *Context, now time.Time) (int, error) {
+	n, err := c.Storage.RemoveExpiredKeys(now.Add(-c.ReapAge).UnixNano())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Unable to remove expired API keys.")
+		return n, err
+	}
+
+	if n > 0 {
+		log.WithFields(log.Fields{
+			"accounts": n,
+		}).Info("Removed expired API keys.")
+	}
+
+	if c.Lockout.ResetAfter > 0 {
+		removed, err := c.Storage.RemoveLoginFailures(now.Add(-c.Lockout.ResetAfter).UnixNano())
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warn("Unable to remove old login failures.")
+			return n, err
+		}
+
+		if removed > 0 {
+			log.WithFields(log.Fields{
+				"sources": removed,
+			}).Info("Removed old login failures.")
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReapOnce(t *testing.T) {
+	s := NewMemoryStorage()
+	a, err := NewAccount(testHasher, "someone", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+	if err := s.CreateAccount(a); err != nil {
+		t.Fatalf("Unexpected error creating account: %v", err)
+	}
+
+	now := time.Now()
+
+	longExpired := apiKeyRecord("123abc")
+	longExpired.ExpiresAt = now.Add(-48 * time.Hour).UnixNano()
+	recentlyExpired := apiKeyRecord("456def")
+	recentlyExpired.ExpiresAt = now.Add(-time.Hour).UnixNano()
+
+	for _, key := range []APIKey{longExpired, recentlyExpired} {
+		if err := s.AddKeyToAccount("someone", key); err != nil {
+			t.Fatalf("Unexpected error adding a key: %v", err)
+		}
+	}
+
+	c := &Context{Storage: s, ReapAge: 24 * time.Hour, Hasher: testHasher}
+	if n, err := ReapOnce(c, now); n != 1 || err != nil {
+		t.Errorf("Expected 1 account to be reaped, but got (%d, %v)", n, err)
+	}
+
+	found, err := s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if len(found.APIKeys) != 2 {
+		t.Fatalf("Expected 2 remaining API keys, but found %d", len(found.APIKeys))
+	}
+	if found.APIKeys[1].Digest != recentlyExpired.Digest {
+		t.Errorf("Expected the recently expired key to be kept, but found %v", found.APIKeys[1])
+	}
+}
+
+func TestReapOnceRemovesLoginFailures(t *testing.T) {
+	s := NewMemoryStorage()
+	now := time.Now()
+
+	old := now.Add(-48 * time.Hour).UnixNano()
+	if _, err := s.RecordLoginFailure("account:old", old, 0); err != nil {
+		t.Fatalf("Unable to record a failure: %v", err)
+	}
+	if _, err := s.RecordLoginFailure("account:recent", now.UnixNano(), 0); err != nil {
+		t.Fatalf("Unable to record a failure: %v", err)
+	}
+
+	c := &Context{Storage: s, ReapAge: 24 * time.Hour, Lockout: LockoutPolicy{ResetAfter: 24 * time.Hour}, Hasher: testHasher}
+	if _, err := ReapOnce(c, now); err != nil {
+		t.Fatalf("Unexpected error reaping: %v", err)
+	}
+
+	if failures, _ := s.FindLoginFailures("account:old"); failures.Count != 0 {
+		t.Errorf("Expected old failures to be removed, but found %d", failures.Count)
+	}
+	if failures, _ := s.FindLoginFailures("account:recent"); failures.Count != 1 {
+		t.Errorf("Expected recent failures to be kept, but found %d", failures.Count)
+	}
+}
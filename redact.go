@@ -0,0 +1,106 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Redacted replaces the secret part of a value in the log.
+const Redacted = "[REDACTED]"
+
+// prefixedFields name log fields that hold random secrets, like API keys and tokens. Their values
+// are logged only by prefix, which is enough to identify them without making them usable.
+var prefixedFields = map[string]bool{
+	"key":         true,
+	"api key":     true,
+	"apikey":      true,
+	"token":       true,
+	"reset token": true,
+	"setup token": true,
+}
+
+// hiddenFields name log fields that hold secrets chosen by people, like passwords. Their values are
+// never logged at all.
+var hiddenFields = map[string]bool{
+	"password":      true,
+	"new password":  true,
+	"newpassword":   true,
+	"secret":        true,
+	"otp":           true,
+	"recovery code": true,
+}
+
+// secretPattern matches long runs of hex digits, the form that every generated secret takes, so
+// that secrets are masked even when they appear in messages or unexpected fields.
+var secretPattern = regexp.MustCompile(`[0-9a-fA-F]{32,}`)
+
+// urlPasswordPattern matches the password in the userinfo of a URL, like the credentials in a
+// database URL, wherever the URL appears.
+var urlPasswordPattern = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://[^\s/?#@:]*:)[^\s/?#@]*@`)
+
+// RevealedSecret marks a secret that's deliberately written to the log, like a setup token that
+// an operator must read, so that RedactingFormatter leaves it intact.
+type RevealedSecret string
+
+// RedactingFormatter masks secrets in log entries before they're formatted by another Formatter.
+type RedactingFormatter struct {
+	Formatter log.Formatter
+}
+
+// Format redacts an entry's secrets and formats the result.
+func (f *RedactingFormatter) Format(entry *log.Entry) ([]byte, error) {
+	data := make(log.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		data[k] = redactField(k, v)
+	}
+
+	redacted := *entry
+	redacted.Data = data
+	redacted.Message = RedactSecrets(entry.Message)
+	return f.Formatter.Format(&redacted)
+}
+
+// redactField masks the value of a single log field.
+func redactField(name string, value interface{}) interface{} {
+	if revealed, ok := value.(RevealedSecret); ok {
+		return string(revealed)
+	}
+
+	name = strings.ToLower(name)
+	switch {
+	case hiddenFields[name]:
+		return Redacted
+	case prefixedFields[name]:
+		if s, ok := value.(string); ok {
+			return RedactPrefix(s)
+		}
+		return Redacted
+	}
+
+	switch v := value.(type) {
+	case string:
+		return RedactSecrets(v)
+	case error:
+		if s := v.Error(); RedactSecrets(s) != s {
+			return RedactSecrets(s)
+		}
+	}
+	return value
+}
+
+// RedactPrefix masks all but the identifying prefix of a secret.
+func RedactPrefix(secret string) string {
+	if len(secret) <= APIKeyPrefixLength*2 {
+		return Redacted
+	}
+	return secret[:APIKeyPrefixLength] + Redacted
+}
+
+// RedactSecrets masks every secret that appears in a piece of text, including the passwords of any
+// URLs in it.
+func RedactSecrets(text string) string {
+	text = urlPasswordPattern.ReplaceAllString(text, "${1}"+Redacted+"@")
+	return secretPattern.ReplaceAllStringFunc(text, RedactPrefix)
+}
@@ -1,17 +1,161 @@
 package main
 
 import (
+	"errors"
+	"io"
+	"net"
+	"regexp"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
+// Errors that every Storage implementation reports, regardless of the underlying backend. Route
+// handlers depend only on these, never on backend-specific errors.
+var (
+	// ErrAccountExists is returned when creating an account with a name that's already taken.
+	ErrAccountExists = errors.New("An account with that name already exists")
+
+	// ErrAccountNotFound is returned when operating on an account that does not exist.
+	ErrAccountNotFound = errors.New("No account with that name exists")
+
+	// ErrKeyNotFound is returned when operating on an API key that isn't associated with an
+	// existing account.
+	ErrKeyNotFound = errors.New("No such API key exists for that account")
+
+	// ErrKeyRotated indicates that an API key has already been replaced by rotation.
+	ErrKeyRotated = errors.New("API key has already been rotated")
+
+	// ErrUnavailable is returned when the backend can't be reached at all.
+	ErrUnavailable = errors.New("Storage is currently unavailable")
+
+	// ErrAccountDisabled indicates that an account exists, but has been disabled.
+	ErrAccountDisabled = errors.New("Account is disabled")
+
+	// ErrInvalidCursor indicates that an account listing's pagination cursor is malformed, or was
+	// issued by a listing in a different order.
+	ErrInvalidCursor = errors.New("Pagination cursor is invalid")
+
+	// ErrResetTokenInvalid indicates that a password reset token is unknown, expired or already used.
+	ErrResetTokenInvalid = errors.New("Password reset token is invalid or has expired")
+
+	// ErrTwoFactorInvalid indicates that a TOTP code or recovery code is unknown or already used.
+	ErrTwoFactorInvalid = errors.New("Two-factor authentication code is invalid or already used")
+)
+
 // Storage provides high-level interactions with an underlying storage mechanism.
+//
+// Every method that accepts an account name returns ErrAccountNotFound if the account doesn't
+// exist, other than CreateAccount, and every method that accepts a key digest returns
+// ErrKeyNotFound if the account doesn't have the key. Any method may return ErrUnavailable if the
+// backend can't be reached.
 type Storage interface {
+	// CreateAccount persists a new account, and returns ErrAccountExists if its name is taken.
 	CreateAccount(account *Account) error
+
+	// FindAccount returns the account with a specified name.
 	FindAccount(name string) (*Account, error)
-	AddKeyToAccount(name, key string) error
-	RevokeKeyFromAccount(name, key string) error
-	AccountHasKey(name, key string) (bool, error)
+
+	// DeleteAccount removes an account along with all of its keys.
+	DeleteAccount(name string) error
+
+	// SetAccountDisabled disables or enables an account, recording the reason and time while it's
+	// disabled.
+	SetAccountDisabled(name string, disabled bool, reason string, at int64) error
+
+	// SetAdministrator grants or revokes an account's administrator status.
+	SetAdministrator(name string, admin bool) error
+
+	// HasAdministrator reports whether any enabled account is an administrator.
+	HasAdministrator() (bool, error)
+
+	// ListAccounts returns a page of the accounts that match a query, in the order that it asks
+	// for, and returns ErrInvalidCursor if its cursor is invalid.
+	ListAccounts(query AccountQuery) (AccountPage, error)
+
+	// UpdatePassword replaces an account's password hash and, if revokeKeys is true, removes every
+	// key in the same operation.
+	UpdatePassword(name string, hashed []byte, updatedAt int64, revokeKeys bool) error
+
+	// RehashPassword atomically replaces an account's password hash with an equivalent one, unless
+	// it no longer matches current, the hash that was verified, in which case it does nothing.
+	RehashPassword(name string, current, hashed []byte) error
+
+	// SetResetToken replaces an account's outstanding password reset token.
+	SetResetToken(name string, token ResetToken) error
+
+	// ResetPassword atomically consumes a reset token and replaces the account's password hash. It
+	// returns ErrResetTokenInvalid if the token doesn't match or has expired.
+	ResetPassword(name, digest string, hashed []byte, now int64) error
+
+	// AddKeyToAccount appends a newly generated key to an account.
+	AddKeyToAccount(name string, key APIKey) error
+
+	// RevokeKeyFromAccount removes a single key from an account.
+	RevokeKeyFromAccount(name, digest string) error
+
+	// RotateKey atomically adds a replacement key, and sets the expiry time of the key that it
+	// replaces and marks it as rotated. It returns ErrKeyRotated if the key was already rotated.
+	RotateKey(name, digest string, replacement APIKey, expiresAt int64) error
+
+	// RevokeAllKeys atomically removes every key from an account, leaving replacement in their
+	// place if it isn't nil, and returns the number of keys that it removed.
+	RevokeAllKeys(name string, replacement *APIKey) (int, error)
+
+	// FindKey returns an unexpired key. It returns ErrKeyNotFound for expired keys, whatever the
+	// account's state, and ErrAccountDisabled for a valid key if the account has been disabled.
+	FindKey(name, digest string) (*APIKey, error)
+
+	// TouchAPIKey records the time at which a key was last used.
+	TouchAPIKey(name, digest string, usedAt int64) error
+
+	// RemoveExpiredKeys deletes every key that expired before a given time, and returns the number
+	// of accounts that it modified.
+	RemoveExpiredKeys(before int64) (int, error)
+
+	// FindLoginFailures returns the failed login attempts counted for a source, which are zero if
+	// it has none.
+	FindLoginFailures(source string) (LoginFailures, error)
+
+	// RecordLoginFailure atomically counts a failed login attempt from a source, restarting the
+	// count if the previous failure was before resetBefore, and returns the updated count.
+	RecordLoginFailure(source string, now, resetBefore int64) (LoginFailures, error)
+
+	// ClearLoginFailures forgets the failed login attempts counted for a source.
+	ClearLoginFailures(source string) error
+
+	// RemoveLoginFailures forgets every source whose last failure was before a given time, and
+	// returns the number that it forgot.
+	RemoveLoginFailures(before int64) (int, error)
+
+	// SetTwoFactor replaces or, given nil, removes an account's TOTP enrollment.
+	SetTwoFactor(name string, twoFactor *TwoFactor) error
+
+	// UseTwoFactorStep atomically records the time step of an accepted TOTP code. It returns
+	// ErrTwoFactorInvalid if the account has no enrollment, or the step isn't later than the last
+	// one used.
+	UseTwoFactorStep(name string, step int64) error
+
+	// UseRecoveryCode atomically consumes a recovery code. It returns ErrTwoFactorInvalid if the
+	// account has no enrollment, or the code is unknown.
+	UseRecoveryCode(name, digest string) error
+
+	// RecordAuditEvent appends an event to the audit trail, which is never modified.
+	RecordAuditEvent(event AuditEvent) error
+
+	// FindAuditEvents returns the events that match a query, in the order that they happened.
+	FindAuditEvents(query AuditQuery) ([]AuditEvent, error)
+}
+
+// KeyMigrator is implemented by Storage backends that may still hold API keys in the formats
+// written by earlier versions of auth-store.
+type KeyMigrator interface {
+	// MigrateKeys converts every plaintext API key into an APIKey record, and assigns an ID to
+	// every record that lacks one, in place. It returns the number of accounts that were
+	// converted, and does nothing if there are none.
+	MigrateKeys() (int, error)
 }
 
 // MongoStorage is a Storage implementation that connects to a real MongoDB cluster.
@@ -26,52 +170,611 @@ func NewMongoStorage(c *Context) (*MongoStorage, error) {
 		return nil, err
 	}
 
-	return &MongoStorage{Database: session.DB("auth")}, nil
+	storage := &MongoStorage{Database: session.DB("auth")}
+	if err := storage.EnsureIndexes(); err != nil {
+		return nil, err
+	}
+	return storage, nil
+}
+
+// EnsureIndexes creates the indexes that account listings are sorted and filtered with, that stale
+// login failures are found with, and that the audit trail is queried with, if they don't already
+// exist. Accounts are already indexed by name, which is their _id.
+func (storage *MongoStorage) EnsureIndexes() error {
+	indexes := [][]string{
+		{"created_at", "_id"},
+		{"admin", "_id"},
+		{"disabled", "_id"},
+	}
+	for _, key := range indexes {
+		if err := storage.accounts().EnsureIndex(mgo.Index{Key: key, Background: true}); err != nil {
+			return mongoError(err)
+		}
+	}
+
+	err := storage.loginFailures().EnsureIndex(mgo.Index{
+		Key:        []string{"last_failure_at"},
+		Background: true,
+	})
+	if err != nil {
+		return mongoError(err)
+	}
+
+	for _, key := range [][]string{{"account", "time"}, {"time"}} {
+		if err := storage.auditEvents().EnsureIndex(mgo.Index{Key: key, Background: true}); err != nil {
+			return mongoError(err)
+		}
+	}
+	return nil
 }
 
 func (storage *MongoStorage) accounts() *mgo.Collection {
 	return storage.Database.C("accounts")
 }
 
+// mongoError translates errors reported by mgo into the backend-neutral Storage errors.
+// mgo.ErrNotFound is always reported as ErrAccountNotFound, so callers that can distinguish a
+// missing key must check for that first.
+func mongoError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if err == mgo.ErrNotFound {
+		return ErrAccountNotFound
+	}
+
+	if mgo.IsDup(err) {
+		return ErrAccountExists
+	}
+
+	if _, ok := err.(net.Error); ok || err == io.EOF || err.Error() == "no reachable servers" {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Unable to reach MongoDB.")
+		return ErrUnavailable
+	}
+
+	return err
+}
+
 // CreateAccount persists an Account model into Mongo as it's currently populated.
 func (storage *MongoStorage) CreateAccount(account *Account) error {
-	return storage.accounts().Insert(account)
+	return mongoError(storage.accounts().Insert(account))
 }
 
 // FindAccount queries for an existing account with a specified name. If no such account exists,
-// nil is returned.
+// ErrAccountNotFound is returned.
 func (storage *MongoStorage) FindAccount(name string) (*Account, error) {
 	var account Account
-	err := storage.accounts().FindId(name).One(&account)
+	if err := storage.accounts().FindId(name).One(&account); err != nil {
+		return nil, mongoError(err)
+	}
+	return &account, nil
+}
+
+// DeleteAccount removes an account, along with all of its API keys.
+func (storage *MongoStorage) DeleteAccount(name string) error {
+	return mongoError(storage.accounts().RemoveId(name))
+}
+
+// SetAccountDisabled disables or enables an account.
+func (storage *MongoStorage) SetAccountDisabled(name string, disabled bool, reason string, at int64) error {
+	var account Account
+	account.SetDisabled(disabled, reason, at)
+
+	return mongoError(storage.accounts().UpdateId(name, bson.M{"$set": bson.M{
+		"disabled":        account.Disabled,
+		"disabled_reason": account.DisabledReason,
+		"disabled_at":     account.DisabledAt,
+	}}))
+}
+
+// SetAdministrator grants or revokes an account's administrator status.
+func (storage *MongoStorage) SetAdministrator(name string, admin bool) error {
+	return mongoError(storage.accounts().UpdateId(name, bson.M{"$set": bson.M{"admin": admin}}))
+}
+
+// HasAdministrator returns true if any enabled account is an administrator.
+func (storage *MongoStorage) HasAdministrator() (bool, error) {
+	n, err := storage.accounts().Find(bson.M{"admin": true, "disabled": bson.M{"$ne": true}}).Count()
+	if err != nil {
+		return false, mongoError(err)
+	}
+	return n > 0, nil
+}
+
+// ListAccounts returns a page of the accounts that match a query.
+func (storage *MongoStorage) ListAccounts(query AccountQuery) (AccountPage, error) {
+	cursor, err := query.normalize()
+	if err != nil {
+		return AccountPage{}, err
+	}
+
+	var conditions []bson.M
+	if query.Prefix != "" {
+		conditions = append(conditions, bson.M{
+			"_id": bson.RegEx{Pattern: "^" + regexp.QuoteMeta(query.Prefix), Options: "i"},
+		})
+	}
+	if query.Contains != "" {
+		conditions = append(conditions, bson.M{
+			"_id": bson.RegEx{Pattern: regexp.QuoteMeta(query.Contains), Options: "i"},
+		})
+	}
+	if query.Administrator != nil {
+		conditions = append(conditions, mongoFlag("admin", *query.Administrator))
+	}
+	if query.Disabled != nil {
+		conditions = append(conditions, mongoFlag("disabled", *query.Disabled))
+	}
+	if query.CreatedAfter != 0 {
+		conditions = append(conditions, bson.M{"created_at": bson.M{"$gt": query.CreatedAfter}})
+	}
+	if query.CreatedBefore != 0 {
+		conditions = append(conditions, bson.M{"created_at": bson.M{"$lt": query.CreatedBefore}})
+	}
+
+	after, order := "$gt", ""
+	if query.Descending {
+		after, order = "$lt", "-"
+	}
+	sort := []string{order + "_id"}
+	if query.Sort == AccountSortCreated {
+		sort = []string{order + "created_at", order + "_id"}
+	}
+
+	if cursor != nil {
+		switch query.Sort {
+		case AccountSortCreated:
+			conditions = append(conditions, bson.M{"$or": []bson.M{
+				{"created_at": bson.M{after: cursor.CreatedAt}},
+				{"created_at": cursor.CreatedAt, "_id": bson.M{after: cursor.Name}},
+			}})
+		default:
+			conditions = append(conditions, bson.M{"_id": bson.M{after: cursor.Name}})
+		}
+	}
+
+	filter := bson.M{}
+	if len(conditions) > 0 {
+		filter["$and"] = conditions
+	}
+
+	var accounts []*Account
+	err = storage.accounts().Find(filter).Sort(sort...).Limit(query.Limit + 1).All(&accounts)
+	if err != nil {
+		return AccountPage{}, mongoError(err)
+	}
+	return query.page(accounts), nil
+}
+
+// mongoFlag matches documents with a boolean field set to value. Documents that predate the field
+// lack it entirely, and are treated as false.
+func mongoFlag(field string, value bool) bson.M {
+	if value {
+		return bson.M{field: true}
+	}
+	return bson.M{field: bson.M{"$ne": true}}
+}
+
+// UpdatePassword replaces an account's password hash. If revokeKeys is true, every API key on the
+// account is removed at the same time.
+func (storage *MongoStorage) UpdatePassword(name string, hashed []byte, updatedAt int64, revokeKeys bool) error {
+	update := bson.M{
+		"password":   hashed,
+		"updated_at": updatedAt,
+	}
+	if revokeKeys {
+		update["api_keys"] = []APIKey{}
+	}
+	return mongoError(storage.accounts().UpdateId(name, bson.M{"$set": update}))
+}
+
+// RehashPassword replaces an account's password hash, unless it's changed since it was verified.
+func (storage *MongoStorage) RehashPassword(name string, current, hashed []byte) error {
+	err := storage.accounts().Update(
+		bson.M{"_id": name, "password": current},
+		bson.M{"$set": bson.M{"password": hashed}},
+	)
 	if err == mgo.ErrNotFound {
-		return nil, nil
+		n, err := storage.accounts().FindId(name).Count()
+		if err != nil {
+			return mongoError(err)
+		}
+		if n == 0 {
+			return ErrAccountNotFound
+		}
+		return nil
 	}
-	return &account, err
+	return mongoError(err)
+}
+
+// SetResetToken replaces an account's outstanding password reset token.
+func (storage *MongoStorage) SetResetToken(name string, token ResetToken) error {
+	return mongoError(storage.accounts().UpdateId(name, bson.M{
+		"$set": bson.M{"password_reset": token},
+	}))
+}
+
+// ResetPassword consumes an account's password reset token and replaces its password hash.
+func (storage *MongoStorage) ResetPassword(name, digest string, hashed []byte, now int64) error {
+	err := storage.accounts().Update(bson.M{
+		"_id":                       name,
+		"password_reset.digest":     digest,
+		"password_reset.expires_at": bson.M{"$gt": now},
+	}, bson.M{
+		"$set":   bson.M{"password": hashed, "updated_at": now},
+		"$unset": bson.M{"password_reset": ""},
+	})
+	if err == mgo.ErrNotFound {
+		n, err := storage.accounts().FindId(name).Count()
+		if err != nil {
+			return mongoError(err)
+		}
+		if n == 0 {
+			return ErrAccountNotFound
+		}
+		return ErrResetTokenInvalid
+	}
+	return mongoError(err)
 }
 
 // AddKeyToAccount appends a newly generated API key to an existing account.
-func (storage *MongoStorage) AddKeyToAccount(name, key string) error {
-	return storage.accounts().UpdateId(name, bson.M{
+func (storage *MongoStorage) AddKeyToAccount(name string, key APIKey) error {
+	return mongoError(storage.accounts().UpdateId(name, bson.M{
 		"$push": bson.M{"api_keys": key},
+	}))
+}
+
+// RevokeKeyFromAccount removes the API key with a specified digest from an account.
+func (storage *MongoStorage) RevokeKeyFromAccount(name, digest string) error {
+	err := storage.accounts().Update(bson.M{
+		"_id":             name,
+		"api_keys.digest": digest,
+	}, bson.M{
+		"$pull": bson.M{"api_keys": bson.M{"digest": digest}},
+	})
+	if err == mgo.ErrNotFound {
+		return storage.keyNotFound(name)
+	}
+	return mongoError(err)
+}
+
+// RotateKey adds a replacement API key to an account and sets the expiry time of the key with a
+// specified digest. MongoDB can't modify an element of an array and append to it in the same
+// update, so the account's keys are rewritten as a whole, guarded against concurrent changes to
+// the set of keys.
+func (storage *MongoStorage) RotateKey(name, digest string, replacement APIKey, expiresAt int64) error {
+	for attempt := 0; attempt < 3; attempt++ {
+		account, err := storage.FindAccount(name)
+		if err != nil {
+			return err
+		}
+
+		digests := make([]string, len(account.APIKeys))
+		for i, key := range account.APIKeys {
+			digests[i] = key.Digest
+		}
+
+		if err := rotateKey(account, digest, replacement, expiresAt); err != nil {
+			return err
+		}
+
+		err = storage.accounts().Update(bson.M{
+			"_id":             name,
+			"api_keys.digest": bson.M{"$all": digests},
+			"api_keys":        bson.M{"$size": len(digests)},
+		}, bson.M{
+			"$set": bson.M{"api_keys": account.APIKeys},
+		})
+		if err != mgo.ErrNotFound {
+			return mongoError(err)
+		}
+	}
+	return errors.New("Unable to rotate API key: the account was modified concurrently")
+}
+
+// RevokeAllKeys removes every API key from an account. If replacement isn't nil, it becomes the
+// account's only key.
+func (storage *MongoStorage) RevokeAllKeys(name string, replacement *APIKey) (int, error) {
+	keys := []APIKey{}
+	if replacement != nil {
+		keys = append(keys, *replacement)
+	}
+
+	var previous Account
+	_, err := storage.accounts().FindId(name).Apply(mgo.Change{
+		Update: bson.M{"$set": bson.M{"api_keys": keys}},
+	}, &previous)
+	if err != nil {
+		return 0, mongoError(err)
+	}
+	return len(previous.APIKeys), nil
+}
+
+// FindKey returns the unexpired API key with the provided digest from the named account.
+func (storage *MongoStorage) FindKey(name, digest string) (*APIKey, error) {
+	var account Account
+	err := storage.accounts().Find(bson.M{
+		"_id": name,
+		"api_keys": bson.M{"$elemMatch": bson.M{
+			"digest": digest,
+			"$or": []bson.M{
+				{"expires_at": bson.M{"$in": []interface{}{0, nil}}},
+				{"expires_at": bson.M{"$gt": time.Now().UnixNano()}},
+			},
+		}},
+	}).Select(bson.M{"disabled": 1, "api_keys.$": 1}).One(&account)
+	if err == mgo.ErrNotFound {
+		// Distinguish a missing account from a missing key. Whether the account is disabled isn't
+		// revealed to anyone without a valid key.
+		err = storage.accounts().FindId(name).Select(bson.M{"_id": 1}).One(&account)
+		if err != nil {
+			return nil, mongoError(err)
+		}
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	if account.Disabled {
+		return nil, ErrAccountDisabled
+	}
+	return &account.APIKeys[0], nil
+}
+
+// RemoveExpiredKeys deletes every API key that expired before a specified time.
+func (storage *MongoStorage) RemoveExpiredKeys(before int64) (int, error) {
+	expired := bson.M{"expires_at": bson.M{"$gt": 0, "$lt": before}}
+
+	info, err := storage.accounts().UpdateAll(bson.M{
+		"api_keys": bson.M{"$elemMatch": expired},
+	}, bson.M{
+		"$pull": bson.M{"api_keys": expired},
 	})
+	if err != nil {
+		return 0, mongoError(err)
+	}
+	return info.Updated, nil
+}
+
+// loginFailures returns the collection that failed login attempts are counted in.
+func (storage *MongoStorage) loginFailures() *mgo.Collection {
+	return storage.Database.C("login_failures")
+}
+
+func (storage *MongoStorage) auditEvents() *mgo.Collection {
+	return storage.Database.C("audit_events")
 }
 
-// RevokeKeyFromAccount removes an API key from an account.
-func (storage *MongoStorage) RevokeKeyFromAccount(name, key string) error {
-	return storage.accounts().UpdateId(name, bson.M{
-		"$pull": bson.M{"api_keys": key},
+// FindLoginFailures returns the failed login attempts counted for a source.
+func (storage *MongoStorage) FindLoginFailures(source string) (LoginFailures, error) {
+	var failures LoginFailures
+	err := storage.loginFailures().FindId(source).One(&failures)
+	if err == mgo.ErrNotFound {
+		return LoginFailures{Source: source}, nil
+	}
+	if err != nil {
+		return LoginFailures{}, mongoError(err)
+	}
+	return failures, nil
+}
+
+// RecordLoginFailure counts a failed login attempt from a source. Failures are counted atomically,
+// except that concurrent failures that restart the count may each count as the first.
+func (storage *MongoStorage) RecordLoginFailure(source string, now, resetBefore int64) (LoginFailures, error) {
+	var failures LoginFailures
+	_, err := storage.loginFailures().Find(bson.M{
+		"_id":             source,
+		"last_failure_at": bson.M{"$gte": resetBefore},
+	}).Apply(mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"count": 1}, "$set": bson.M{"last_failure_at": now}},
+		ReturnNew: true,
+	}, &failures)
+	if err == mgo.ErrNotFound {
+		failures = LoginFailures{Source: source, Count: 1, LastFailureAt: now}
+		_, err = storage.loginFailures().UpsertId(source, failures)
+	}
+	if err != nil {
+		return LoginFailures{}, mongoError(err)
+	}
+	return failures, nil
+}
+
+// ClearLoginFailures forgets the failed login attempts counted for a source.
+func (storage *MongoStorage) ClearLoginFailures(source string) error {
+	err := storage.loginFailures().RemoveId(source)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return mongoError(err)
+}
+
+// RemoveLoginFailures forgets every source whose last failed login attempt was before a specified
+// time.
+func (storage *MongoStorage) RemoveLoginFailures(before int64) (int, error) {
+	info, err := storage.loginFailures().RemoveAll(bson.M{"last_failure_at": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, mongoError(err)
+	}
+	return info.Removed, nil
+}
+
+// SetTwoFactor replaces or removes an account's TOTP enrollment.
+func (storage *MongoStorage) SetTwoFactor(name string, twoFactor *TwoFactor) error {
+	update := bson.M{"$set": bson.M{"two_factor": twoFactor}}
+	if twoFactor == nil {
+		update = bson.M{"$unset": bson.M{"two_factor": ""}}
+	}
+	return mongoError(storage.accounts().UpdateId(name, update))
+}
+
+// UseTwoFactorStep records the time step of an accepted TOTP code, unless it's already been used.
+func (storage *MongoStorage) UseTwoFactorStep(name string, step int64) error {
+	err := storage.accounts().Update(bson.M{
+		"_id":                  name,
+		"two_factor.last_step": bson.M{"$lt": step},
+	}, bson.M{
+		"$set": bson.M{"two_factor.last_step": step},
 	})
+	if err == mgo.ErrNotFound {
+		return storage.twoFactorInvalid(name)
+	}
+	return mongoError(err)
 }
 
-// AccountHasKey returns true if the named account has an associated API key that matches the
-// provided one, or false if it does not.
-func (storage *MongoStorage) AccountHasKey(name, key string) (bool, error) {
-	n, err := storage.accounts().Find(bson.M{
-		"_id":      name,
-		"api_keys": key,
-	}).Count()
+// UseRecoveryCode consumes one of an account's recovery codes.
+func (storage *MongoStorage) UseRecoveryCode(name, digest string) error {
+	err := storage.accounts().Update(bson.M{
+		"_id":                       name,
+		"two_factor.recovery_codes": digest,
+	}, bson.M{
+		"$pull": bson.M{"two_factor.recovery_codes": digest},
+	})
+	if err == mgo.ErrNotFound {
+		return storage.twoFactorInvalid(name)
+	}
+	return mongoError(err)
+}
+
+// RecordAuditEvent appends an event to the audit trail.
+func (storage *MongoStorage) RecordAuditEvent(event AuditEvent) error {
+	return mongoError(storage.auditEvents().Insert(event))
+}
+
+// FindAuditEvents returns the events in the audit trail that match a query.
+func (storage *MongoStorage) FindAuditEvents(query AuditQuery) ([]AuditEvent, error) {
+	query.normalize()
+
+	filter := bson.M{}
+	if query.Account != "" {
+		filter["account"] = query.Account
+	}
+	if query.Since != 0 || query.Until != 0 {
+		between := bson.M{}
+		if query.Since != 0 {
+			between["$gte"] = query.Since
+		}
+		if query.Until != 0 {
+			between["$lt"] = query.Until
+		}
+		filter["time"] = between
+	}
+
+	var events []AuditEvent
+	err := storage.auditEvents().Find(filter).Sort("time").Limit(query.Limit).All(&events)
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	return events, nil
+}
+
+// twoFactorInvalid determines whether a failed two-factor update was caused by a missing account
+// or an invalid code.
+func (storage *MongoStorage) twoFactorInvalid(name string) error {
+	n, err := storage.accounts().FindId(name).Count()
+	if err != nil {
+		return mongoError(err)
+	}
+	if n == 0 {
+		return ErrAccountNotFound
+	}
+	return ErrTwoFactorInvalid
+}
 
-	return n == 1, err
+// keyNotFound distinguishes between a missing account and a missing key after an update that
+// selected on both failed to match.
+func (storage *MongoStorage) keyNotFound(name string) error {
+	n, err := storage.accounts().FindId(name).Count()
+	if err != nil {
+		return mongoError(err)
+	}
+	if n == 0 {
+		return ErrAccountNotFound
+	}
+	return ErrKeyNotFound
+}
+
+// TouchAPIKey records the time at which an API key was last used.
+func (storage *MongoStorage) TouchAPIKey(name, digest string, usedAt int64) error {
+	err := storage.accounts().Update(bson.M{
+		"_id":             name,
+		"api_keys.digest": digest,
+	}, bson.M{
+		"$set": bson.M{"api_keys.$.last_used_at": usedAt},
+	})
+	if err == mgo.ErrNotFound {
+		return storage.keyNotFound(name)
+	}
+	return mongoError(err)
+}
+
+// MigrateKeys converts the plaintext API keys stored by earlier versions of auth-store into APIKey
+// records, and assigns IDs to records that predate them.
+func (storage *MongoStorage) MigrateKeys() (int, error) {
+	// BSON type 2 is a string. Only accounts with at least one plaintext or unidentified key will
+	// match.
+	iter := storage.accounts().Find(bson.M{
+		"$or": []bson.M{
+			{"api_keys": bson.M{"$type": 2}},
+			{"api_keys": bson.M{"$elemMatch": bson.M{"id": bson.M{"$exists": false}}}},
+		},
+	}).Select(bson.M{"api_keys": 1}).Iter()
+
+	var doc struct {
+		Name    string        `bson:"_id"`
+		APIKeys []interface{} `bson:"api_keys"`
+	}
+
+	n := 0
+	for iter.Next(&doc) {
+		keys := make([]interface{}, len(doc.APIKeys))
+		for i, key := range doc.APIKeys {
+			keys[i] = migrateKey(key)
+		}
+
+		// Only replace the keys if they haven't changed since they were read.
+		err := storage.accounts().Update(bson.M{
+			"_id":      doc.Name,
+			"api_keys": doc.APIKeys,
+		}, bson.M{
+			"$set": bson.M{"api_keys": keys},
+		})
+		if err != nil && err != mgo.ErrNotFound {
+			iter.Close()
+			return n, mongoError(err)
+		}
+		if err == nil {
+			n++
+		}
+
+		doc.APIKeys = nil
+	}
+
+	return n, mongoError(iter.Close())
+}
+
+// Ensure that MongoStorage obeys the Storage and KeyMigrator interfaces.
+var (
+	_ Storage     = &MongoStorage{}
+	_ KeyMigrator = &MongoStorage{}
+)
+
+// migrateKey brings a single decoded API key up to date. Plaintext keys are replaced by their
+// APIKey records, and records without an ID are assigned one.
+func migrateKey(key interface{}) interface{} {
+	switch k := key.(type) {
+	case string:
+		return apiKeyRecord(k)
+	case bson.M:
+		if _, ok := k["id"]; !ok {
+			digest, _ := k["digest"].(string)
+			k["id"] = APIKeyID(digest)
+		}
+		return k
+	}
+	return key
 }
 
 // NullStorage provides no-op implementations of Storage methods. It's useful for selective
@@ -85,22 +788,132 @@ func (storage NullStorage) CreateAccount(*Account) error {
 
 // FindAccount always fails to find an account.
 func (storage NullStorage) FindAccount(name string) (*Account, error) {
-	return nil, nil
+	return nil, ErrAccountNotFound
+}
+
+// DeleteAccount is a no-op.
+func (storage NullStorage) DeleteAccount(name string) error {
+	return nil
+}
+
+// SetAccountDisabled is a no-op.
+func (storage NullStorage) SetAccountDisabled(name string, disabled bool, reason string, at int64) error {
+	return nil
+}
+
+// SetAdministrator is a no-op.
+func (storage NullStorage) SetAdministrator(name string, admin bool) error {
+	return nil
+}
+
+// HasAdministrator always returns false.
+func (storage NullStorage) HasAdministrator() (bool, error) {
+	return false, nil
+}
+
+// ListAccounts always returns no accounts.
+func (storage NullStorage) ListAccounts(query AccountQuery) (AccountPage, error) {
+	return AccountPage{}, nil
+}
+
+// UpdatePassword is a no-op.
+func (storage NullStorage) UpdatePassword(name string, hashed []byte, updatedAt int64, revokeKeys bool) error {
+	return nil
+}
+
+// SetResetToken is a no-op.
+func (storage NullStorage) SetResetToken(name string, token ResetToken) error {
+	return nil
+}
+
+// ResetPassword always returns ErrResetTokenInvalid.
+func (storage NullStorage) ResetPassword(name, digest string, hashed []byte, now int64) error {
+	return ErrResetTokenInvalid
 }
 
 // AddKeyToAccount is a no-op.
-func (storage NullStorage) AddKeyToAccount(name, key string) error {
+func (storage NullStorage) AddKeyToAccount(name string, key APIKey) error {
 	return nil
 }
 
 // RevokeKeyFromAccount is a no-op.
-func (storage NullStorage) RevokeKeyFromAccount(name, key string) error {
+func (storage NullStorage) RevokeKeyFromAccount(name, digest string) error {
 	return nil
 }
 
-// AccountHasKey always returns false.
-func (storage NullStorage) AccountHasKey(name, key string) (bool, error) {
-	return false, nil
+// RevokeAllKeys is a no-op.
+func (storage NullStorage) RevokeAllKeys(name string, replacement *APIKey) (int, error) {
+	return 0, nil
+}
+
+// FindKey always returns ErrKeyNotFound.
+func (storage NullStorage) FindKey(name, digest string) (*APIKey, error) {
+	return nil, ErrKeyNotFound
+}
+
+// TouchAPIKey is a no-op.
+func (storage NullStorage) TouchAPIKey(name, digest string, usedAt int64) error {
+	return nil
+}
+
+// RotateKey is a no-op.
+func (storage NullStorage) RotateKey(name, digest string, replacement APIKey, expiresAt int64) error {
+	return nil
+}
+
+// RemoveExpiredKeys is a no-op.
+func (storage NullStorage) RemoveExpiredKeys(before int64) (int, error) {
+	return 0, nil
+}
+
+// FindLoginFailures always returns no failures.
+func (storage NullStorage) FindLoginFailures(source string) (LoginFailures, error) {
+	return LoginFailures{Source: source}, nil
+}
+
+// RecordLoginFailure always returns a single failure.
+func (storage NullStorage) RecordLoginFailure(source string, now, resetBefore int64) (LoginFailures, error) {
+	return LoginFailures{Source: source, Count: 1, LastFailureAt: now}, nil
+}
+
+// ClearLoginFailures is a no-op.
+func (storage NullStorage) ClearLoginFailures(source string) error {
+	return nil
+}
+
+// RemoveLoginFailures is a no-op.
+func (storage NullStorage) RemoveLoginFailures(before int64) (int, error) {
+	return 0, nil
+}
+
+// RehashPassword is a no-op.
+func (storage NullStorage) RehashPassword(name string, current, hashed []byte) error {
+	return nil
+}
+
+// SetTwoFactor is a no-op.
+func (storage NullStorage) SetTwoFactor(name string, twoFactor *TwoFactor) error {
+	return nil
+}
+
+// UseTwoFactorStep is a no-op.
+func (storage NullStorage) UseTwoFactorStep(name string, step int64) error {
+	return nil
+}
+
+// UseRecoveryCode is a no-op.
+func (storage NullStorage) UseRecoveryCode(name, digest string) error {
+	return nil
+}
+
+// RecordAuditEvent is a no-op.
+func (storage NullStorage) RecordAuditEvent(event AuditEvent) error {
+	return nil
+}
+
+// FindAuditEvents always returns no events.
+func (storage NullStorage) FindAuditEvents(query AuditQuery) ([]AuditEvent, error) {
+	return nil, nil
 }
 
 // Ensure that NullStorage obeys the Storage interface.
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	accountsBucket = []byte("accounts")
+	failuresBucket = []byte("login_failures")
+	auditBucket    = []byte("audit_events")
+)
+
+// BoltStorage is a Storage implementation that persists accounts to a single BoltDB file. It's
+// intended for small installations that don't want to operate a MongoDB cluster.
+type BoltStorage struct {
+	DB *bolt.DB
+}
+
+// NewBoltStorage opens (or creates) the BoltDB file at the configured path.
+func NewBoltStorage(c *Context) (*BoltStorage, error) {
+	db, err := bolt.Open(c.BoltPath, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{accountsBucket, failuresBucket, auditBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStorage{DB: db}, nil
+}
+
+// getAccount reads and decodes an account within a transaction.
+func getAccount(tx *bolt.Tx, name string) (*Account, error) {
+	data := tx.Bucket(accountsBucket).Get([]byte(name))
+	if data == nil {
+		return nil, ErrAccountNotFound
+	}
+	return decodeAccount(data)
+}
+
+// decodeAccount decodes an account from a copy of its stored document. bolt's values are only valid
+// until their transaction ends, and the decoder leaves []byte fields like HashedPassword pointing
+// into its input.
+func decodeAccount(data []byte) (*Account, error) {
+	var account Account
+	if err := bson.Unmarshal(append([]byte(nil), data...), &account); err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// putAccount encodes and writes an account within a transaction.
+func putAccount(tx *bolt.Tx, account *Account) error {
+	data, err := bson.Marshal(account)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(accountsBucket).Put([]byte(account.Name), data)
+}
+
+// boltError translates errors reported by bolt into the backend-neutral Storage errors.
+func boltError(err error) error {
+	if err == bolt.ErrDatabaseNotOpen || err == bolt.ErrTimeout {
+		return ErrUnavailable
+	}
+	return err
+}
+
+// updateAccount applies a modification to an existing account within a single read-write
+// transaction. If modify returns an error, the transaction is rolled back.
+func (storage *BoltStorage) updateAccount(name string, modify func(*Account) error) error {
+	return boltError(storage.DB.Update(func(tx *bolt.Tx) error {
+		account, err := getAccount(tx, name)
+		if err != nil {
+			return err
+		}
+
+		if err := modify(account); err != nil {
+			return err
+		}
+		return putAccount(tx, account)
+	}))
+}
+
+// CreateAccount persists an Account model as it's currently populated.
+func (storage *BoltStorage) CreateAccount(account *Account) error {
+	return boltError(storage.DB.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(accountsBucket).Get([]byte(account.Name)) != nil {
+			return ErrAccountExists
+		}
+		return putAccount(tx, account)
+	}))
+}
+
+// FindAccount queries for an existing account with a specified name.
+func (storage *BoltStorage) FindAccount(name string) (*Account, error) {
+	var account *Account
+	err := storage.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		account, err = getAccount(tx, name)
+		return err
+	})
+	return account, boltError(err)
+}
+
+// DeleteAccount removes an account, along with all of its API keys.
+func (storage *BoltStorage) DeleteAccount(name string) error {
+	return boltError(storage.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(accountsBucket)
+		if b.Get([]byte(name)) == nil {
+			return ErrAccountNotFound
+		}
+		return b.Delete([]byte(name))
+	}))
+}
+
+// SetAccountDisabled disables or enables an account.
+func (storage *BoltStorage) SetAccountDisabled(name string, disabled bool, reason string, at int64) error {
+	return storage.updateAccount(name, func(account *Account) error {
+		account.SetDisabled(disabled, reason, at)
+		return nil
+	})
+}
+
+// SetAdministrator grants or revokes an account's administrator status.
+func (storage *BoltStorage) SetAdministrator(name string, admin bool) error {
+	return storage.updateAccount(name, func(account *Account) error {
+		account.Administrator = admin
+		return nil
+	})
+}
+
+// HasAdministrator returns true if any enabled account is an administrator.
+func (storage *BoltStorage) HasAdministrator() (bool, error) {
+	found := false
+	err := storage.DB.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(accountsBucket).Cursor()
+		for name, data := c.First(); name != nil && !found; name, data = c.Next() {
+			account, err := decodeAccount(data)
+			if err != nil {
+				return err
+			}
+			found = account.Administrator && !account.Disabled
+		}
+		return nil
+	})
+	return found, boltError(err)
+}
+
+// ListAccounts returns a page of the accounts that match a query. Every account is read to build
+// it, which is acceptable for the small installations that bolt is suited to.
+func (storage *BoltStorage) ListAccounts(query AccountQuery) (AccountPage, error) {
+	var accounts []*Account
+	err := storage.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(accountsBucket).ForEach(func(name, data []byte) error {
+			account, err := decodeAccount(data)
+			if err != nil {
+				return err
+			}
+			accounts = append(accounts, account)
+			return nil
+		})
+	})
+	if err != nil {
+		return AccountPage{}, boltError(err)
+	}
+	return queryAccounts(accounts, query)
+}
+
+// UpdatePassword replaces an account's password hash. If revokeKeys is true, every API key on the
+// account is removed at the same time.
+func (storage *BoltStorage) UpdatePassword(name string, hashed []byte, updatedAt int64, revokeKeys bool) error {
+	return storage.updateAccount(name, func(account *Account) error {
+		updatePassword(account, hashed, updatedAt, revokeKeys)
+		return nil
+	})
+}
+
+// RehashPassword replaces an account's password hash, unless it's changed since it was verified.
+func (storage *BoltStorage) RehashPassword(name string, current, hashed []byte) error {
+	return storage.updateAccount(name, func(account *Account) error {
+		if bytes.Equal(account.HashedPassword, current) {
+			account.HashedPassword = hashed
+		}
+		return nil
+	})
+}
+
+// SetResetToken replaces an account's outstanding password reset token.
+func (storage *BoltStorage) SetResetToken(name string, token ResetToken) error {
+	return storage.updateAccount(name, func(account *Account) error {
+		account.PasswordReset = &token
+		return nil
+	})
+}
+
+// ResetPassword consumes an account's password reset token and replaces its password hash.
+func (storage *BoltStorage) ResetPassword(name, digest string, hashed []byte, now int64) error {
+	return storage.updateAccount(name, func(account *Account) error {
+		return resetPassword(account, digest, hashed, now)
+	})
+}
+
+// SetTwoFactor replaces or removes an account's TOTP enrollment.
+func (storage *BoltStorage) SetTwoFactor(name string, twoFactor *TwoFactor) error {
+	return storage.updateAccount(name, func(account *Account) error {
+		account.TwoFactor = twoFactor
+		return nil
+	})
+}
+
+// UseTwoFactorStep records the time step of an accepted TOTP code, unless it's already been used.
+func (storage *BoltStorage) UseTwoFactorStep(name string, step int64) error {
+	return storage.updateAccount(name, func(account *Account) error {
+		return useTwoFactorStep(account, step)
+	})
+}
+
+// UseRecoveryCode consumes one of an account's recovery codes.
+func (storage *BoltStorage) UseRecoveryCode(name, digest string) error {
+	return storage.updateAccount(name, func(account *Account) error {
+		return useRecoveryCode(account, digest)
+	})
+}
+
+// AddKeyToAccount appends a newly generated API key to an existing account.
+func (storage *BoltStorage) AddKeyToAccount(name string, key APIKey) error {
+	return storage.updateAccount(name, func(account *Account) error {
+		account.APIKeys = append(account.APIKeys, key)
+		return nil
+	})
+}
+
+// RevokeKeyFromAccount removes the API key with a specified digest from an account.
+func (storage *BoltStorage) RevokeKeyFromAccount(name, digest string) error {
+	return storage.updateAccount(name, func(account *Account) error {
+		for i, existing := range account.APIKeys {
+			if existing.Digest == digest {
+				account.APIKeys = append(account.APIKeys[:i], account.APIKeys[i+1:]...)
+				return nil
+			}
+		}
+		return ErrKeyNotFound
+	})
+}
+
+// RotateKey adds a replacement API key to an account and sets the expiry time of the key with a
+// specified digest.
+func (storage *BoltStorage) RotateKey(name, digest string, replacement APIKey, expiresAt int64) error {
+	return storage.updateAccount(name, func(account *Account) error {
+		return rotateKey(account, digest, replacement, expiresAt)
+	})
+}
+
+// RevokeAllKeys removes every API key from an account. If replacement isn't nil, it becomes the
+// account's only key.
+func (storage *BoltStorage) RevokeAllKeys(name string, replacement *APIKey) (int, error) {
+	n := 0
+	err := storage.updateAccount(name, func(account *Account) error {
+		n = revokeAllKeys(account, replacement)
+		return nil
+	})
+	return n, err
+}
+
+// TouchAPIKey records the time at which an API key was last used.
+func (storage *BoltStorage) TouchAPIKey(name, digest string, usedAt int64) error {
+	return storage.updateAccount(name, func(account *Account) error {
+		for i := range account.APIKeys {
+			if account.APIKeys[i].Digest == digest {
+				account.APIKeys[i].LastUsedAt = usedAt
+				return nil
+			}
+		}
+		return ErrKeyNotFound
+	})
+}
+
+// FindKey returns the unexpired API key with the provided digest from the named account.
+func (storage *BoltStorage) FindKey(name, digest string) (*APIKey, error) {
+	account, err := storage.FindAccount(name)
+	if err != nil {
+		return nil, err
+	}
+	return findValidKey(account, digest, time.Now().UnixNano())
+}
+
+// RemoveExpiredKeys deletes every API key that expired before a specified time. Every account is
+// updated within a single transaction.
+func (storage *BoltStorage) RemoveExpiredKeys(before int64) (int, error) {
+	n := 0
+	err := storage.DB.Update(func(tx *bolt.Tx) error {
+		var modified []*Account
+		err := tx.Bucket(accountsBucket).ForEach(func(name, data []byte) error {
+			account, err := decodeAccount(data)
+			if err != nil {
+				return err
+			}
+			if removeExpiredKeys(account, before) {
+				modified = append(modified, account)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, account := range modified {
+			if err := putAccount(tx, account); err != nil {
+				return err
+			}
+		}
+		n = len(modified)
+		return nil
+	})
+	return n, boltError(err)
+}
+
+// MigrateKeys converts the plaintext API keys stored by earlier versions of auth-store into APIKey
+// records, and assigns IDs to records that predate them. Every account is converted within a single
+// transaction.
+func (storage *BoltStorage) MigrateKeys() (int, error) {
+	n := 0
+	err := storage.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(accountsBucket)
+
+		// Collect the converted documents first: bolt doesn't permit modifying a bucket while
+		// iterating over it.
+		converted := make(map[string][]byte)
+		err := b.ForEach(func(name, data []byte) error {
+			var doc bson.M
+			if err := bson.Unmarshal(data, &doc); err != nil {
+				return err
+			}
+
+			keys, _ := doc["api_keys"].([]interface{})
+			changed := false
+			for i, key := range keys {
+				if m, ok := key.(bson.M); ok && m["id"] != nil {
+					continue
+				}
+				keys[i] = migrateKey(key)
+				changed = true
+			}
+			if !changed {
+				return nil
+			}
+
+			data, err := bson.Marshal(doc)
+			if err != nil {
+				return err
+			}
+			converted[string(name)] = data
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for name, data := range converted {
+			if err := b.Put([]byte(name), data); err != nil {
+				return err
+			}
+		}
+		n = len(converted)
+		return nil
+	})
+	return n, boltError(err)
+}
+
+// Ensure that BoltStorage obeys the Storage and KeyMigrator interfaces.
+var (
+	_ Storage     = &BoltStorage{}
+	_ KeyMigrator = &BoltStorage{}
+)
+
+// getLoginFailures reads and decodes the failed login attempts counted for a source within a
+// transaction.
+func getLoginFailures(tx *bolt.Tx, source string) (LoginFailures, error) {
+	failures := LoginFailures{Source: source}
+	data := tx.Bucket(failuresBucket).Get([]byte(source))
+	if data == nil {
+		return failures, nil
+	}
+	err := bson.Unmarshal(data, &failures)
+	return failures, err
+}
+
+// FindLoginFailures returns the failed login attempts counted for a source.
+func (storage *BoltStorage) FindLoginFailures(source string) (LoginFailures, error) {
+	var failures LoginFailures
+	err := storage.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		failures, err = getLoginFailures(tx, source)
+		return err
+	})
+	return failures, boltError(err)
+}
+
+// RecordLoginFailure counts a failed login attempt from a source.
+func (storage *BoltStorage) RecordLoginFailure(source string, now, resetBefore int64) (LoginFailures, error) {
+	var failures LoginFailures
+	err := storage.DB.Update(func(tx *bolt.Tx) error {
+		existing, err := getLoginFailures(tx, source)
+		if err != nil {
+			return err
+		}
+		failures = recordLoginFailure(existing, source, now, resetBefore)
+
+		data, err := bson.Marshal(failures)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(failuresBucket).Put([]byte(source), data)
+	})
+	return failures, boltError(err)
+}
+
+// ClearLoginFailures forgets the failed login attempts counted for a source.
+func (storage *BoltStorage) ClearLoginFailures(source string) error {
+	return boltError(storage.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(failuresBucket).Delete([]byte(source))
+	}))
+}
+
+// RemoveLoginFailures forgets every source whose last failed login attempt was before a specified
+// time.
+func (storage *BoltStorage) RemoveLoginFailures(before int64) (int, error) {
+	n := 0
+	err := storage.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(failuresBucket)
+
+		var stale [][]byte
+		err := b.ForEach(func(source, data []byte) error {
+			var failures LoginFailures
+			if err := bson.Unmarshal(data, &failures); err != nil {
+				return err
+			}
+			if failures.LastFailureAt < before {
+				stale = append(stale, append([]byte(nil), source...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, source := range stale {
+			if err := b.Delete(source); err != nil {
+				return err
+			}
+		}
+		n = len(stale)
+		return nil
+	})
+	return n, boltError(err)
+}
+
+// RecordAuditEvent appends an event to the audit trail. Events are keyed by the bucket's sequence
+// number, so they're stored in the order that they were recorded.
+func (storage *BoltStorage) RecordAuditEvent(event AuditEvent) error {
+	return boltError(storage.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(auditBucket)
+
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+
+		data, err := bson.Marshal(event)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, data)
+	}))
+}
+
+// FindAuditEvents returns the events in the audit trail that match a query. Bolt has no secondary
+// indexes, so every event is scanned.
+func (storage *BoltStorage) FindAuditEvents(query AuditQuery) ([]AuditEvent, error) {
+	var events []AuditEvent
+	err := storage.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(auditBucket).ForEach(func(key, data []byte) error {
+			var event AuditEvent
+			if err := bson.Unmarshal(data, &event); err != nil {
+				return err
+			}
+			if query.matches(event) {
+				events = append(events, event)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, boltError(err)
+	}
+	return queryAuditEvents(events, query), nil
+}
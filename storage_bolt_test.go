@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TempBoltStorage(t *testing.T) (*BoltStorage, func()) {
+	dir, err := ioutil.TempDir("", "auth-store-bolt")
+	if err != nil {
+		t.Fatalf("Unable to create a temporary directory: %v", err)
+	}
+
+	c := &Context{Settings: Settings{BoltPath: filepath.Join(dir, "auth.db")}}
+	s, err := NewBoltStorage(c)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Unable to open BoltDB storage: %v", err)
+	}
+
+	return s, func() {
+		s.DB.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBoltStorageConformance(t *testing.T) {
+	StorageConformance(t, func(t *testing.T) (Storage, func()) {
+		return TempBoltStorage(t)
+	})
+}
+
+func TestBoltStoragePersistence(t *testing.T) {
+	s, cleanup := TempBoltStorage(t)
+	defer cleanup()
+
+	a, err := NewAccount(testHasher, "someone", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+	if err := s.CreateAccount(a); err != nil {
+		t.Fatalf("Unexpected error creating account: %v", err)
+	}
+	if err := s.AddKeyToAccount("someone", apiKeyRecord("123abc")); err != nil {
+		t.Fatalf("Unexpected error adding a key: %v", err)
+	}
+
+	path := s.DB.Path()
+	s.DB.Close()
+
+	reopened, err := NewBoltStorage(&Context{Settings: Settings{BoltPath: path}})
+	if err != nil {
+		t.Fatalf("Unable to reopen BoltDB storage: %v", err)
+	}
+	s.DB = reopened.DB
+
+	if _, err := s.FindKey("someone", DigestAPIKey("123abc")); err != nil {
+		t.Errorf("Expected key to survive reopening the database, but got: %v", err)
+	}
+}
+
+func TestBoltStorageAccountOutlivesTransaction(t *testing.T) {
+	s, cleanup := TempBoltStorage(t)
+	defer cleanup()
+
+	a, err := NewAccount(testHasher, "someone", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+	if err := s.CreateAccount(a); err != nil {
+		t.Fatalf("Unexpected error creating account: %v", err)
+	}
+
+	found, err := s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+
+	// Grow the file well past its initial size, so that bolt remaps it and the pages that the
+	// account was read from are no longer mapped.
+	err = s.DB.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("padding"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 8; i++ {
+			if err := b.Put([]byte{byte(i)}, make([]byte, 1<<20)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to grow the database: %v", err)
+	}
+
+	if !found.HasPassword("secret") {
+		t.Error("Expected the account read before the remap to keep its password hash")
+	}
+}
+
+func TestBoltStorageMigrateKeys(t *testing.T) {
+	s, cleanup := TempBoltStorage(t)
+	defer cleanup()
+
+	// Store an account the way that earlier versions did, with one API key in plaintext and one
+	// stored without an ID.
+	legacy := bson.M{
+		"_id":      "someone",
+		"password": []byte("hashed"),
+		"api_keys": []interface{}{
+			"123abc",
+			bson.M{"prefix": "456def", "digest": DigestAPIKey("456def")},
+		},
+		"created_at": int64(1),
+		"updated_at": int64(1),
+	}
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		data, err := bson.Marshal(legacy)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(accountsBucket).Put([]byte("someone"), data)
+	})
+	if err != nil {
+		t.Fatalf("Unable to store legacy account: %v", err)
+	}
+
+	n, err := s.MigrateKeys()
+	if err != nil {
+		t.Fatalf("Unexpected error migrating keys: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("Expected 1 account to be converted, but %d were", n)
+	}
+
+	found, err := s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find migrated account: %v", err)
+	}
+	for i, key := range []string{"123abc", "456def"} {
+		if found.APIKeys[i].Digest != DigestAPIKey(key) {
+			t.Errorf("Expected migrated key [%s] to be present, but found %v", key, found.APIKeys[i])
+		}
+		if found.APIKeys[i].ID != APIKeyID(DigestAPIKey(key)) {
+			t.Errorf("Expected migrated key [%s] to be assigned an ID, but found %v", key, found.APIKeys[i])
+		}
+	}
+
+	if n, err := s.MigrateKeys(); n != 0 || err != nil {
+		t.Errorf("Expected a second migration to do nothing, but got (%d, %v)", n, err)
+	}
+}
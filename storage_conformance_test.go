@@ -0,0 +1,1218 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// StorageFactory creates a fresh, empty Storage for a single conformance check. The returned
+// cleanup function releases any resources that the Storage holds.
+type StorageFactory func(t *testing.T) (Storage, func())
+
+// StorageConformance verifies that a Storage implementation honors the contract that the route
+// handlers depend on. Each check runs against a fresh Storage produced by factory. Every backend
+// should pass this suite before it's used as a drop-in replacement for MongoStorage.
+func StorageConformance(t *testing.T, factory StorageFactory) {
+	checks := []struct {
+		name  string
+		check func(t *testing.T, s Storage)
+	}{
+		{"create and find an account", conformCreateAndFind},
+		{"find a missing account", conformFindMissing},
+		{"reject a duplicate account", conformDuplicateAccount},
+		{"delete an account", conformDeleteAccount},
+		{"disable and enable an account", conformDisableAccount},
+		{"grant and revoke administrator status", conformSetAdministrator},
+		{"detect an administrator", conformHasAdministrator},
+		{"list accounts", conformListAccounts},
+		{"list accounts with filters", conformListAccountsFiltered},
+		{"list accounts a page at a time", conformListAccountsPaginated},
+		{"change a password", conformUpdatePassword},
+		{"change a password and revoke keys", conformUpdatePasswordRevokingKeys},
+		{"rehash a password", conformRehashPassword},
+		{"reset a password", conformResetPassword},
+		{"reject an invalid reset token", conformResetPasswordInvalidToken},
+		{"enroll in two-factor authentication", conformSetTwoFactor},
+		{"use each TOTP step once", conformUseTwoFactorStep},
+		{"use each recovery code once", conformUseRecoveryCode},
+		{"add a key", conformAddKey},
+		{"add a key to a missing account", conformAddKeyMissingAccount},
+		{"revoke a key", conformRevokeKey},
+		{"revoke an unknown key", conformRevokeUnknownKey},
+		{"revoke a key from a missing account", conformRevokeMissingAccount},
+		{"revoke every key", conformRevokeAllKeys},
+		{"revoke every key and replace them", conformRevokeAllKeysWithReplacement},
+		{"find a key", conformFindKey},
+		{"find a key on a missing account", conformFindKeyMissingAccount},
+		{"rotate a key", conformRotateKey},
+		{"rotate an unknown key", conformRotateUnknownKey},
+		{"record key usage", conformTouchKey},
+		{"append keys concurrently", conformConcurrentKeyAppends},
+		{"reject an expired key", conformExpiredKey},
+		{"remove expired keys", conformRemoveExpiredKeys},
+		{"count login failures", conformLoginFailures},
+		{"remove stale login failures", conformRemoveLoginFailures},
+		{"record and query audit events", conformAuditEvents},
+	}
+
+	for _, c := range checks {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			s, cleanup := factory(t)
+			defer cleanup()
+			c.check(t, s)
+		})
+	}
+}
+
+// conformHasKey reports whether an account has a valid API key with the provided digest, treating
+// missing accounts and keys as an ordinary negative result.
+func conformHasKey(s Storage, name, digest string) (bool, error) {
+	_, err := s.FindKey(name, digest)
+	if err == ErrAccountNotFound || err == ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// conformAccount creates and stores an account with a known password and a single API key.
+func conformAccount(t *testing.T, s Storage, name string) *Account {
+	account, err := NewAccount(testHasher, name, "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+
+	if err := s.CreateAccount(account); err != nil {
+		t.Fatalf("Unexpected error storing account [%s]: %v", name, err)
+	}
+	return account
+}
+
+func conformCreateAndFind(t *testing.T, s Storage) {
+	account, err := NewAccount(testHasher, "someone@example.com", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+	account.Administrator = true
+
+	if err := s.CreateAccount(account); err != nil {
+		t.Fatalf("Unexpected error storing account: %v", err)
+	}
+
+	found, err := s.FindAccount("someone@example.com")
+	if err != nil {
+		t.Fatalf("Unexpected error finding account: %v", err)
+	}
+	if found == nil {
+		t.Fatal("Expected to find the stored account")
+	}
+
+	if found.Name != account.Name {
+		t.Errorf("Found account had unexpected name: [%s]", found.Name)
+	}
+	if !found.HasPassword("secret") {
+		t.Error("Found account did not accept its password")
+	}
+	if !found.Administrator {
+		t.Error("Found account lost its administrator flag")
+	}
+	if found.CreatedAt != account.CreatedAt || found.UpdatedAt != account.UpdatedAt {
+		t.Errorf("Found account had unexpected timestamps: %d/%d != %d/%d",
+			found.CreatedAt, found.UpdatedAt, account.CreatedAt, account.UpdatedAt)
+	}
+	if !reflect.DeepEqual(found.APIKeys, account.APIKeys) {
+		t.Errorf("Found account had unexpected API keys: %v", found.APIKeys)
+	}
+}
+
+func conformFindMissing(t *testing.T, s Storage) {
+	found, err := s.FindAccount("nobody")
+	if err != ErrAccountNotFound {
+		t.Errorf("Expected ErrAccountNotFound, but got: %v", err)
+	}
+	if found != nil {
+		t.Errorf("Expected no account, but found [%s]", found.Name)
+	}
+}
+
+func conformDuplicateAccount(t *testing.T, s Storage) {
+	conformAccount(t, s, "someone")
+
+	duplicate, err := NewAccount(testHasher, "someone", "other")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+
+	if err := s.CreateAccount(duplicate); err != ErrAccountExists {
+		t.Errorf("Expected ErrAccountExists, but got: %v", err)
+	}
+
+	found, err := s.FindAccount("someone")
+	if err != nil || found == nil {
+		t.Fatalf("Unable to find the original account: (%v, %v)", found, err)
+	}
+	if !found.HasPassword("secret") {
+		t.Error("Duplicate account overwrote the original")
+	}
+}
+
+func conformDeleteAccount(t *testing.T, s Storage) {
+	account := conformAccount(t, s, "someone")
+	conformAccount(t, s, "other")
+
+	if err := s.DeleteAccount("someone"); err != nil {
+		t.Fatalf("Unexpected error deleting an account: %v", err)
+	}
+
+	if _, err := s.FindAccount("someone"); err != ErrAccountNotFound {
+		t.Errorf("Expected a deleted account to be missing, but got: %v", err)
+	}
+	if ok, err := conformHasKey(s, "someone", account.APIKeys[0].Digest); ok || err != nil {
+		t.Errorf("Expected a deleted account's keys to be invalid, but got (%v, %v)", ok, err)
+	}
+	if _, err := s.FindAccount("other"); err != nil {
+		t.Errorf("Expected other accounts to survive, but got: %v", err)
+	}
+
+	if err := s.DeleteAccount("someone"); err != ErrAccountNotFound {
+		t.Errorf("Expected ErrAccountNotFound deleting a missing account, but got: %v", err)
+	}
+
+	// The name may be reused, without inheriting the deleted account's keys.
+	conformAccount(t, s, "someone")
+	if ok, err := conformHasKey(s, "someone", account.APIKeys[0].Digest); ok || err != nil {
+		t.Errorf("Expected a recreated account not to inherit keys, but got (%v, %v)", ok, err)
+	}
+}
+
+func conformDisableAccount(t *testing.T, s Storage) {
+	account := conformAccount(t, s, "someone")
+	digest := account.APIKeys[0].Digest
+
+	if err := s.SetAccountDisabled("someone", true, "abuse", 12345); err != nil {
+		t.Fatalf("Unexpected error disabling an account: %v", err)
+	}
+
+	found, err := s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if !found.Disabled || found.DisabledReason != "abuse" || found.DisabledAt != 12345 {
+		t.Errorf("Unexpected disabled state: (%v, %s, %d)", found.Disabled, found.DisabledReason, found.DisabledAt)
+	}
+	if !reflect.DeepEqual(found.APIKeys, account.APIKeys) {
+		t.Errorf("Expected a disabled account to keep its keys, but found %v", found.APIKeys)
+	}
+
+	if _, err := s.FindKey("someone", digest); err != ErrAccountDisabled {
+		t.Errorf("Expected ErrAccountDisabled for a key on a disabled account, but got: %v", err)
+	}
+	if _, err := s.FindKey("someone", DigestAPIKey("123abc")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound for an unknown key on a disabled account, but got: %v", err)
+	}
+
+	if err := s.SetAccountDisabled("someone", false, "ignored", 23456); err != nil {
+		t.Fatalf("Unexpected error enabling an account: %v", err)
+	}
+
+	found, err = s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if found.Disabled || found.DisabledReason != "" || found.DisabledAt != 0 {
+		t.Errorf("Expected enabling to clear the disabled state, but got (%v, %s, %d)",
+			found.Disabled, found.DisabledReason, found.DisabledAt)
+	}
+	if _, err := s.FindKey("someone", digest); err != nil {
+		t.Errorf("Expected keys to work again once enabled, but got: %v", err)
+	}
+
+	if err := s.SetAccountDisabled("nobody", true, "abuse", 12345); err != ErrAccountNotFound {
+		t.Errorf("Expected ErrAccountNotFound, but got: %v", err)
+	}
+}
+
+func conformUpdatePassword(t *testing.T, s Storage) {
+	account := conformAccount(t, s, "someone")
+
+	changed, err := NewAccount(testHasher, "someone", "changed")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+
+	if err := s.UpdatePassword("someone", changed.HashedPassword, 12345, false); err != nil {
+		t.Fatalf("Unexpected error changing a password: %v", err)
+	}
+
+	found, err := s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if !found.HasPassword("changed") || found.HasPassword("secret") {
+		t.Error("Expected the account to accept only its new password")
+	}
+	if found.UpdatedAt != 12345 || found.CreatedAt != account.CreatedAt {
+		t.Errorf("Unexpected timestamps after a password change: %d/%d", found.CreatedAt, found.UpdatedAt)
+	}
+	if !reflect.DeepEqual(found.APIKeys, account.APIKeys) {
+		t.Errorf("Expected API keys to be unaffected, but found %v", found.APIKeys)
+	}
+
+	if err := s.UpdatePassword("nobody", changed.HashedPassword, 12345, false); err != ErrAccountNotFound {
+		t.Errorf("Expected ErrAccountNotFound, but got: %v", err)
+	}
+}
+
+func conformUpdatePasswordRevokingKeys(t *testing.T, s Storage) {
+	conformAccount(t, s, "someone")
+
+	if err := s.UpdatePassword("someone", []byte("hashed"), 12345, true); err != nil {
+		t.Fatalf("Unexpected error changing a password: %v", err)
+	}
+
+	found, err := s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if len(found.APIKeys) != 0 {
+		t.Errorf("Expected every key to be revoked, but found %v", found.APIKeys)
+	}
+}
+
+func conformRehashPassword(t *testing.T, s Storage) {
+	account := conformAccount(t, s, "someone")
+	original := account.HashedPassword
+
+	if err := s.RehashPassword("someone", original, []byte("rehashed")); err != nil {
+		t.Fatalf("Unexpected error rehashing a password: %v", err)
+	}
+	found, err := s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if string(found.HashedPassword) != "rehashed" {
+		t.Errorf("Expected the password hash to be replaced, but found %s", found.HashedPassword)
+	}
+	if found.UpdatedAt != account.UpdatedAt {
+		t.Errorf("Expected rehashing to leave updatedAt alone, but it was %d", found.UpdatedAt)
+	}
+
+	// The password has changed since the original hash was verified.
+	if err := s.RehashPassword("someone", original, []byte("stale")); err != nil {
+		t.Fatalf("Unexpected error rehashing a changed password: %v", err)
+	}
+	found, err = s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if string(found.HashedPassword) != "rehashed" {
+		t.Errorf("Expected a changed password to be left alone, but found %s", found.HashedPassword)
+	}
+
+	if err := s.RehashPassword("nobody", original, []byte("rehashed")); err != ErrAccountNotFound {
+		t.Errorf("Expected ErrAccountNotFound, but got: %v", err)
+	}
+}
+
+func conformResetPassword(t *testing.T, s Storage) {
+	conformAccount(t, s, "someone")
+
+	token := ResetToken{Digest: DigestResetToken("123abc"), ExpiresAt: 200}
+	if err := s.SetResetToken("someone", token); err != nil {
+		t.Fatalf("Unexpected error setting a reset token: %v", err)
+	}
+
+	found, err := s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if found.PasswordReset == nil || *found.PasswordReset != token {
+		t.Errorf("Expected reset token %v, but found %v", token, found.PasswordReset)
+	}
+
+	changed, err := NewAccount(testHasher, "someone", "changed")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+	if err := s.ResetPassword("someone", token.Digest, changed.HashedPassword, 100); err != nil {
+		t.Fatalf("Unexpected error resetting a password: %v", err)
+	}
+
+	found, err = s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if !found.HasPassword("changed") {
+		t.Error("Expected the account to accept its new password")
+	}
+	if found.PasswordReset != nil {
+		t.Errorf("Expected the reset token to be consumed, but found %v", found.PasswordReset)
+	}
+
+	if err := s.ResetPassword("someone", token.Digest, []byte("again"), 100); err != ErrResetTokenInvalid {
+		t.Errorf("Expected a reset token to be usable only once, but got: %v", err)
+	}
+
+	if err := s.SetResetToken("nobody", token); err != ErrAccountNotFound {
+		t.Errorf("Expected ErrAccountNotFound, but got: %v", err)
+	}
+	if err := s.ResetPassword("nobody", token.Digest, []byte("hashed"), 100); err != ErrAccountNotFound {
+		t.Errorf("Expected ErrAccountNotFound, but got: %v", err)
+	}
+}
+
+func conformResetPasswordInvalidToken(t *testing.T, s Storage) {
+	conformAccount(t, s, "someone")
+
+	if err := s.ResetPassword("someone", DigestResetToken("123abc"), []byte("hashed"), 100); err != ErrResetTokenInvalid {
+		t.Errorf("Expected ErrResetTokenInvalid without a token, but got: %v", err)
+	}
+
+	token := ResetToken{Digest: DigestResetToken("123abc"), ExpiresAt: 200}
+	if err := s.SetResetToken("someone", token); err != nil {
+		t.Fatalf("Unexpected error setting a reset token: %v", err)
+	}
+
+	if err := s.ResetPassword("someone", DigestResetToken("456def"), []byte("hashed"), 100); err != ErrResetTokenInvalid {
+		t.Errorf("Expected ErrResetTokenInvalid for the wrong token, but got: %v", err)
+	}
+	if err := s.ResetPassword("someone", token.Digest, []byte("hashed"), 200); err != ErrResetTokenInvalid {
+		t.Errorf("Expected ErrResetTokenInvalid for an expired token, but got: %v", err)
+	}
+
+	found, err := s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if !found.HasPassword("secret") {
+		t.Error("Expected failed resets to leave the password unchanged")
+	}
+}
+
+func conformSetTwoFactor(t *testing.T, s Storage) {
+	conformAccount(t, s, "someone")
+
+	twoFactor := &TwoFactor{
+		Secret:        "JBSWY3DPEHPK3PXP",
+		Confirmed:     true,
+		LastStep:      100,
+		RecoveryCodes: []string{DigestRecoveryCode("aaaaa-11111"), DigestRecoveryCode("bbbbb-22222")},
+	}
+	if err := s.SetTwoFactor("someone", twoFactor); err != nil {
+		t.Fatalf("Unexpected error enrolling in two-factor authentication: %v", err)
+	}
+
+	found, err := s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if found.TwoFactor == nil {
+		t.Fatal("Expected a two-factor enrollment to be stored")
+	}
+	if !reflect.DeepEqual(conformSorted(found.TwoFactor.RecoveryCodes), conformSorted(twoFactor.RecoveryCodes)) {
+		t.Errorf("Expected recovery codes %v, but found %v", twoFactor.RecoveryCodes, found.TwoFactor.RecoveryCodes)
+	}
+	found.TwoFactor.RecoveryCodes = twoFactor.RecoveryCodes
+	if !reflect.DeepEqual(found.TwoFactor, twoFactor) {
+		t.Errorf("Expected enrollment %+v, but found %+v", twoFactor, found.TwoFactor)
+	}
+	if !found.TwoFactorEnabled() {
+		t.Error("Expected two-factor authentication to be enabled")
+	}
+
+	if err := s.SetTwoFactor("someone", nil); err != nil {
+		t.Fatalf("Unexpected error removing two-factor authentication: %v", err)
+	}
+	found, err = s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if found.TwoFactor != nil {
+		t.Errorf("Expected the enrollment to be removed, but found %+v", found.TwoFactor)
+	}
+
+	if err := s.SetTwoFactor("nobody", twoFactor); err != ErrAccountNotFound {
+		t.Errorf("Expected ErrAccountNotFound, but got: %v", err)
+	}
+}
+
+// conformSorted returns a sorted copy of strings, for comparisons that ignore order.
+func conformSorted(values []string) []string {
+	sorted := append([]string(nil), values...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+func conformUseTwoFactorStep(t *testing.T, s Storage) {
+	conformAccount(t, s, "someone")
+
+	if err := s.UseTwoFactorStep("someone", 100); err != ErrTwoFactorInvalid {
+		t.Errorf("Expected ErrTwoFactorInvalid without an enrollment, but got: %v", err)
+	}
+
+	if err := s.SetTwoFactor("someone", &TwoFactor{Secret: "JBSWY3DPEHPK3PXP"}); err != nil {
+		t.Fatalf("Unexpected error enrolling in two-factor authentication: %v", err)
+	}
+
+	if err := s.UseTwoFactorStep("someone", 100); err != nil {
+		t.Fatalf("Unexpected error using a TOTP step: %v", err)
+	}
+	if err := s.UseTwoFactorStep("someone", 100); err != ErrTwoFactorInvalid {
+		t.Errorf("Expected a TOTP step to be usable only once, but got: %v", err)
+	}
+	if err := s.UseTwoFactorStep("someone", 99); err != ErrTwoFactorInvalid {
+		t.Errorf("Expected an earlier TOTP step to be refused, but got: %v", err)
+	}
+	if err := s.UseTwoFactorStep("someone", 101); err != nil {
+		t.Errorf("Unexpected error using a later TOTP step: %v", err)
+	}
+
+	found, err := s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if found.TwoFactor == nil || found.TwoFactor.LastStep != 101 {
+		t.Errorf("Expected the last TOTP step to be 101, but found %+v", found.TwoFactor)
+	}
+
+	if err := s.UseTwoFactorStep("nobody", 100); err != ErrAccountNotFound {
+		t.Errorf("Expected ErrAccountNotFound, but got: %v", err)
+	}
+}
+
+func conformUseRecoveryCode(t *testing.T, s Storage) {
+	conformAccount(t, s, "someone")
+
+	first, second := DigestRecoveryCode("aaaaa-11111"), DigestRecoveryCode("bbbbb-22222")
+	if err := s.UseRecoveryCode("someone", first); err != ErrTwoFactorInvalid {
+		t.Errorf("Expected ErrTwoFactorInvalid without an enrollment, but got: %v", err)
+	}
+
+	twoFactor := &TwoFactor{Secret: "JBSWY3DPEHPK3PXP", Confirmed: true, RecoveryCodes: []string{first, second}}
+	if err := s.SetTwoFactor("someone", twoFactor); err != nil {
+		t.Fatalf("Unexpected error enrolling in two-factor authentication: %v", err)
+	}
+
+	if err := s.UseRecoveryCode("someone", first); err != nil {
+		t.Fatalf("Unexpected error using a recovery code: %v", err)
+	}
+	if err := s.UseRecoveryCode("someone", first); err != ErrTwoFactorInvalid {
+		t.Errorf("Expected a recovery code to be usable only once, but got: %v", err)
+	}
+	if err := s.UseRecoveryCode("someone", DigestRecoveryCode("ccccc-33333")); err != ErrTwoFactorInvalid {
+		t.Errorf("Expected an unknown recovery code to be refused, but got: %v", err)
+	}
+
+	found, err := s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if found.TwoFactor == nil || !reflect.DeepEqual(found.TwoFactor.RecoveryCodes, []string{second}) {
+		t.Errorf("Expected only the unused recovery code to remain, but found %+v", found.TwoFactor)
+	}
+
+	if err := s.DeleteAccount("someone"); err != nil {
+		t.Fatalf("Unexpected error deleting an account with recovery codes: %v", err)
+	}
+	if err := s.UseRecoveryCode("nobody", second); err != ErrAccountNotFound {
+		t.Errorf("Expected ErrAccountNotFound, but got: %v", err)
+	}
+}
+
+func conformAddKey(t *testing.T, s Storage) {
+	account := conformAccount(t, s, "someone")
+
+	added := apiKeyRecord("123abc")
+	added.Label = "laptop"
+	added.CreatedAt = 12345
+	added.CreatedFrom = "10.0.0.1"
+
+	if err := s.AddKeyToAccount("someone", added); err != nil {
+		t.Fatalf("Unexpected error adding a key: %v", err)
+	}
+
+	if ok, err := conformHasKey(s, "someone", DigestAPIKey("123abc")); !ok || err != nil {
+		t.Errorf("Expected the added key to be present, but got (%v, %v)", ok, err)
+	}
+
+	if ok, err := conformHasKey(s, "someone", DigestAPIKey("456def")); ok || err != nil {
+		t.Errorf("Expected an unknown key to be absent, but got (%v, %v)", ok, err)
+	}
+
+	found, err := s.FindAccount("someone")
+	if err != nil || found == nil {
+		t.Fatalf("Unable to find account: (%v, %v)", found, err)
+	}
+
+	expected := []APIKey{account.APIKeys[0], added}
+	if !reflect.DeepEqual(found.APIKeys, expected) {
+		t.Errorf("Expected API keys %v, but found %v", expected, found.APIKeys)
+	}
+}
+
+func conformAddKeyMissingAccount(t *testing.T, s Storage) {
+	if err := s.AddKeyToAccount("nobody", apiKeyRecord("123abc")); err != ErrAccountNotFound {
+		t.Errorf("Expected ErrAccountNotFound, but got: %v", err)
+	}
+
+	if _, err := s.FindAccount("nobody"); err != ErrAccountNotFound {
+		t.Errorf("Adding a key to a missing account created it: %v", err)
+	}
+}
+
+func conformRevokeKey(t *testing.T, s Storage) {
+	account := conformAccount(t, s, "someone")
+
+	if err := s.AddKeyToAccount("someone", apiKeyRecord("123abc")); err != nil {
+		t.Fatalf("Unexpected error adding a key: %v", err)
+	}
+
+	if err := s.RevokeKeyFromAccount("someone", DigestAPIKey("123abc")); err != nil {
+		t.Fatalf("Unexpected error revoking a key: %v", err)
+	}
+
+	if ok, err := conformHasKey(s, "someone", DigestAPIKey("123abc")); ok || err != nil {
+		t.Errorf("Expected the revoked key to be absent, but got (%v, %v)", ok, err)
+	}
+
+	if ok, err := conformHasKey(s, "someone", account.APIKeys[0].Digest); !ok || err != nil {
+		t.Errorf("Expected other keys to survive revocation, but got (%v, %v)", ok, err)
+	}
+}
+
+func conformRevokeUnknownKey(t *testing.T, s Storage) {
+	account := conformAccount(t, s, "someone")
+
+	if err := s.RevokeKeyFromAccount("someone", DigestAPIKey("123abc")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, but got: %v", err)
+	}
+
+	if ok, err := conformHasKey(s, "someone", account.APIKeys[0].Digest); !ok || err != nil {
+		t.Errorf("Expected existing keys to be unaffected, but got (%v, %v)", ok, err)
+	}
+}
+
+func conformRevokeMissingAccount(t *testing.T, s Storage) {
+	if err := s.RevokeKeyFromAccount("nobody", DigestAPIKey("123abc")); err != ErrAccountNotFound {
+		t.Errorf("Expected ErrAccountNotFound, but got: %v", err)
+	}
+}
+
+func conformRevokeAllKeys(t *testing.T, s Storage) {
+	account := conformAccount(t, s, "someone")
+	conformAccount(t, s, "other")
+
+	if err := s.AddKeyToAccount("someone", apiKeyRecord("123abc")); err != nil {
+		t.Fatalf("Unexpected error adding a key: %v", err)
+	}
+
+	n, err := s.RevokeAllKeys("someone", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error revoking every key: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("Expected 2 keys to be revoked, but %d were", n)
+	}
+
+	for _, digest := range []string{account.APIKeys[0].Digest, DigestAPIKey("123abc")} {
+		if ok, err := conformHasKey(s, "someone", digest); ok || err != nil {
+			t.Errorf("Expected every key to be revoked, but got (%v, %v)", ok, err)
+		}
+	}
+
+	found, err := s.FindAccount("other")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if len(found.APIKeys) != 1 {
+		t.Errorf("Expected other accounts to keep their keys, but found %d", len(found.APIKeys))
+	}
+
+	if _, err := s.RevokeAllKeys("nobody", nil); err != ErrAccountNotFound {
+		t.Errorf("Expected ErrAccountNotFound, but got: %v", err)
+	}
+}
+
+func conformRevokeAllKeysWithReplacement(t *testing.T, s Storage) {
+	conformAccount(t, s, "someone")
+
+	replacement := apiKeyRecord("123abc")
+	n, err := s.RevokeAllKeys("someone", &replacement)
+	if err != nil {
+		t.Fatalf("Unexpected error revoking every key: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("Expected 1 key to be revoked, but %d were", n)
+	}
+
+	found, err := s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	expected := []APIKey{replacement}
+	if !reflect.DeepEqual(found.APIKeys, expected) {
+		t.Errorf("Expected API keys %v, but found %v", expected, found.APIKeys)
+	}
+}
+
+func conformFindKey(t *testing.T, s Storage) {
+	conformAccount(t, s, "someone")
+
+	added := apiKeyRecord("123abc")
+	added.Label = "ci"
+	added.Scopes = []string{ScopeJobsSubmit, ScopeJobsRead}
+	if err := s.AddKeyToAccount("someone", added); err != nil {
+		t.Fatalf("Unexpected error adding a key: %v", err)
+	}
+
+	found, err := s.FindKey("someone", added.Digest)
+	if err != nil {
+		t.Fatalf("Unexpected error finding a key: %v", err)
+	}
+	if !reflect.DeepEqual(*found, added) {
+		t.Errorf("Expected key %v, but found %v", added, *found)
+	}
+
+	if _, err := s.FindKey("someone", DigestAPIKey("456def")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound for an unknown key, but got: %v", err)
+	}
+}
+
+func conformFindKeyMissingAccount(t *testing.T, s Storage) {
+	if _, err := s.FindKey("nobody", DigestAPIKey("123abc")); err != ErrAccountNotFound {
+		t.Errorf("Expected ErrAccountNotFound for a missing account, but got: %v", err)
+	}
+}
+
+func conformRotateKey(t *testing.T, s Storage) {
+	account := conformAccount(t, s, "someone")
+	previous := account.APIKeys[0]
+
+	replacement := apiKeyRecord("123abc")
+	replacement.ExpiresAt = 98765
+	replacement.Lifetime = 6789
+	if err := s.RotateKey("someone", previous.Digest, replacement, 12345); err != nil {
+		t.Fatalf("Unexpected error rotating a key: %v", err)
+	}
+
+	found, err := s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+
+	previous.ExpiresAt = 12345
+	previous.Rotated = true
+	expected := []APIKey{previous, replacement}
+	if !reflect.DeepEqual(found.APIKeys, expected) {
+		t.Errorf("Expected API keys %v, but found %v", expected, found.APIKeys)
+	}
+
+	if ok, err := conformHasKey(s, "someone", previous.Digest); ok || err != nil {
+		t.Errorf("Expected the rotated key to have expired, but got (%v, %v)", ok, err)
+	}
+
+	err = s.RotateKey("someone", previous.Digest, apiKeyRecord("456def"), 23456)
+	if err != ErrKeyRotated {
+		t.Errorf("Expected ErrKeyRotated rotating a key a second time, but got: %v", err)
+	}
+	found, err = s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if !reflect.DeepEqual(found.APIKeys, expected) {
+		t.Errorf("Expected a second rotation to leave keys unchanged, but found %v", found.APIKeys)
+	}
+}
+
+func conformRotateUnknownKey(t *testing.T, s Storage) {
+	account := conformAccount(t, s, "someone")
+
+	err := s.RotateKey("someone", DigestAPIKey("123abc"), apiKeyRecord("456def"), 12345)
+	if err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, but got: %v", err)
+	}
+
+	found, err := s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if !reflect.DeepEqual(found.APIKeys, account.APIKeys) {
+		t.Errorf("Expected a failed rotation to leave keys unchanged, but found %v", found.APIKeys)
+	}
+
+	err = s.RotateKey("nobody", DigestAPIKey("123abc"), apiKeyRecord("456def"), 12345)
+	if err != ErrAccountNotFound {
+		t.Errorf("Expected ErrAccountNotFound, but got: %v", err)
+	}
+}
+
+func conformTouchKey(t *testing.T, s Storage) {
+	account := conformAccount(t, s, "someone")
+	digest := account.APIKeys[0].Digest
+
+	if err := s.TouchAPIKey("someone", digest, 12345); err != nil {
+		t.Fatalf("Unexpected error recording key usage: %v", err)
+	}
+
+	found, err := s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	if found.APIKeys[0].LastUsedAt != 12345 {
+		t.Errorf("Expected the key to have been last used at 12345, but was %d", found.APIKeys[0].LastUsedAt)
+	}
+
+	if err := s.TouchAPIKey("someone", DigestAPIKey("123abc"), 12345); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound touching an unknown key, but got: %v", err)
+	}
+
+	if err := s.TouchAPIKey("nobody", digest, 12345); err != ErrAccountNotFound {
+		t.Errorf("Expected ErrAccountNotFound touching a key on a missing account, but got: %v", err)
+	}
+}
+
+func conformConcurrentKeyAppends(t *testing.T, s Storage) {
+	conformAccount(t, s, "someone")
+
+	const n = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- s.AddKeyToAccount("someone", apiKeyRecord(fmt.Sprintf("key-%d", i)))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Unexpected error appending a key concurrently: %v", err)
+		}
+	}
+
+	found, err := s.FindAccount("someone")
+	if err != nil || found == nil {
+		t.Fatalf("Unable to find account: (%v, %v)", found, err)
+	}
+	if len(found.APIKeys) != n+1 {
+		t.Errorf("Expected %d API keys after concurrent appends, but found %d", n+1, len(found.APIKeys))
+	}
+
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if ok, err := conformHasKey(s, "someone", DigestAPIKey(key)); !ok || err != nil {
+			t.Errorf("Expected concurrently appended key [%s] to be present, but got (%v, %v)", key, ok, err)
+		}
+	}
+}
+
+func conformExpiredKey(t *testing.T, s Storage) {
+	conformAccount(t, s, "someone")
+	now := time.Now().UnixNano()
+
+	expired := apiKeyRecord("123abc")
+	expired.ExpiresAt = now - int64(time.Hour)
+	current := apiKeyRecord("456def")
+	current.ExpiresAt = now + int64(time.Hour)
+
+	for _, key := range []APIKey{expired, current} {
+		if err := s.AddKeyToAccount("someone", key); err != nil {
+			t.Fatalf("Unexpected error adding a key: %v", err)
+		}
+	}
+
+	if ok, err := conformHasKey(s, "someone", expired.Digest); ok || err != nil {
+		t.Errorf("Expected an expired key to be rejected, but got (%v, %v)", ok, err)
+	}
+	if ok, err := conformHasKey(s, "someone", current.Digest); !ok || err != nil {
+		t.Errorf("Expected an unexpired key to be accepted, but got (%v, %v)", ok, err)
+	}
+}
+
+func conformRemoveExpiredKeys(t *testing.T, s Storage) {
+	account := conformAccount(t, s, "someone")
+	conformAccount(t, s, "other")
+
+	old := apiKeyRecord("123abc")
+	old.ExpiresAt = 100
+	recent := apiKeyRecord("456def")
+	recent.ExpiresAt = 300
+
+	for _, key := range []APIKey{old, recent} {
+		if err := s.AddKeyToAccount("someone", key); err != nil {
+			t.Fatalf("Unexpected error adding a key: %v", err)
+		}
+	}
+
+	n, err := s.RemoveExpiredKeys(200)
+	if err != nil {
+		t.Fatalf("Unexpected error removing expired keys: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("Expected 1 account to be modified, but %d were", n)
+	}
+
+	found, err := s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unable to find account: %v", err)
+	}
+	expected := []APIKey{account.APIKeys[0], recent}
+	if !reflect.DeepEqual(found.APIKeys, expected) {
+		t.Errorf("Expected API keys %v, but found %v", expected, found.APIKeys)
+	}
+
+	if n, err := s.RemoveExpiredKeys(200); n != 0 || err != nil {
+		t.Errorf("Expected a second removal to do nothing, but got (%d, %v)", n, err)
+	}
+}
+
+func conformSetAdministrator(t *testing.T, s Storage) {
+	conformAccount(t, s, "someone@example.com")
+
+	if err := s.SetAdministrator("someone@example.com", true); err != nil {
+		t.Fatalf("Unexpected error granting administrator status: %v", err)
+	}
+	found, err := s.FindAccount("someone@example.com")
+	if err != nil {
+		t.Fatalf("Unexpected error finding account: %v", err)
+	}
+	if !found.Administrator {
+		t.Error("Expected the account to be an administrator")
+	}
+
+	if err := s.SetAdministrator("someone@example.com", false); err != nil {
+		t.Fatalf("Unexpected error revoking administrator status: %v", err)
+	}
+	found, err = s.FindAccount("someone@example.com")
+	if err != nil {
+		t.Fatalf("Unexpected error finding account: %v", err)
+	}
+	if found.Administrator {
+		t.Error("Expected the account to no longer be an administrator")
+	}
+
+	if err := s.SetAdministrator("nobody", true); err != ErrAccountNotFound {
+		t.Errorf("Expected ErrAccountNotFound for a missing account, but got: %v", err)
+	}
+}
+
+// conformList lists accounts, and returns their names and the cursor of the next page.
+func conformList(t *testing.T, s Storage, query AccountQuery) ([]string, string) {
+	page, err := s.ListAccounts(query)
+	if err != nil {
+		t.Fatalf("Unexpected error listing accounts with %+v: %v", query, err)
+	}
+
+	var names []string
+	for _, account := range page.Accounts {
+		names = append(names, account.Name)
+	}
+	return names, page.NextCursor
+}
+
+func conformListAccounts(t *testing.T, s Storage) {
+	if names, next := conformList(t, s, AccountQuery{}); len(names) != 0 || next != "" {
+		t.Errorf("Expected no accounts, but found %v", names)
+	}
+
+	carol := conformAccount(t, s, "carol@example.com")
+	conformAccount(t, s, "alice@example.com")
+	conformAccount(t, s, "bob_smith@example.org")
+
+	page, err := s.ListAccounts(AccountQuery{})
+	if err != nil {
+		t.Fatalf("Unexpected error listing accounts: %v", err)
+	}
+	if page.NextCursor != "" {
+		t.Errorf("Expected a single page, but found cursor [%s]", page.NextCursor)
+	}
+	for _, account := range page.Accounts {
+		if account.Name == carol.Name && !reflect.DeepEqual(account.APIKeys, carol.APIKeys) {
+			t.Errorf("Listed account had unexpected API keys: %v", account.APIKeys)
+		}
+	}
+
+	queries := []struct {
+		query    AccountQuery
+		expected []string
+	}{
+		{AccountQuery{}, []string{"alice@example.com", "bob_smith@example.org", "carol@example.com"}},
+		{AccountQuery{Descending: true}, []string{"carol@example.com", "bob_smith@example.org", "alice@example.com"}},
+		{AccountQuery{Contains: "EXAMPLE.COM"}, []string{"alice@example.com", "carol@example.com"}},
+		{AccountQuery{Contains: "_smith"}, []string{"bob_smith@example.org"}},
+		{AccountQuery{Contains: "b%"}, nil},
+		{AccountQuery{Contains: "x_"}, nil},
+		{AccountQuery{Prefix: "BOB_"}, []string{"bob_smith@example.org"}},
+		{AccountQuery{Prefix: "example"}, nil},
+		{AccountQuery{Prefix: "c", Contains: "example"}, []string{"carol@example.com"}},
+	}
+	for _, each := range queries {
+		if names, _ := conformList(t, s, each.query); !reflect.DeepEqual(names, each.expected) {
+			t.Errorf("Expected %+v to list %v, but found %v", each.query, each.expected, names)
+		}
+	}
+}
+
+// conformListingAccounts stores accounts for listing checks. They're created a second apart, in
+// the order given, except for the last two, which are created at the same time.
+func conformListingAccounts(t *testing.T, s Storage, names ...string) []*Account {
+	var accounts []*Account
+	for i, name := range names {
+		account, err := NewAccount(testHasher, name, "secret")
+		if err != nil {
+			t.Fatalf("Unable to create account: %v", err)
+		}
+		if i == len(names)-1 {
+			i--
+		}
+		account.CreatedAt = int64(i+1) * int64(time.Second)
+
+		if err := s.CreateAccount(account); err != nil {
+			t.Fatalf("Unexpected error storing account [%s]: %v", name, err)
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts
+}
+
+func conformListAccountsFiltered(t *testing.T, s Storage) {
+	accounts := conformListingAccounts(t, s, "erin", "dave", "carol", "bob", "alice")
+
+	if err := s.SetAdministrator("carol", true); err != nil {
+		t.Fatalf("Unexpected error granting administrator status: %v", err)
+	}
+	if err := s.SetAccountDisabled("dave", true, "", 1); err != nil {
+		t.Fatalf("Unexpected error disabling account: %v", err)
+	}
+
+	yes, no := true, false
+	queries := []struct {
+		query    AccountQuery
+		expected []string
+	}{
+		{AccountQuery{Administrator: &yes}, []string{"carol"}},
+		{AccountQuery{Administrator: &no}, []string{"alice", "bob", "dave", "erin"}},
+		{AccountQuery{Disabled: &yes}, []string{"dave"}},
+		{AccountQuery{Disabled: &no, Administrator: &no}, []string{"alice", "bob", "erin"}},
+		{AccountQuery{CreatedAfter: accounts[1].CreatedAt}, []string{"alice", "bob", "carol"}},
+		{AccountQuery{CreatedBefore: accounts[2].CreatedAt}, []string{"dave", "erin"}},
+		{AccountQuery{CreatedAfter: accounts[0].CreatedAt, CreatedBefore: accounts[3].CreatedAt},
+			[]string{"carol", "dave"}},
+		{AccountQuery{Sort: AccountSortCreated}, []string{"erin", "dave", "carol", "alice", "bob"}},
+		{AccountQuery{Sort: AccountSortCreated, Descending: true},
+			[]string{"bob", "alice", "carol", "dave", "erin"}},
+	}
+	for _, each := range queries {
+		if names, _ := conformList(t, s, each.query); !reflect.DeepEqual(names, each.expected) {
+			t.Errorf("Expected %+v to list %v, but found %v", each.query, each.expected, names)
+		}
+	}
+}
+
+func conformListAccountsPaginated(t *testing.T, s Storage) {
+	conformListingAccounts(t, s, "erin", "dave", "carol", "bob", "alice")
+
+	queries := []struct {
+		query    AccountQuery
+		expected []string
+	}{
+		{AccountQuery{}, []string{"alice", "bob", "carol", "dave", "erin"}},
+		{AccountQuery{Descending: true}, []string{"erin", "dave", "carol", "bob", "alice"}},
+		{AccountQuery{Sort: AccountSortCreated}, []string{"erin", "dave", "carol", "alice", "bob"}},
+		{AccountQuery{Sort: AccountSortCreated, Descending: true},
+			[]string{"bob", "alice", "carol", "dave", "erin"}},
+		{AccountQuery{Prefix: "a", Sort: AccountSortCreated}, []string{"alice"}},
+	}
+	for _, each := range queries {
+		var listed []string
+		query := each.query
+		query.Limit = 2
+		for pages := 0; pages < 5; pages++ {
+			names, next := conformList(t, s, query)
+			if len(names) > 2 {
+				t.Errorf("Expected at most 2 accounts on a page, but found %v", names)
+			}
+			listed = append(listed, names...)
+			if next == "" {
+				break
+			}
+			query.Cursor = next
+		}
+
+		if !reflect.DeepEqual(listed, each.expected) {
+			t.Errorf("Expected %+v to list %v a page at a time, but found %v", each.query, each.expected, listed)
+		}
+	}
+
+	_, next := conformList(t, s, AccountQuery{Limit: 2})
+	if next == "" {
+		t.Fatal("Expected a cursor for the next page")
+	}
+	if _, err := s.ListAccounts(AccountQuery{Limit: 2, Sort: AccountSortCreated, Cursor: next}); err != ErrInvalidCursor {
+		t.Errorf("Expected a cursor from a differently sorted listing to be rejected, but got: %v", err)
+	}
+	if _, err := s.ListAccounts(AccountQuery{Cursor: "not a cursor"}); err != ErrInvalidCursor {
+		t.Errorf("Expected a malformed cursor to be rejected, but got: %v", err)
+	}
+}
+
+func conformHasAdministrator(t *testing.T, s Storage) {
+	hasAdmin := func(expected bool, when string) {
+		found, err := s.HasAdministrator()
+		if err != nil {
+			t.Fatalf("Unexpected error looking for an administrator %s: %v", when, err)
+		}
+		if found != expected {
+			t.Errorf("Expected HasAdministrator to be %v %s, but was %v", expected, when, found)
+		}
+	}
+
+	hasAdmin(false, "without any accounts")
+
+	conformAccount(t, s, "someone@example.com")
+	conformAccount(t, s, "root@example.com")
+	hasAdmin(false, "without any administrators")
+
+	if err := s.SetAdministrator("root@example.com", true); err != nil {
+		t.Fatalf("Unexpected error granting administrator status: %v", err)
+	}
+	hasAdmin(true, "once an account is an administrator")
+
+	if err := s.SetAccountDisabled("root@example.com", true, "", 1); err != nil {
+		t.Fatalf("Unexpected error disabling account: %v", err)
+	}
+	hasAdmin(false, "once the only administrator is disabled")
+}
+
+func conformLoginFailures(t *testing.T, s Storage) {
+	failures, err := s.FindLoginFailures("account:someone")
+	if err != nil {
+		t.Fatalf("Unexpected error finding login failures: %v", err)
+	}
+	if failures.Count != 0 {
+		t.Errorf("Expected no login failures, but found %d", failures.Count)
+	}
+
+	for i := 1; i <= 3; i++ {
+		failures, err = s.RecordLoginFailure("account:someone", int64(i*100), 0)
+		if err != nil {
+			t.Fatalf("Unexpected error recording a login failure: %v", err)
+		}
+		if failures.Count != i || failures.LastFailureAt != int64(i*100) {
+			t.Errorf("Unexpected login failures after %d: (%d, %d)", i, failures.Count, failures.LastFailureAt)
+		}
+	}
+
+	found, err := s.FindLoginFailures("account:someone")
+	if err != nil {
+		t.Fatalf("Unexpected error finding login failures: %v", err)
+	}
+	if found.Source != "account:someone" || found.Count != 3 || found.LastFailureAt != 300 {
+		t.Errorf("Unexpected login failures found: %+v", found)
+	}
+
+	other, err := s.FindLoginFailures("address:10.0.0.1")
+	if err != nil {
+		t.Fatalf("Unexpected error finding login failures: %v", err)
+	}
+	if other.Count != 0 {
+		t.Errorf("Expected failures to be counted separately for each source, but found %d", other.Count)
+	}
+
+	// A failure long after the previous one starts counting again.
+	failures, err = s.RecordLoginFailure("account:someone", 1000, 500)
+	if err != nil {
+		t.Fatalf("Unexpected error recording a login failure: %v", err)
+	}
+	if failures.Count != 1 || failures.LastFailureAt != 1000 {
+		t.Errorf("Expected the failure count to restart, but found (%d, %d)", failures.Count, failures.LastFailureAt)
+	}
+
+	if err := s.ClearLoginFailures("account:someone"); err != nil {
+		t.Fatalf("Unexpected error clearing login failures: %v", err)
+	}
+	if err := s.ClearLoginFailures("account:someone"); err != nil {
+		t.Errorf("Unexpected error clearing login failures twice: %v", err)
+	}
+
+	found, err = s.FindLoginFailures("account:someone")
+	if err != nil {
+		t.Fatalf("Unexpected error finding login failures: %v", err)
+	}
+	if found.Count != 0 {
+		t.Errorf("Expected login failures to be cleared, but found %d", found.Count)
+	}
+}
+
+func conformRemoveLoginFailures(t *testing.T, s Storage) {
+	for source, at := range map[string]int64{"account:old": 100, "address:old": 200, "account:new": 300} {
+		if _, err := s.RecordLoginFailure(source, at, 0); err != nil {
+			t.Fatalf("Unexpected error recording a login failure: %v", err)
+		}
+	}
+
+	n, err := s.RemoveLoginFailures(300)
+	if err != nil {
+		t.Fatalf("Unexpected error removing login failures: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("Expected 2 sources to be forgotten, but %d were", n)
+	}
+
+	for source, expected := range map[string]int{"account:old": 0, "address:old": 0, "account:new": 1} {
+		found, err := s.FindLoginFailures(source)
+		if err != nil {
+			t.Fatalf("Unexpected error finding login failures: %v", err)
+		}
+		if found.Count != expected {
+			t.Errorf("Expected %d login failures for [%s], but found %d", expected, source, found.Count)
+		}
+	}
+}
+
+func conformAuditEvents(t *testing.T, s Storage) {
+	events := []AuditEvent{
+		{Event: "account.created", Account: "someone", Actor: "someone", Address: "10.0.0.1", Outcome: AuditSuccess, Time: 300},
+		{
+			Event:              "key.revoked",
+			Account:            "someone",
+			Actor:              "root",
+			CertificateSubject: "O=Example,CN=admin",
+			Outcome:            AuditSuccess,
+			Time:               100,
+			Details:            map[string]string{"key id": "abc123"},
+		},
+		{Event: "key.validation", Account: "other", Actor: "other", Outcome: AuditFailure, Time: 200},
+		{Event: "account.deleted", Account: "someone", Actor: "someone", Outcome: AuditSuccess, Time: 400},
+	}
+	for _, event := range events {
+		if err := s.RecordAuditEvent(event); err != nil {
+			t.Fatalf("Unexpected error recording an audit event: %v", err)
+		}
+	}
+
+	expect := func(query AuditQuery, expected ...AuditEvent) {
+		found, err := s.FindAuditEvents(query)
+		if err != nil {
+			t.Fatalf("Unexpected error querying audit events: %v", err)
+		}
+		if len(found) != len(expected) || (len(found) > 0 && !reflect.DeepEqual(found, expected)) {
+			t.Errorf("Expected %+v to find %+v, but found %+v", query, expected, found)
+		}
+	}
+
+	expect(AuditQuery{}, events[1], events[2], events[0], events[3])
+	expect(AuditQuery{Account: "someone"}, events[1], events[0], events[3])
+	expect(AuditQuery{Account: "someone", Since: 300}, events[0], events[3])
+	expect(AuditQuery{Since: 100, Until: 300}, events[1], events[2])
+	expect(AuditQuery{Limit: 2}, events[1], events[2])
+	expect(AuditQuery{Account: "nobody"})
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// MemoryStorage is a Storage implementation that keeps everything in process memory. Nothing
+// survives a restart, so it's only suitable for local development and tests.
+type MemoryStorage struct {
+	mutex    sync.RWMutex
+	accounts map[string]*Account
+	failures map[string]LoginFailures
+	audit    []AuditEvent
+}
+
+// NewMemoryStorage creates an empty MemoryStorage.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		accounts: make(map[string]*Account),
+		failures: make(map[string]LoginFailures),
+	}
+}
+
+// copyAccount creates a deep copy of an Account, so that callers can't modify stored state
+// without going through the Storage interface.
+func copyAccount(account *Account) *Account {
+	c := *account
+	c.HashedPassword = append([]byte(nil), account.HashedPassword...)
+	if account.PasswordReset != nil {
+		token := *account.PasswordReset
+		c.PasswordReset = &token
+	}
+	c.TwoFactor = copyTwoFactor(account.TwoFactor)
+	c.APIKeys = append([]APIKey(nil), account.APIKeys...)
+	for i := range c.APIKeys {
+		c.APIKeys[i] = copyAPIKey(c.APIKeys[i])
+	}
+	return &c
+}
+
+// copyAPIKey creates a deep copy of an APIKey, so that its scopes aren't shared with the caller.
+func copyAPIKey(key APIKey) APIKey {
+	key.Scopes = append([]string(nil), key.Scopes...)
+	return key
+}
+
+// copyTwoFactor creates a deep copy of a TOTP enrollment, or returns nil if there's none.
+func copyTwoFactor(twoFactor *TwoFactor) *TwoFactor {
+	if twoFactor == nil {
+		return nil
+	}
+	c := *twoFactor
+	c.RecoveryCodes = append([]string(nil), twoFactor.RecoveryCodes...)
+	return &c
+}
+
+// CreateAccount stores a copy of an Account.
+func (storage *MemoryStorage) CreateAccount(account *Account) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if _, ok := storage.accounts[account.Name]; ok {
+		return ErrAccountExists
+	}
+	storage.accounts[account.Name] = copyAccount(account)
+	return nil
+}
+
+// FindAccount returns a copy of the account with the specified name.
+func (storage *MemoryStorage) FindAccount(name string) (*Account, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+
+	account, ok := storage.accounts[name]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	return copyAccount(account), nil
+}
+
+// DeleteAccount removes an account, along with all of its API keys.
+func (storage *MemoryStorage) DeleteAccount(name string) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if _, ok := storage.accounts[name]; !ok {
+		return ErrAccountNotFound
+	}
+	delete(storage.accounts, name)
+	return nil
+}
+
+// SetAccountDisabled disables or enables an account.
+func (storage *MemoryStorage) SetAccountDisabled(name string, disabled bool, reason string, at int64) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	account, ok := storage.accounts[name]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	account.SetDisabled(disabled, reason, at)
+	return nil
+}
+
+// SetAdministrator grants or revokes an account's administrator status.
+func (storage *MemoryStorage) SetAdministrator(name string, admin bool) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	account, ok := storage.accounts[name]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	account.Administrator = admin
+	return nil
+}
+
+// HasAdministrator returns true if any enabled account is an administrator.
+func (storage *MemoryStorage) HasAdministrator() (bool, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+
+	for _, account := range storage.accounts {
+		if account.Administrator && !account.Disabled {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ListAccounts returns copies of a page of the accounts that match a query.
+func (storage *MemoryStorage) ListAccounts(query AccountQuery) (AccountPage, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+
+	accounts := make([]*Account, 0, len(storage.accounts))
+	for _, account := range storage.accounts {
+		accounts = append(accounts, account)
+	}
+
+	page, err := queryAccounts(accounts, query)
+	for i, account := range page.Accounts {
+		page.Accounts[i] = copyAccount(account)
+	}
+	return page, err
+}
+
+// UpdatePassword replaces an account's password hash. If revokeKeys is true, every API key on the
+// account is removed at the same time.
+func (storage *MemoryStorage) UpdatePassword(name string, hashed []byte, updatedAt int64, revokeKeys bool) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	account, ok := storage.accounts[name]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	updatePassword(account, hashed, updatedAt, revokeKeys)
+	return nil
+}
+
+// RehashPassword replaces an account's password hash, unless it's changed since it was verified.
+func (storage *MemoryStorage) RehashPassword(name string, current, hashed []byte) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	account, ok := storage.accounts[name]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	if bytes.Equal(account.HashedPassword, current) {
+		account.HashedPassword = hashed
+	}
+	return nil
+}
+
+// SetResetToken replaces an account's outstanding password reset token.
+func (storage *MemoryStorage) SetResetToken(name string, token ResetToken) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	account, ok := storage.accounts[name]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	account.PasswordReset = &token
+	return nil
+}
+
+// ResetPassword consumes an account's password reset token and replaces its password hash.
+func (storage *MemoryStorage) ResetPassword(name, digest string, hashed []byte, now int64) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	account, ok := storage.accounts[name]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	return resetPassword(account, digest, hashed, now)
+}
+
+// SetTwoFactor replaces or removes an account's TOTP enrollment.
+func (storage *MemoryStorage) SetTwoFactor(name string, twoFactor *TwoFactor) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	account, ok := storage.accounts[name]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	account.TwoFactor = copyTwoFactor(twoFactor)
+	return nil
+}
+
+// UseTwoFactorStep records the time step of an accepted TOTP code, unless it's already been used.
+func (storage *MemoryStorage) UseTwoFactorStep(name string, step int64) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	account, ok := storage.accounts[name]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	return useTwoFactorStep(account, step)
+}
+
+// UseRecoveryCode consumes one of an account's recovery codes.
+func (storage *MemoryStorage) UseRecoveryCode(name, digest string) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	account, ok := storage.accounts[name]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	return useRecoveryCode(account, digest)
+}
+
+// AddKeyToAccount appends a newly generated API key to an existing account.
+func (storage *MemoryStorage) AddKeyToAccount(name string, key APIKey) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	account, ok := storage.accounts[name]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	account.APIKeys = append(account.APIKeys, copyAPIKey(key))
+	return nil
+}
+
+// RevokeKeyFromAccount removes the API key with a specified digest from an account.
+func (storage *MemoryStorage) RevokeKeyFromAccount(name, digest string) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	account, ok := storage.accounts[name]
+	if !ok {
+		return ErrAccountNotFound
+	}
+
+	for i, existing := range account.APIKeys {
+		if existing.Digest == digest {
+			account.APIKeys = append(account.APIKeys[:i], account.APIKeys[i+1:]...)
+			return nil
+		}
+	}
+	return ErrKeyNotFound
+}
+
+// RotateKey adds a replacement API key to an account and sets the expiry time of the key with a
+// specified digest.
+func (storage *MemoryStorage) RotateKey(name, digest string, replacement APIKey, expiresAt int64) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	account, ok := storage.accounts[name]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	return rotateKey(account, digest, copyAPIKey(replacement), expiresAt)
+}
+
+// RevokeAllKeys removes every API key from an account. If replacement isn't nil, it becomes the
+// account's only key.
+func (storage *MemoryStorage) RevokeAllKeys(name string, replacement *APIKey) (int, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	account, ok := storage.accounts[name]
+	if !ok {
+		return 0, ErrAccountNotFound
+	}
+	if replacement != nil {
+		copied := copyAPIKey(*replacement)
+		replacement = &copied
+	}
+	return revokeAllKeys(account, replacement), nil
+}
+
+// TouchAPIKey records the time at which an API key was last used.
+func (storage *MemoryStorage) TouchAPIKey(name, digest string, usedAt int64) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	account, ok := storage.accounts[name]
+	if !ok {
+		return ErrAccountNotFound
+	}
+
+	for i := range account.APIKeys {
+		if account.APIKeys[i].Digest == digest {
+			account.APIKeys[i].LastUsedAt = usedAt
+			return nil
+		}
+	}
+	return ErrKeyNotFound
+}
+
+// FindKey returns a copy of the unexpired API key with the provided digest from the named account.
+func (storage *MemoryStorage) FindKey(name, digest string) (*APIKey, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+
+	account, ok := storage.accounts[name]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	return findValidKey(account, digest, time.Now().UnixNano())
+}
+
+// RemoveExpiredKeys deletes every API key that expired before a specified time.
+func (storage *MemoryStorage) RemoveExpiredKeys(before int64) (int, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	n := 0
+	for _, account := range storage.accounts {
+		if removeExpiredKeys(account, before) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// findValidKey returns a copy of an account's unexpired API key with the provided digest, as long
+// as the account hasn't been disabled. The key is checked first, so that unknown keys don't reveal
+// whether an account is disabled.
+func findValidKey(account *Account, digest string, now int64) (*APIKey, error) {
+	key := account.Key(digest)
+	if key == nil || key.Expired(now) {
+		return nil, ErrKeyNotFound
+	}
+	if account.Disabled {
+		return nil, ErrAccountDisabled
+	}
+
+	found := *key
+	found.Scopes = append([]string(nil), key.Scopes...)
+	return &found, nil
+}
+
+// rotateKey sets the expiry time of an account's API key with the provided digest, marks it as
+// rotated, and appends its replacement.
+func rotateKey(account *Account, digest string, replacement APIKey, expiresAt int64) error {
+	key := account.Key(digest)
+	if key == nil {
+		return ErrKeyNotFound
+	}
+	if key.Rotated {
+		return ErrKeyRotated
+	}
+
+	key.ExpiresAt = expiresAt
+	key.Rotated = true
+	account.APIKeys = append(account.APIKeys, replacement)
+	return nil
+}
+
+// updatePassword replaces an account's password hash, and optionally revokes its API keys.
+func updatePassword(account *Account, hashed []byte, updatedAt int64, revokeKeys bool) {
+	account.HashedPassword = append([]byte(nil), hashed...)
+	account.UpdatedAt = updatedAt
+	if revokeKeys {
+		revokeAllKeys(account, nil)
+	}
+}
+
+// resetPassword consumes an account's password reset token, if it matches a digest and hasn't
+// expired, and replaces the account's password hash.
+func resetPassword(account *Account, digest string, hashed []byte, now int64) error {
+	token := account.PasswordReset
+	if token == nil || token.Digest != digest || token.ExpiresAt <= now {
+		return ErrResetTokenInvalid
+	}
+
+	account.PasswordReset = nil
+	updatePassword(account, hashed, now, false)
+	return nil
+}
+
+// useTwoFactorStep records the time step of an accepted TOTP code on an account, as long as it's
+// later than the last step that was used.
+func useTwoFactorStep(account *Account, step int64) error {
+	if account.TwoFactor == nil || account.TwoFactor.LastStep >= step {
+		return ErrTwoFactorInvalid
+	}
+	account.TwoFactor.LastStep = step
+	return nil
+}
+
+// useRecoveryCode removes the recovery code with a digest from an account.
+func useRecoveryCode(account *Account, digest string) error {
+	if account.TwoFactor == nil {
+		return ErrTwoFactorInvalid
+	}
+
+	codes := account.TwoFactor.RecoveryCodes
+	for i, existing := range codes {
+		if existing == digest {
+			account.TwoFactor.RecoveryCodes = append(codes[:i:i], codes[i+1:]...)
+			return nil
+		}
+	}
+	return ErrTwoFactorInvalid
+}
+
+// revokeAllKeys replaces an account's API keys with an optional replacement. It returns the number
+// of keys that were removed.
+func revokeAllKeys(account *Account, replacement *APIKey) int {
+	n := len(account.APIKeys)
+	account.APIKeys = nil
+	if replacement != nil {
+		account.APIKeys = append(account.APIKeys, *replacement)
+	}
+	return n
+}
+
+// removeExpiredKeys removes every API key from an account that expired before a specified time. It
+// returns true if any keys were removed.
+func removeExpiredKeys(account *Account, before int64) bool {
+	kept := account.APIKeys[:0]
+	for _, key := range account.APIKeys {
+		if key.ExpiresAt == 0 || key.ExpiresAt >= before {
+			kept = append(kept, key)
+		}
+	}
+
+	removed := len(kept) != len(account.APIKeys)
+	account.APIKeys = kept
+	return removed
+}
+
+// FindLoginFailures returns the failed login attempts counted for a source.
+func (storage *MemoryStorage) FindLoginFailures(source string) (LoginFailures, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+
+	if failures, ok := storage.failures[source]; ok {
+		return failures, nil
+	}
+	return LoginFailures{Source: source}, nil
+}
+
+// RecordLoginFailure counts a failed login attempt from a source.
+func (storage *MemoryStorage) RecordLoginFailure(source string, now, resetBefore int64) (LoginFailures, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	failures := recordLoginFailure(storage.failures[source], source, now, resetBefore)
+	storage.failures[source] = failures
+	return failures, nil
+}
+
+// ClearLoginFailures forgets the failed login attempts counted for a source.
+func (storage *MemoryStorage) ClearLoginFailures(source string) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	delete(storage.failures, source)
+	return nil
+}
+
+// RemoveLoginFailures forgets every source whose last failed login attempt was before a specified
+// time.
+func (storage *MemoryStorage) RemoveLoginFailures(before int64) (int, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	n := 0
+	for source, failures := range storage.failures {
+		if failures.LastFailureAt < before {
+			delete(storage.failures, source)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// RecordAuditEvent appends an event to the audit trail.
+func (storage *MemoryStorage) RecordAuditEvent(event AuditEvent) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	storage.audit = append(storage.audit, copyAuditEvent(event))
+	return nil
+}
+
+// FindAuditEvents returns the events in the audit trail that match a query.
+func (storage *MemoryStorage) FindAuditEvents(query AuditQuery) ([]AuditEvent, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+
+	events := queryAuditEvents(storage.audit, query)
+	for i := range events {
+		events[i] = copyAuditEvent(events[i])
+	}
+	return events, nil
+}
+
+// copyAuditEvent creates a deep copy of an AuditEvent.
+func copyAuditEvent(event AuditEvent) AuditEvent {
+	if event.Details != nil {
+		details := make(map[string]string, len(event.Details))
+		for k, v := range event.Details {
+			details[k] = v
+		}
+		event.Details = details
+	}
+	return event
+}
+
+// recordLoginFailure counts another failed login attempt from a source. The count restarts if the
+// previous failure was before resetBefore.
+func recordLoginFailure(failures LoginFailures, source string, now, resetBefore int64) LoginFailures {
+	if failures.LastFailureAt < resetBefore {
+		failures.Count = 0
+	}
+	failures.Source = source
+	failures.Count++
+	failures.LastFailureAt = now
+	return failures
+}
+
+// Ensure that MemoryStorage obeys the Storage interface.
+var _ Storage = &MemoryStorage{}
@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestMemoryStorageConformance(t *testing.T) {
+	StorageConformance(t, func(t *testing.T) (Storage, func()) {
+		return NewMemoryStorage(), func() {}
+	})
+}
+
+func TestMemoryStorageIsolation(t *testing.T) {
+	s := NewMemoryStorage()
+	a, err := NewAccount(testHasher, "someone", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+	if err := s.CreateAccount(a); err != nil {
+		t.Fatalf("Unexpected error creating account: %v", err)
+	}
+
+	a.Administrator = true
+
+	found, err := s.FindAccount("someone")
+	if err != nil {
+		t.Fatalf("Unexpected error finding account: %v", err)
+	}
+	if found.Administrator {
+		t.Error("Modifying the original account changed stored state")
+	}
+}
+
+func TestMemoryStorageKeyIsolation(t *testing.T) {
+	s := NewMemoryStorage()
+	a, err := NewAccount(testHasher, "someone", "secret")
+	if err != nil {
+		t.Fatalf("Unable to create account: %v", err)
+	}
+	if err := s.CreateAccount(a); err != nil {
+		t.Fatalf("Unexpected error creating account: %v", err)
+	}
+
+	key := apiKeyRecord("123abc")
+	key.Scopes = []string{"jobs:read"}
+	if err := s.AddKeyToAccount("someone", key); err != nil {
+		t.Fatalf("Unexpected error adding a key: %v", err)
+	}
+
+	key.Scopes[0] = ScopeKeysManage
+
+	found, err := s.FindKey("someone", key.Digest)
+	if err != nil {
+		t.Fatalf("Unexpected error finding a key: %v", err)
+	}
+	if found.HasScope(ScopeKeysManage) {
+		t.Error("Modifying the original key's scopes changed stored state")
+	}
+}
@@ -0,0 +1,1344 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqlDialect captures the differences between the SQL databases that SQLStorage supports.
+type sqlDialect struct {
+	Name string
+
+	// Driver is the database/sql driver name used to open connections.
+	Driver string
+
+	// BlobType and SerialType are column types used in schema migrations.
+	BlobType   string
+	SerialType string
+
+	// NumberedParams is true if the database expects $1, $2, ... rather than ? placeholders.
+	NumberedParams bool
+}
+
+var (
+	postgresDialect = sqlDialect{
+		Name:           "postgres",
+		Driver:         "postgres",
+		BlobType:       "BYTEA",
+		SerialType:     "SERIAL PRIMARY KEY",
+		NumberedParams: true,
+	}
+
+	sqliteDialect = sqlDialect{
+		Name:       "sqlite3",
+		Driver:     "sqlite3",
+		BlobType:   "BLOB",
+		SerialType: "INTEGER PRIMARY KEY AUTOINCREMENT",
+	}
+)
+
+// parseDatabaseURL determines the SQL dialect and the driver-specific data source name to use from
+// a database URL. PostgreSQL URLs are passed to the driver unchanged. SQLite URLs have the form
+// "sqlite3://path/to/file.db".
+func parseDatabaseURL(url string) (sqlDialect, string, error) {
+	switch {
+	case strings.HasPrefix(url, "postgres://"), strings.HasPrefix(url, "postgresql://"):
+		return postgresDialect, url, nil
+	case strings.HasPrefix(url, "sqlite3://"):
+		return sqliteDialect, strings.TrimPrefix(url, "sqlite3://"), nil
+	case strings.HasPrefix(url, "sqlite://"):
+		return sqliteDialect, strings.TrimPrefix(url, "sqlite://"), nil
+	default:
+		return sqlDialect{}, "", fmt.Errorf("Unsupported database URL: %s", url)
+	}
+}
+
+// rebind rewrites ? placeholders in a query into the form expected by the dialect.
+func (d sqlDialect) rebind(query string) string {
+	if !d.NumberedParams {
+		return query
+	}
+
+	var b bytes.Buffer
+	n := 0
+	for _, ch := range query {
+		if ch == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(ch)
+	}
+	return b.String()
+}
+
+// isUniqueViolation returns true if err was caused by a primary key or uniqueness constraint.
+func (d sqlDialect) isUniqueViolation(err error) bool {
+	switch e := err.(type) {
+	case *pq.Error:
+		return e.Code == "23505"
+	case sqlite3.Error:
+		return e.ExtendedCode == sqlite3.ErrConstraintPrimaryKey ||
+			e.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+	return false
+}
+
+// storageError translates errors reported by database/sql and its drivers into the
+// backend-neutral Storage errors.
+func (d sqlDialect) storageError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if d.isUniqueViolation(err) {
+		return ErrAccountExists
+	}
+
+	if _, ok := err.(net.Error); ok || err == driver.ErrBadConn {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Unable to reach the database.")
+		return ErrUnavailable
+	}
+
+	return err
+}
+
+// sqlExecer is satisfied by both *sql.DB and *sql.Tx.
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// sqlScanner is satisfied by both *sql.Row and *sql.Rows.
+type sqlScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// sqlMigration is a single, versioned schema change. Migrations are applied in order, each within
+// its own transaction, and are recorded in the schema_migrations table once they succeed.
+type sqlMigration struct {
+	Version     int
+	Description string
+	Up          func(tx *sql.Tx, d sqlDialect) error
+}
+
+// execAll returns a migration function that executes each statement in turn.
+func execAll(statements ...string) func(*sql.Tx, sqlDialect) error {
+	return func(tx *sql.Tx, d sqlDialect) error {
+		for _, statement := range statements {
+			statement = strings.NewReplacer(
+				"{{blob}}", d.BlobType,
+				"{{serial}}", d.SerialType,
+			).Replace(statement)
+
+			if _, err := tx.Exec(statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// sqlMigrations lists every schema migration. Never modify or reorder a migration that's already
+// been released; append a new one instead.
+var sqlMigrations = []sqlMigration{
+	{
+		Version:     1,
+		Description: "Create the accounts and api_keys tables.",
+		Up: execAll(
+			`CREATE TABLE accounts (
+				name VARCHAR(255) PRIMARY KEY,
+				password {{blob}} NOT NULL,
+				admin BOOLEAN NOT NULL DEFAULT FALSE,
+				created_at BIGINT NOT NULL,
+				updated_at BIGINT NOT NULL
+			)`,
+			`CREATE TABLE api_keys (
+				id {{serial}},
+				account_name VARCHAR(255) NOT NULL REFERENCES accounts (name),
+				api_key VARCHAR(255) NOT NULL,
+				UNIQUE (account_name, api_key)
+			)`,
+		),
+	},
+	{
+		Version:     2,
+		Description: "Store API keys as digests instead of plaintext.",
+		Up:          migrateHashAPIKeys,
+	},
+	{
+		Version:     3,
+		Description: "Add IDs, labels and usage timestamps to API keys.",
+		Up: execAll(
+			`ALTER TABLE api_keys ADD COLUMN key_id VARCHAR(32) NOT NULL DEFAULT ''`,
+			`ALTER TABLE api_keys ADD COLUMN label VARCHAR(255) NOT NULL DEFAULT ''`,
+			`ALTER TABLE api_keys ADD COLUMN created_at BIGINT NOT NULL DEFAULT 0`,
+			`ALTER TABLE api_keys ADD COLUMN created_from VARCHAR(64) NOT NULL DEFAULT ''`,
+			`ALTER TABLE api_keys ADD COLUMN last_used_at BIGINT NOT NULL DEFAULT 0`,
+			`UPDATE api_keys SET key_id = SUBSTR(digest, 1, 16)`,
+		),
+	},
+	{
+		Version:     4,
+		Description: "Add expiration times to API keys.",
+		Up: execAll(
+			`ALTER TABLE api_keys ADD COLUMN expires_at BIGINT NOT NULL DEFAULT 0`,
+			`CREATE INDEX api_keys_expires_at ON api_keys (expires_at)`,
+		),
+	},
+	{
+		Version:     5,
+		Description: "Add scopes to API keys.",
+		Up: execAll(
+			`ALTER TABLE api_keys ADD COLUMN scopes TEXT NOT NULL DEFAULT ''`,
+		),
+	},
+	{
+		Version:     6,
+		Description: "Add password reset tokens to accounts.",
+		Up: execAll(
+			`ALTER TABLE accounts ADD COLUMN reset_digest TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE accounts ADD COLUMN reset_expires_at BIGINT NOT NULL DEFAULT 0`,
+		),
+	},
+	{
+		Version:     7,
+		Description: "Allow accounts to be disabled.",
+		Up: execAll(
+			`ALTER TABLE accounts ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE`,
+			`ALTER TABLE accounts ADD COLUMN disabled_reason TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE accounts ADD COLUMN disabled_at BIGINT NOT NULL DEFAULT 0`,
+		),
+	},
+	{
+		Version:     8,
+		Description: "Index accounts by creation time, for listings.",
+		Up: execAll(
+			`CREATE INDEX accounts_created_at ON accounts (created_at, name)`,
+		),
+	},
+	{
+		Version:     9,
+		Description: "Count failed login attempts.",
+		Up: execAll(
+			`CREATE TABLE login_failures (
+				source VARCHAR(255) PRIMARY KEY,
+				failures INTEGER NOT NULL,
+				last_failure_at BIGINT NOT NULL
+			)`,
+			`CREATE INDEX login_failures_last_failure_at ON login_failures (last_failure_at)`,
+		),
+	},
+	{
+		Version:     10,
+		Description: "Add TOTP two-factor authentication to accounts.",
+		Up: execAll(
+			`ALTER TABLE accounts ADD COLUMN totp_secret TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE accounts ADD COLUMN totp_confirmed BOOLEAN NOT NULL DEFAULT FALSE`,
+			`ALTER TABLE accounts ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0`,
+			`CREATE TABLE recovery_codes (
+				account_name VARCHAR(255) NOT NULL REFERENCES accounts (name),
+				digest VARCHAR(64) NOT NULL,
+				PRIMARY KEY (account_name, digest)
+			)`,
+		),
+	},
+	{
+		Version:     11,
+		Description: "Create the audit trail.",
+		Up: execAll(
+			`CREATE TABLE audit_events (
+				id {{serial}},
+				event VARCHAR(255) NOT NULL,
+				account_name VARCHAR(255) NOT NULL,
+				actor VARCHAR(255) NOT NULL,
+				address VARCHAR(255) NOT NULL,
+				certificate_subject TEXT NOT NULL,
+				outcome VARCHAR(16) NOT NULL,
+				time BIGINT NOT NULL,
+				details TEXT NOT NULL
+			)`,
+			`CREATE INDEX audit_events_account_time ON audit_events (account_name, time)`,
+			`CREATE INDEX audit_events_time ON audit_events (time)`,
+		),
+	},
+	{
+		Version:     12,
+		Description: "Record the lifetime and rotation of API keys.",
+		Up: execAll(
+			`ALTER TABLE api_keys ADD COLUMN lifetime BIGINT NOT NULL DEFAULT 0`,
+			`ALTER TABLE api_keys ADD COLUMN rotated BOOLEAN NOT NULL DEFAULT FALSE`,
+		),
+	},
+}
+
+// migrateHashAPIKeys replaces the plaintext api_key column with a digest and a short prefix. The
+// table is rebuilt, rather than altered, because SQLite can't drop columns.
+func migrateHashAPIKeys(tx *sql.Tx, d sqlDialect) error {
+	err := execAll(`CREATE TABLE hashed_api_keys (
+		id {{serial}},
+		account_name VARCHAR(255) NOT NULL REFERENCES accounts (name),
+		prefix VARCHAR(16) NOT NULL,
+		digest VARCHAR(64) NOT NULL,
+		UNIQUE (account_name, digest)
+	)`)(tx, d)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`SELECT account_name, api_key FROM api_keys ORDER BY id`)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	var keys []APIKey
+	for rows.Next() {
+		var name, plaintext string
+		if err := rows.Scan(&name, &plaintext); err != nil {
+			rows.Close()
+			return err
+		}
+		names = append(names, name)
+		keys = append(keys, apiKeyRecord(plaintext))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i, key := range keys {
+		_, err := tx.Exec(
+			d.rebind(`INSERT INTO hashed_api_keys (account_name, prefix, digest) VALUES (?, ?, ?)`),
+			names[i], key.Prefix, key.Digest,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return execAll(
+		`DROP TABLE api_keys`,
+		`ALTER TABLE hashed_api_keys RENAME TO api_keys`,
+	)(tx, d)
+}
+
+// SQLStorage is a Storage implementation backed by a SQL database through database/sql. Accounts
+// and their API keys are stored in separate tables.
+type SQLStorage struct {
+	DB      *sql.DB
+	Dialect sqlDialect
+}
+
+// NewSQLStorage connects to the database specified by the DatabaseURL setting and brings its schema
+// up to date.
+func NewSQLStorage(c *Context) (*SQLStorage, error) {
+	dialect, dsn, err := parseDatabaseURL(c.DatabaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open(dialect.Driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if dialect == sqliteDialect {
+		// SQLite only permits a single writer, and each connection to ":memory:" gets its own
+		// database.
+		db.SetMaxOpenConns(1)
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	storage := &SQLStorage{DB: db, Dialect: dialect}
+	if err := storage.Migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return storage, nil
+}
+
+// Migrate applies any schema migrations that haven't been applied to this database yet.
+func (storage *SQLStorage) Migrate() error {
+	_, err := storage.DB.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at BIGINT NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	var current int
+	err = storage.DB.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range sqlMigrations {
+		if migration.Version <= current {
+			continue
+		}
+
+		if err := storage.applyMigration(migration); err != nil {
+			return fmt.Errorf("Unable to apply schema migration %d: %v", migration.Version, err)
+		}
+
+		log.WithFields(log.Fields{
+			"version":     migration.Version,
+			"description": migration.Description,
+		}).Info("Applied schema migration.")
+	}
+	return nil
+}
+
+func (storage *SQLStorage) applyMigration(migration sqlMigration) error {
+	return storage.transaction(func(tx *sql.Tx) error {
+		if err := migration.Up(tx, storage.Dialect); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(
+			storage.Dialect.rebind(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`),
+			migration.Version, time.Now().UnixNano(),
+		)
+		return err
+	})
+}
+
+// transaction runs fn within a database transaction, committing if it returns nil and rolling back
+// otherwise.
+func (storage *SQLStorage) transaction(fn func(tx *sql.Tx) error) error {
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// accountExists returns true if an account with the given name is present.
+func (storage *SQLStorage) accountExists(q sqlExecer, name string) (bool, error) {
+	var n int
+	err := q.QueryRow(storage.Dialect.rebind(`SELECT COUNT(*) FROM accounts WHERE name = ?`), name).Scan(&n)
+	return n > 0, err
+}
+
+// CreateAccount inserts an account and its API keys.
+func (storage *SQLStorage) CreateAccount(account *Account) error {
+	err := storage.transaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			storage.Dialect.rebind(`INSERT INTO accounts
+				(name, password, admin, disabled, disabled_reason, disabled_at, created_at, updated_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+			account.Name, account.HashedPassword, account.Administrator,
+			account.Disabled, account.DisabledReason, account.DisabledAt,
+			account.CreatedAt, account.UpdatedAt,
+		)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range account.APIKeys {
+			if err := storage.insertKey(tx, account.Name, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return storage.Dialect.storageError(err)
+}
+
+func (storage *SQLStorage) insertKey(q sqlExecer, name string, key APIKey) error {
+	_, err := q.Exec(
+		storage.Dialect.rebind(`INSERT INTO api_keys (account_name, `+apiKeyColumns+`)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		name, key.ID, key.Label, key.Prefix, key.Digest,
+		key.CreatedAt, key.CreatedFrom, key.LastUsedAt, key.ExpiresAt,
+		strings.Join(key.Scopes, " "), key.Lifetime, key.Rotated,
+	)
+	return err
+}
+
+// apiKeyColumns lists the api_keys columns that hold an APIKey, in the order that scanKey reads
+// them.
+const apiKeyColumns = `key_id, label, prefix, digest, created_at, created_from, last_used_at,
+	expires_at, scopes, lifetime, rotated`
+
+// scanKey reads an APIKey from a row selected with apiKeyColumns.
+func scanKey(row sqlScanner) (APIKey, error) {
+	var key APIKey
+	var scopes string
+	err := row.Scan(&key.ID, &key.Label, &key.Prefix, &key.Digest,
+		&key.CreatedAt, &key.CreatedFrom, &key.LastUsedAt, &key.ExpiresAt, &scopes,
+		&key.Lifetime, &key.Rotated)
+	if scopes != "" {
+		key.Scopes = strings.Fields(scopes)
+	}
+	return key, err
+}
+
+// accountColumns lists the accounts columns that hold an Account, in the order that scanAccount
+// reads them.
+const accountColumns = `name, password, admin, disabled, disabled_reason, disabled_at,
+	created_at, updated_at, reset_digest, reset_expires_at, totp_secret, totp_confirmed,
+	totp_last_step`
+
+// scanAccount reads an Account, without its API keys or recovery codes, from a row selected with
+// accountColumns.
+func scanAccount(row sqlScanner) (*Account, error) {
+	account := &Account{}
+	var reset ResetToken
+	var twoFactor TwoFactor
+	err := row.Scan(&account.Name, &account.HashedPassword, &account.Administrator,
+		&account.Disabled, &account.DisabledReason, &account.DisabledAt,
+		&account.CreatedAt, &account.UpdatedAt, &reset.Digest, &reset.ExpiresAt,
+		&twoFactor.Secret, &twoFactor.Confirmed, &twoFactor.LastStep)
+	if reset.Digest != "" {
+		account.PasswordReset = &reset
+	}
+	if twoFactor.Secret != "" {
+		account.TwoFactor = &twoFactor
+	}
+	return account, err
+}
+
+// FindAccount queries for an existing account with a specified name.
+func (storage *SQLStorage) FindAccount(name string) (*Account, error) {
+	account, err := scanAccount(storage.DB.QueryRow(
+		storage.Dialect.rebind(`SELECT `+accountColumns+` FROM accounts WHERE name = ?`),
+		name,
+	))
+	if err == sql.ErrNoRows {
+		return nil, ErrAccountNotFound
+	}
+	if err != nil {
+		return nil, storage.Dialect.storageError(err)
+	}
+
+	if account.APIKeys, err = storage.findKeys(name); err != nil {
+		return nil, storage.Dialect.storageError(err)
+	}
+	if account.TwoFactor != nil {
+		if account.TwoFactor.RecoveryCodes, err = storage.findRecoveryCodes(name); err != nil {
+			return nil, storage.Dialect.storageError(err)
+		}
+	}
+	return account, nil
+}
+
+// findRecoveryCodes returns the digests of an account's unused recovery codes.
+func (storage *SQLStorage) findRecoveryCodes(name string) ([]string, error) {
+	rows, err := storage.DB.Query(
+		storage.Dialect.rebind(`SELECT digest FROM recovery_codes WHERE account_name = ? ORDER BY digest`),
+		name,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var digests []string
+	for rows.Next() {
+		var digest string
+		if err := rows.Scan(&digest); err != nil {
+			return nil, err
+		}
+		digests = append(digests, digest)
+	}
+	return digests, rows.Err()
+}
+
+// findKeys returns every API key on an account, in the order that they were added.
+func (storage *SQLStorage) findKeys(name string) ([]APIKey, error) {
+	rows, err := storage.DB.Query(
+		storage.Dialect.rebind(`SELECT `+apiKeyColumns+`
+			FROM api_keys WHERE account_name = ? ORDER BY id`),
+		name,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []APIKey
+	for rows.Next() {
+		key, err := scanKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// ListAccounts returns a page of the accounts that match a query.
+func (storage *SQLStorage) ListAccounts(query AccountQuery) (AccountPage, error) {
+	cursor, err := query.normalize()
+	if err != nil {
+		return AccountPage{}, err
+	}
+
+	var conditions []string
+	var args []interface{}
+	where := func(condition string, values ...interface{}) {
+		conditions = append(conditions, condition)
+		args = append(args, values...)
+	}
+
+	if query.Prefix != "" {
+		where(`LOWER(name) LIKE ? ESCAPE '\'`, likePattern(query.Prefix)+"%")
+	}
+	if query.Contains != "" {
+		where(`LOWER(name) LIKE ? ESCAPE '\'`, "%"+likePattern(query.Contains)+"%")
+	}
+	if query.Administrator != nil {
+		where(`admin = ?`, *query.Administrator)
+	}
+	if query.Disabled != nil {
+		where(`disabled = ?`, *query.Disabled)
+	}
+	if query.CreatedAfter != 0 {
+		where(`created_at > ?`, query.CreatedAfter)
+	}
+	if query.CreatedBefore != 0 {
+		where(`created_at < ?`, query.CreatedBefore)
+	}
+
+	after, order := ">", ""
+	if query.Descending {
+		after, order = "<", " DESC"
+	}
+	orderBy := "name" + order
+	if query.Sort == AccountSortCreated {
+		orderBy = "created_at" + order + ", name" + order
+	}
+
+	if cursor != nil {
+		switch query.Sort {
+		case AccountSortCreated:
+			where(`(created_at `+after+` ? OR (created_at = ? AND name `+after+` ?))`,
+				cursor.CreatedAt, cursor.CreatedAt, cursor.Name)
+		default:
+			where(`name `+after+` ?`, cursor.Name)
+		}
+	}
+
+	statement := `SELECT ` + accountColumns + ` FROM accounts`
+	if len(conditions) > 0 {
+		statement += ` WHERE ` + strings.Join(conditions, ` AND `)
+	}
+	statement += ` ORDER BY ` + orderBy + ` LIMIT ?`
+	args = append(args, query.Limit+1)
+
+	rows, err := storage.DB.Query(storage.Dialect.rebind(statement), args...)
+	if err != nil {
+		return AccountPage{}, storage.Dialect.storageError(err)
+	}
+
+	var accounts []*Account
+	for rows.Next() {
+		account, err := scanAccount(rows)
+		if err != nil {
+			rows.Close()
+			return AccountPage{}, err
+		}
+		accounts = append(accounts, account)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return AccountPage{}, storage.Dialect.storageError(err)
+	}
+
+	page := query.page(accounts)
+
+	// Read keys only once the accounts have been read, so that a single connection suffices.
+	for _, account := range page.Accounts {
+		if account.APIKeys, err = storage.findKeys(account.Name); err != nil {
+			return AccountPage{}, storage.Dialect.storageError(err)
+		}
+	}
+	return page, nil
+}
+
+// likeEscaper escapes the characters that are special within a LIKE pattern.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// likePattern converts text into part of a LIKE pattern that matches it literally, ignoring case.
+// The pattern must be compared with LOWER() of a column.
+func likePattern(text string) string {
+	return likeEscaper.Replace(strings.ToLower(text))
+}
+
+// DeleteAccount removes an account, along with all of its API keys and recovery codes.
+func (storage *SQLStorage) DeleteAccount(name string) error {
+	return storage.Dialect.storageError(storage.transaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(storage.Dialect.rebind(`DELETE FROM api_keys WHERE account_name = ?`), name)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(storage.Dialect.rebind(`DELETE FROM recovery_codes WHERE account_name = ?`), name)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.Exec(storage.Dialect.rebind(`DELETE FROM accounts WHERE name = ?`), name)
+		if err != nil {
+			return err
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrAccountNotFound
+		}
+		return nil
+	}))
+}
+
+// SetAccountDisabled disables or enables an account.
+func (storage *SQLStorage) SetAccountDisabled(name string, disabled bool, reason string, at int64) error {
+	var account Account
+	account.SetDisabled(disabled, reason, at)
+
+	result, err := storage.DB.Exec(
+		storage.Dialect.rebind(`UPDATE accounts SET disabled = ?, disabled_reason = ?, disabled_at = ?
+			WHERE name = ?`),
+		account.Disabled, account.DisabledReason, account.DisabledAt, name,
+	)
+	if err != nil {
+		return storage.Dialect.storageError(err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return storage.Dialect.storageError(err)
+	}
+	if n == 0 {
+		return ErrAccountNotFound
+	}
+	return nil
+}
+
+// SetAdministrator grants or revokes an account's administrator status.
+func (storage *SQLStorage) SetAdministrator(name string, admin bool) error {
+	result, err := storage.DB.Exec(
+		storage.Dialect.rebind(`UPDATE accounts SET admin = ? WHERE name = ?`),
+		admin, name,
+	)
+	if err != nil {
+		return storage.Dialect.storageError(err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return storage.Dialect.storageError(err)
+	}
+	if n == 0 {
+		return ErrAccountNotFound
+	}
+	return nil
+}
+
+// HasAdministrator returns true if any enabled account is an administrator.
+func (storage *SQLStorage) HasAdministrator() (bool, error) {
+	var n int
+	err := storage.DB.QueryRow(
+		storage.Dialect.rebind(`SELECT COUNT(*) FROM accounts WHERE admin = ? AND disabled = ?`),
+		true, false,
+	).Scan(&n)
+	if err != nil {
+		return false, storage.Dialect.storageError(err)
+	}
+	return n > 0, nil
+}
+
+// UpdatePassword replaces an account's password hash. If revokeKeys is true, every API key on the
+// account is removed within the same transaction.
+func (storage *SQLStorage) UpdatePassword(name string, hashed []byte, updatedAt int64, revokeKeys bool) error {
+	return storage.Dialect.storageError(storage.transaction(func(tx *sql.Tx) error {
+		result, err := tx.Exec(
+			storage.Dialect.rebind(`UPDATE accounts SET password = ?, updated_at = ? WHERE name = ?`),
+			hashed, updatedAt, name,
+		)
+		if err != nil {
+			return err
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrAccountNotFound
+		}
+
+		if revokeKeys {
+			_, err = tx.Exec(storage.Dialect.rebind(`DELETE FROM api_keys WHERE account_name = ?`), name)
+		}
+		return err
+	}))
+}
+
+// RehashPassword replaces an account's password hash, unless it's changed since it was verified.
+func (storage *SQLStorage) RehashPassword(name string, current, hashed []byte) error {
+	result, err := storage.DB.Exec(
+		storage.Dialect.rebind(`UPDATE accounts SET password = ? WHERE name = ? AND password = ?`),
+		hashed, name, current,
+	)
+	if err != nil {
+		return storage.Dialect.storageError(err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return storage.Dialect.storageError(err)
+	}
+	if n == 0 {
+		exists, err := storage.accountExists(storage.DB, name)
+		if err != nil {
+			return storage.Dialect.storageError(err)
+		}
+		if !exists {
+			return ErrAccountNotFound
+		}
+	}
+	return nil
+}
+
+// SetResetToken replaces an account's outstanding password reset token.
+func (storage *SQLStorage) SetResetToken(name string, token ResetToken) error {
+	result, err := storage.DB.Exec(
+		storage.Dialect.rebind(`UPDATE accounts SET reset_digest = ?, reset_expires_at = ? WHERE name = ?`),
+		token.Digest, token.ExpiresAt, name,
+	)
+	if err != nil {
+		return storage.Dialect.storageError(err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return storage.Dialect.storageError(err)
+	}
+	if n == 0 {
+		return ErrAccountNotFound
+	}
+	return nil
+}
+
+// ResetPassword consumes an account's password reset token and replaces its password hash.
+func (storage *SQLStorage) ResetPassword(name, digest string, hashed []byte, now int64) error {
+	result, err := storage.DB.Exec(
+		storage.Dialect.rebind(`UPDATE accounts
+			SET password = ?, updated_at = ?, reset_digest = '', reset_expires_at = 0
+			WHERE name = ? AND reset_digest = ? AND reset_digest <> '' AND reset_expires_at > ?`),
+		hashed, now, name, digest, now,
+	)
+	if err != nil {
+		return storage.Dialect.storageError(err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return storage.Dialect.storageError(err)
+	}
+	if n > 0 {
+		return nil
+	}
+
+	ok, err := storage.accountExists(storage.DB, name)
+	if err != nil {
+		return storage.Dialect.storageError(err)
+	}
+	if !ok {
+		return ErrAccountNotFound
+	}
+	return ErrResetTokenInvalid
+}
+
+// SetTwoFactor replaces or removes an account's TOTP enrollment, along with its recovery codes.
+func (storage *SQLStorage) SetTwoFactor(name string, twoFactor *TwoFactor) error {
+	if twoFactor == nil {
+		twoFactor = &TwoFactor{}
+	}
+
+	return storage.Dialect.storageError(storage.transaction(func(tx *sql.Tx) error {
+		result, err := tx.Exec(
+			storage.Dialect.rebind(`UPDATE accounts
+				SET totp_secret = ?, totp_confirmed = ?, totp_last_step = ? WHERE name = ?`),
+			twoFactor.Secret, twoFactor.Confirmed, twoFactor.LastStep, name,
+		)
+		if err != nil {
+			return err
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrAccountNotFound
+		}
+
+		_, err = tx.Exec(storage.Dialect.rebind(`DELETE FROM recovery_codes WHERE account_name = ?`), name)
+		if err != nil {
+			return err
+		}
+
+		for _, digest := range twoFactor.RecoveryCodes {
+			_, err := tx.Exec(
+				storage.Dialect.rebind(`INSERT INTO recovery_codes (account_name, digest) VALUES (?, ?)`),
+				name, digest,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+// UseTwoFactorStep records the time step of an accepted TOTP code, unless it's already been used.
+func (storage *SQLStorage) UseTwoFactorStep(name string, step int64) error {
+	result, err := storage.DB.Exec(
+		storage.Dialect.rebind(`UPDATE accounts SET totp_last_step = ?
+			WHERE name = ? AND totp_secret <> '' AND totp_last_step < ?`),
+		step, name, step,
+	)
+	if err != nil {
+		return storage.Dialect.storageError(err)
+	}
+	return storage.twoFactorInvalid(result, name)
+}
+
+// UseRecoveryCode consumes one of an account's recovery codes.
+func (storage *SQLStorage) UseRecoveryCode(name, digest string) error {
+	result, err := storage.DB.Exec(
+		storage.Dialect.rebind(`DELETE FROM recovery_codes WHERE account_name = ? AND digest = ?`),
+		name, digest,
+	)
+	if err != nil {
+		return storage.Dialect.storageError(err)
+	}
+	return storage.twoFactorInvalid(result, name)
+}
+
+// twoFactorInvalid inspects the result of a statement that used a second factor. If no rows were
+// affected, it determines whether the account was missing or the second factor was invalid.
+func (storage *SQLStorage) twoFactorInvalid(result sql.Result, name string) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return storage.Dialect.storageError(err)
+	}
+	if n > 0 {
+		return nil
+	}
+
+	ok, err := storage.accountExists(storage.DB, name)
+	if err != nil {
+		return storage.Dialect.storageError(err)
+	}
+	if !ok {
+		return ErrAccountNotFound
+	}
+	return ErrTwoFactorInvalid
+}
+
+// AddKeyToAccount appends a newly generated API key to an existing account.
+func (storage *SQLStorage) AddKeyToAccount(name string, key APIKey) error {
+	return storage.Dialect.storageError(storage.transaction(func(tx *sql.Tx) error {
+		ok, err := storage.accountExists(tx, name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrAccountNotFound
+		}
+
+		return storage.insertKey(tx, name, key)
+	}))
+}
+
+// RevokeKeyFromAccount removes the API key with a specified digest from an account.
+func (storage *SQLStorage) RevokeKeyFromAccount(name, digest string) error {
+	return storage.Dialect.storageError(storage.transaction(func(tx *sql.Tx) error {
+		ok, err := storage.accountExists(tx, name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrAccountNotFound
+		}
+
+		result, err := tx.Exec(
+			storage.Dialect.rebind(`DELETE FROM api_keys WHERE account_name = ? AND digest = ?`),
+			name, digest,
+		)
+		if err != nil {
+			return err
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrKeyNotFound
+		}
+		return nil
+	}))
+}
+
+// RotateKey adds a replacement API key to an account and sets the expiry time of the key with a
+// specified digest.
+func (storage *SQLStorage) RotateKey(name, digest string, replacement APIKey, expiresAt int64) error {
+	return storage.Dialect.storageError(storage.transaction(func(tx *sql.Tx) error {
+		ok, err := storage.accountExists(tx, name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrAccountNotFound
+		}
+
+		result, err := tx.Exec(
+			storage.Dialect.rebind(`UPDATE api_keys SET expires_at = ?, rotated = ?
+				WHERE account_name = ? AND digest = ? AND rotated = ?`),
+			expiresAt, true, name, digest, false,
+		)
+		if err != nil {
+			return err
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			// Distinguish a key that's already been rotated from a missing one.
+			var existing int
+			err := tx.QueryRow(
+				storage.Dialect.rebind(`SELECT COUNT(*) FROM api_keys WHERE account_name = ? AND digest = ?`),
+				name, digest,
+			).Scan(&existing)
+			if err != nil {
+				return err
+			}
+			if existing > 0 {
+				return ErrKeyRotated
+			}
+			return ErrKeyNotFound
+		}
+
+		return storage.insertKey(tx, name, replacement)
+	}))
+}
+
+// RevokeAllKeys removes every API key from an account. If replacement isn't nil, it becomes the
+// account's only key.
+func (storage *SQLStorage) RevokeAllKeys(name string, replacement *APIKey) (int, error) {
+	var n int64
+	err := storage.transaction(func(tx *sql.Tx) error {
+		ok, err := storage.accountExists(tx, name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrAccountNotFound
+		}
+
+		result, err := tx.Exec(storage.Dialect.rebind(`DELETE FROM api_keys WHERE account_name = ?`), name)
+		if err != nil {
+			return err
+		}
+		if n, err = result.RowsAffected(); err != nil {
+			return err
+		}
+
+		if replacement != nil {
+			return storage.insertKey(tx, name, *replacement)
+		}
+		return nil
+	})
+	return int(n), storage.Dialect.storageError(err)
+}
+
+// TouchAPIKey records the time at which an API key was last used.
+func (storage *SQLStorage) TouchAPIKey(name, digest string, usedAt int64) error {
+	result, err := storage.DB.Exec(
+		storage.Dialect.rebind(`UPDATE api_keys SET last_used_at = ? WHERE account_name = ? AND digest = ?`),
+		usedAt, name, digest,
+	)
+	if err != nil {
+		return storage.Dialect.storageError(err)
+	}
+	return storage.keyNotFound(result, name)
+}
+
+// keyNotFound inspects the result of a statement that modified a single API key. If no rows were
+// affected, it determines whether the account or the key was missing.
+func (storage *SQLStorage) keyNotFound(result sql.Result, name string) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	ok, err := storage.accountExists(storage.DB, name)
+	if err != nil {
+		return storage.Dialect.storageError(err)
+	}
+	if !ok {
+		return ErrAccountNotFound
+	}
+	return ErrKeyNotFound
+}
+
+// FindKey returns the unexpired API key with the provided digest from the named account. The
+// account and the key are read within a single transaction, so that a key can't be returned after
+// its account is disabled or the key itself is revoked.
+func (storage *SQLStorage) FindKey(name, digest string) (*APIKey, error) {
+	var key APIKey
+	err := storage.transaction(func(tx *sql.Tx) error {
+		var disabled bool
+		err := tx.QueryRow(
+			storage.Dialect.rebind(`SELECT disabled FROM accounts WHERE name = ?`), name,
+		).Scan(&disabled)
+		if err == sql.ErrNoRows {
+			return ErrAccountNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		key, err = scanKey(tx.QueryRow(
+			storage.Dialect.rebind(`SELECT `+apiKeyColumns+` FROM api_keys
+				WHERE account_name = ? AND digest = ? AND (expires_at = 0 OR expires_at > ?)`),
+			name, digest, time.Now().UnixNano(),
+		))
+		if err == sql.ErrNoRows {
+			return ErrKeyNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		// Only report a disabled account to callers that hold one of its valid keys.
+		if disabled {
+			return ErrAccountDisabled
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, storage.Dialect.storageError(err)
+	}
+	return &key, nil
+}
+
+// RemoveExpiredKeys deletes every API key that expired before a specified time.
+func (storage *SQLStorage) RemoveExpiredKeys(before int64) (int, error) {
+	var n int
+	err := storage.transaction(func(tx *sql.Tx) error {
+		condition := `expires_at > 0 AND expires_at < ?`
+
+		err := tx.QueryRow(
+			storage.Dialect.rebind(`SELECT COUNT(DISTINCT account_name) FROM api_keys WHERE `+condition),
+			before,
+		).Scan(&n)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(storage.Dialect.rebind(`DELETE FROM api_keys WHERE `+condition), before)
+		return err
+	})
+	return n, storage.Dialect.storageError(err)
+}
+
+// FindLoginFailures returns the failed login attempts counted for a source.
+func (storage *SQLStorage) FindLoginFailures(source string) (LoginFailures, error) {
+	failures := LoginFailures{Source: source}
+	err := storage.DB.QueryRow(
+		storage.Dialect.rebind(`SELECT failures, last_failure_at FROM login_failures WHERE source = ?`),
+		source,
+	).Scan(&failures.Count, &failures.LastFailureAt)
+	if err == sql.ErrNoRows {
+		return failures, nil
+	}
+	if err != nil {
+		return LoginFailures{}, storage.Dialect.storageError(err)
+	}
+	return failures, nil
+}
+
+// RecordLoginFailure counts a failed login attempt from a source within a single transaction. If
+// another transaction counts the source's first failure at the same time, it's retried once.
+func (storage *SQLStorage) RecordLoginFailure(source string, now, resetBefore int64) (LoginFailures, error) {
+	failures := LoginFailures{Source: source}
+	record := func(tx *sql.Tx) error {
+		result, err := tx.Exec(
+			storage.Dialect.rebind(`UPDATE login_failures SET
+				failures = CASE WHEN last_failure_at < ? THEN 1 ELSE failures + 1 END,
+				last_failure_at = ?
+				WHERE source = ?`),
+			resetBefore, now, source,
+		)
+		if err != nil {
+			return err
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			_, err = tx.Exec(
+				storage.Dialect.rebind(`INSERT INTO login_failures (source, failures, last_failure_at)
+					VALUES (?, 1, ?)`),
+				source, now,
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.QueryRow(
+			storage.Dialect.rebind(`SELECT failures, last_failure_at FROM login_failures WHERE source = ?`),
+			source,
+		).Scan(&failures.Count, &failures.LastFailureAt)
+	}
+
+	err := storage.transaction(record)
+	if storage.Dialect.isUniqueViolation(err) {
+		err = storage.transaction(record)
+	}
+	if err != nil {
+		return LoginFailures{}, storage.Dialect.storageError(err)
+	}
+	return failures, nil
+}
+
+// ClearLoginFailures forgets the failed login attempts counted for a source.
+func (storage *SQLStorage) ClearLoginFailures(source string) error {
+	_, err := storage.DB.Exec(storage.Dialect.rebind(`DELETE FROM login_failures WHERE source = ?`), source)
+	return storage.Dialect.storageError(err)
+}
+
+// RemoveLoginFailures forgets every source whose last failed login attempt was before a specified
+// time.
+func (storage *SQLStorage) RemoveLoginFailures(before int64) (int, error) {
+	result, err := storage.DB.Exec(
+		storage.Dialect.rebind(`DELETE FROM login_failures WHERE last_failure_at < ?`),
+		before,
+	)
+	if err != nil {
+		return 0, storage.Dialect.storageError(err)
+	}
+
+	n, err := result.RowsAffected()
+	return int(n), storage.Dialect.storageError(err)
+}
+
+// RecordAuditEvent appends an event to the audit trail. Its details are stored as a JSON object.
+// Audit events don't reference the accounts table, so that they outlive the accounts they describe.
+func (storage *SQLStorage) RecordAuditEvent(event AuditEvent) error {
+	details, err := json.Marshal(event.Details)
+	if err != nil {
+		return err
+	}
+
+	_, err = storage.DB.Exec(
+		storage.Dialect.rebind(`INSERT INTO audit_events
+			(event, account_name, actor, address, certificate_subject, outcome, time, details)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+		event.Event, event.Account, event.Actor, event.Address, event.CertificateSubject,
+		event.Outcome, event.Time, string(details),
+	)
+	return storage.Dialect.storageError(err)
+}
+
+// FindAuditEvents returns the events in the audit trail that match a query.
+func (storage *SQLStorage) FindAuditEvents(query AuditQuery) ([]AuditEvent, error) {
+	query.normalize()
+
+	var conditions []string
+	var args []interface{}
+	where := func(condition string, values ...interface{}) {
+		conditions = append(conditions, condition)
+		args = append(args, values...)
+	}
+
+	if query.Account != "" {
+		where(`account_name = ?`, query.Account)
+	}
+	if query.Since != 0 {
+		where(`time >= ?`, query.Since)
+	}
+	if query.Until != 0 {
+		where(`time < ?`, query.Until)
+	}
+
+	statement := `SELECT event, account_name, actor, address, certificate_subject, outcome, time, details
+		FROM audit_events`
+	if len(conditions) > 0 {
+		statement += ` WHERE ` + strings.Join(conditions, ` AND `)
+	}
+	statement += ` ORDER BY time, id LIMIT ?`
+	args = append(args, query.Limit)
+
+	rows, err := storage.DB.Query(storage.Dialect.rebind(statement), args...)
+	if err != nil {
+		return nil, storage.Dialect.storageError(err)
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+	for rows.Next() {
+		var event AuditEvent
+		var details string
+		err := rows.Scan(&event.Event, &event.Account, &event.Actor, &event.Address,
+			&event.CertificateSubject, &event.Outcome, &event.Time, &details)
+		if err != nil {
+			return nil, storage.Dialect.storageError(err)
+		}
+		if err := json.Unmarshal([]byte(details), &event.Details); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, storage.Dialect.storageError(err)
+	}
+	return events, nil
+}
+
+// Ensure that SQLStorage obeys the Storage interface.
+var _ Storage = &SQLStorage{}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TempSQLStorage(t *testing.T) (*SQLStorage, func()) {
+	dir, err := ioutil.TempDir("", "auth-store-sql")
+	if err != nil {
+		t.Fatalf("Unable to create a temporary directory: %v", err)
+	}
+
+	c := &Context{Settings: Settings{DatabaseURL: "sqlite3://" + filepath.Join(dir, "auth.db")}}
+	s, err := NewSQLStorage(c)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Unable to open SQL storage: %v", err)
+	}
+
+	return s, func() {
+		s.DB.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestParseDatabaseURL(t *testing.T) {
+	d, dsn, err := parseDatabaseURL("postgres://auth@db.example.com/auth?sslmode=disable")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing a PostgreSQL URL: %v", err)
+	}
+	if d.Name != "postgres" || dsn != "postgres://auth@db.example.com/auth?sslmode=disable" {
+		t.Errorf("Unexpected dialect [%s] or DSN [%s]", d.Name, dsn)
+	}
+
+	d, dsn, err = parseDatabaseURL("sqlite3:///var/lib/auth.db")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing a SQLite URL: %v", err)
+	}
+	if d.Name != "sqlite3" || dsn != "/var/lib/auth.db" {
+		t.Errorf("Unexpected dialect [%s] or DSN [%s]", d.Name, dsn)
+	}
+
+	if _, _, err := parseDatabaseURL("oracle://nope"); err == nil {
+		t.Error("Expected an error for an unsupported database")
+	}
+}
+
+func TestSQLDialectRebind(t *testing.T) {
+	q := "SELECT a FROM b WHERE c = ? AND d = ?"
+
+	if r := sqliteDialect.rebind(q); r != q {
+		t.Errorf("Expected SQLite query to be unchanged, but got [%s]", r)
+	}
+
+	if r := postgresDialect.rebind(q); r != "SELECT a FROM b WHERE c = $1 AND d = $2" {
+		t.Errorf("Unexpected PostgreSQL query [%s]", r)
+	}
+}
+
+func TestSQLStorageConformance(t *testing.T) {
+	StorageConformance(t, func(t *testing.T) (Storage, func()) {
+		return TempSQLStorage(t)
+	})
+}
+
+func TestSQLStorageMigrationsAreIdempotent(t *testing.T) {
+	s, cleanup := TempSQLStorage(t)
+	defer cleanup()
+
+	if err := s.Migrate(); err != nil {
+		t.Fatalf("Unexpected error re-running migrations: %v", err)
+	}
+
+	var n int
+	if err := s.DB.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&n); err != nil {
+		t.Fatalf("Unable to count applied migrations: %v", err)
+	}
+	if n != len(sqlMigrations) {
+		t.Errorf("Expected %d applied migrations, but found %d", len(sqlMigrations), n)
+	}
+}
+
+func TestSQLStorageMigratePlaintextKeys(t *testing.T) {
+	s, cleanup := TempSQLStorage(t)
+	defer cleanup()
+
+	// Rebuild the database at schema version 1, which stored API keys in plaintext.
+	tables := []string{
+		"audit_events", "recovery_codes", "login_failures", "api_keys", "accounts", "schema_migrations",
+	}
+	for _, table := range tables {
+		if _, err := s.DB.Exec(`DROP TABLE ` + table); err != nil {
+			t.Fatalf("Unable to drop table %s: %v", table, err)
+		}
+	}
+
+	all := sqlMigrations
+	sqlMigrations = all[:1]
+	err := s.Migrate()
+	sqlMigrations = all
+	if err != nil {
+		t.Fatalf("Unable to apply the initial schema: %v", err)
+	}
+
+	statements := []string{
+		`INSERT INTO accounts (name, password, admin, created_at, updated_at)
+			VALUES ('someone', 'hashed', 0, 1, 1)`,
+		`INSERT INTO api_keys (account_name, api_key) VALUES ('someone', '123abc')`,
+	}
+	for _, statement := range statements {
+		if _, err := s.DB.Exec(statement); err != nil {
+			t.Fatalf("Unable to store legacy data: %v", err)
+		}
+	}
+
+	if err := s.Migrate(); err != nil {
+		t.Fatalf("Unable to migrate legacy data: %v", err)
+	}
+
+	if _, err := s.FindKey("someone", DigestAPIKey("123abc")); err != nil {
+		t.Errorf("Expected migrated key to be present, but got: %v", err)
+	}
+
+	var n int
+	if err := s.DB.QueryRow(`SELECT COUNT(*) FROM api_keys WHERE prefix = '123abc'`).Scan(&n); err != nil {
+		t.Fatalf("Unable to query migrated keys: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("Expected the migrated key to keep its prefix, but found %d matching rows", n)
+	}
+}
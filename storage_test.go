@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// TestMongoStorageConformance runs the storage conformance suite against a real MongoDB server. It's
+// skipped unless AUTH_TEST_MONGOURL is set. Each check uses, and then drops, its own database.
+func TestMongoStorageConformance(t *testing.T) {
+	url := os.Getenv("AUTH_TEST_MONGOURL")
+	if url == "" {
+		t.Skip("Set AUTH_TEST_MONGOURL to run the MongoDB storage conformance suite.")
+	}
+
+	session, err := mgo.Dial(url)
+	if err != nil {
+		t.Fatalf("Unable to connect to MongoDB at [%s]: %v", url, err)
+	}
+	defer session.Close()
+
+	StorageConformance(t, func(t *testing.T) (Storage, func()) {
+		db := session.DB(fmt.Sprintf("auth_test_%d", time.Now().UnixNano()))
+		storage := &MongoStorage{Database: db}
+		if err := storage.EnsureIndexes(); err != nil {
+			t.Fatalf("Unable to create indexes: %v", err)
+		}
+		return storage, func() { db.DropDatabase() }
+	})
+}
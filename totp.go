@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTPIssuer names auth-store in the authenticator apps that accounts enroll with.
+const TOTPIssuer = "auth-store"
+
+// TOTP parameters. These are the defaults of RFC 6238, which every authenticator app supports.
+const (
+	TOTPSecretLength = 20
+	TOTPDigits       = 6
+	TOTPPeriod       = 30 * time.Second
+
+	// TOTPSkew is the number of periods before or after the current one whose codes are also
+	// accepted, to allow for clock drift.
+	TOTPSkew = 1
+)
+
+// RecoveryCodeCount is the number of recovery codes issued when two-factor authentication is
+// enabled, and RecoveryCodeLength is the number of random bytes in each.
+const (
+	RecoveryCodeCount  = 10
+	RecoveryCodeLength = 5
+)
+
+// TwoFactor is an account's enrollment in TOTP two-factor authentication. Unlike the account's
+// other secrets, the TOTP secret is stored as it is, because codes must be computed from it. Each
+// recovery code is stored as a digest, and may be used once in place of a TOTP code.
+type TwoFactor struct {
+	// Secret is the base32-encoded TOTP secret.
+	Secret string `bson:"secret"`
+
+	// Confirmed is false until a code has been generated from the secret, proving that it was
+	// enrolled successfully. Unconfirmed enrollments aren't enforced.
+	Confirmed bool `bson:"confirmed"`
+
+	// LastStep is the time step of the most recently accepted TOTP code. Codes from that step or
+	// earlier are refused, so that each may be used only once.
+	LastStep int64 `bson:"last_step"`
+
+	RecoveryCodes []string `bson:"recovery_codes"`
+}
+
+// NewTwoFactor generates an unconfirmed TOTP enrollment with a random secret.
+func NewTwoFactor() (*TwoFactor, error) {
+	b := make([]byte, TOTPSecretLength)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return &TwoFactor{Secret: base32.StdEncoding.EncodeToString(b)}, nil
+}
+
+// URI returns the otpauth URI that enrolls the secret in an authenticator app, usually by way of a
+// QR code.
+func (twoFactor *TwoFactor) URI(accountName string) string {
+	params := url.Values{}
+	params.Set("secret", twoFactor.Secret)
+	params.Set("issuer", TOTPIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprintf("%d", TOTPDigits))
+	params.Set("period", fmt.Sprintf("%d", int(TOTPPeriod/time.Second)))
+
+	label := url.QueryEscape(TOTPIssuer + ":" + accountName)
+	return "otpauth://totp/" + strings.Replace(label, "+", "%20", -1) + "?" + params.Encode()
+}
+
+// MatchCode checks a TOTP code against the secret, allowing for TOTPSkew. It returns the time step
+// that the code belongs to, and false if the code doesn't match.
+func (twoFactor *TwoFactor) MatchCode(code string, now time.Time) (int64, bool) {
+	secret, err := base32.StdEncoding.DecodeString(twoFactor.Secret)
+	if err != nil || len(code) != TOTPDigits {
+		return 0, false
+	}
+
+	current := TOTPStep(now)
+	for step := current - TOTPSkew; step <= current+TOTPSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(TOTPCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// TOTPStep returns the time step that a TOTP code is generated for at a given time.
+func TOTPStep(t time.Time) int64 {
+	return t.Unix() / int64(TOTPPeriod/time.Second)
+}
+
+// TOTPCode computes the TOTP code for a secret at a time step, as described by RFC 6238.
+func TOTPCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulus := uint32(1)
+	for i := 0; i < TOTPDigits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTPDigits, value%modulus)
+}
+
+// NewRecoveryCodes securely generates a set of recovery codes. It returns the plaintext codes,
+// which should be shown to the account's owner exactly once, and the digests that are safe to
+// store.
+func NewRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	digests := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, RecoveryCodeLength)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+
+		code := hex.EncodeToString(b)
+		codes[i] = code[:len(code)/2] + "-" + code[len(code)/2:]
+		digests[i] = DigestRecoveryCode(codes[i])
+	}
+	return codes, digests, nil
+}
+
+// DigestRecoveryCode computes the digest that a recovery code is stored under. Codes are compared
+// without regard to case, spaces or dashes.
+func DigestRecoveryCode(code string) string {
+	normalized := strings.ToLower(code)
+	for _, c := range []string{"-", " "} {
+		normalized = strings.Replace(normalized, c, "", -1)
+	}
+	return digestSecret(normalized)
+}
+
+// IsTOTPCode returns true if a second factor looks like a TOTP code, rather than a recovery code.
+func IsTOTPCode(code string) bool {
+	if len(code) != TOTPDigits {
+		return false
+	}
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// Test vectors for SHA-1 from RFC 6238, truncated to six digits.
+	secret := []byte("12345678901234567890")
+	expectations := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+
+	for seconds, expected := range expectations {
+		if code := TOTPCode(secret, TOTPStep(time.Unix(seconds, 0))); code != expected {
+			t.Errorf("Expected the code at %d to be %s, but was %s", seconds, expected, code)
+		}
+	}
+}
+
+func TestTwoFactorMatchCode(t *testing.T) {
+	twoFactor, err := NewTwoFactor()
+	if err != nil {
+		t.Fatalf("Unable to generate a TOTP secret: %v", err)
+	}
+	secret := testTOTPSecret(t, twoFactor)
+
+	now := time.Unix(1234567890, 0)
+	step := TOTPStep(now)
+
+	for _, offset := range []int64{-1, 0, 1} {
+		matched, ok := twoFactor.MatchCode(TOTPCode(secret, step+offset), now)
+		if !ok || matched != step+offset {
+			t.Errorf("Expected a code from step offset %d to match, but got (%d, %v)", offset, matched, ok)
+		}
+	}
+
+	for _, offset := range []int64{-2, 2} {
+		if _, ok := twoFactor.MatchCode(TOTPCode(secret, step+offset), now); ok {
+			t.Errorf("Expected a code from step offset %d to be refused", offset)
+		}
+	}
+
+	if _, ok := twoFactor.MatchCode("12345", now); ok {
+		t.Error("Expected a short code to be refused")
+	}
+}
+
+func TestTwoFactorURI(t *testing.T) {
+	twoFactor := &TwoFactor{Secret: "JBSWY3DPEHPK3PXP"}
+
+	u, err := url.Parse(twoFactor.URI("someone@example.com"))
+	if err != nil {
+		t.Fatalf("Unable to parse otpauth URI: %v", err)
+	}
+
+	if u.Scheme != "otpauth" || u.Host != "totp" {
+		t.Errorf("Unexpected otpauth URI: [%s]", u)
+	}
+	if u.Path != "/auth-store:someone@example.com" {
+		t.Errorf("Unexpected otpauth label: [%s]", u.Path)
+	}
+
+	params := u.Query()
+	if params.Get("secret") != twoFactor.Secret || params.Get("issuer") != TOTPIssuer {
+		t.Errorf("Unexpected otpauth parameters: %v", params)
+	}
+	if params.Get("digits") != "6" || params.Get("period") != "30" {
+		t.Errorf("Unexpected otpauth parameters: %v", params)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, digests, err := NewRecoveryCodes()
+	if err != nil {
+		t.Fatalf("Unable to generate recovery codes: %v", err)
+	}
+
+	if len(codes) != RecoveryCodeCount || len(digests) != RecoveryCodeCount {
+		t.Fatalf("Expected %d recovery codes, but got %d", RecoveryCodeCount, len(codes))
+	}
+
+	seen := make(map[string]bool)
+	for i, code := range codes {
+		if len(code) != 11 || code[5] != '-' {
+			t.Errorf("Unexpected recovery code format: [%s]", code)
+		}
+		if IsTOTPCode(code) {
+			t.Errorf("Expected recovery code [%s] not to look like a TOTP code", code)
+		}
+		if digests[i] != DigestRecoveryCode(code) {
+			t.Errorf("Expected recovery code [%s] to match its digest", code)
+		}
+		if seen[code] {
+			t.Errorf("Duplicate recovery code [%s]", code)
+		}
+		seen[code] = true
+	}
+
+	if DigestRecoveryCode("ABCDE-12345") != DigestRecoveryCode("abcde 12345") {
+		t.Error("Expected recovery codes to ignore case, spaces and dashes")
+	}
+}